@@ -25,6 +25,10 @@ const (
 	MinDiskSizeGB = 1
 	// MaxDiskSizeGB specifies the maximum attached disk size
 	MaxDiskSizeGB = 1023
+	// MaxDataDiskSizeGB specifies the maximum managed data disk size
+	MaxDataDiskSizeGB = 32767
+	// MaxStorageAccountDataDiskSizeGB specifies the maximum data disk size in a storage account
+	MaxStorageAccountDataDiskSizeGB = 4095
 	// MinIPAddressCount specifies the minimum number of IP addresses per network interface
 	MinIPAddressCount = 1
 	// MaxIPAddressCount specifies the maximum number of IP addresses per network interface
@@ -45,7 +45,7 @@ func HandleValidationErrors(e validator.ValidationErrors) error {
 			case strings.HasSuffix(ns, ".StorageProfile"):
 				return errors.Errorf("Unknown storageProfile '%s'. Specify either %s or %s", err.Value().(string), StorageAccount, ManagedDisks)
 			case strings.Contains(ns, ".DiskSizesGB"):
-				return errors.Errorf("A maximum of %d disks may be specified, The range of valid disk size values are [%d, %d]", MaxDisks, MinDiskSizeGB, MaxDiskSizeGB)
+				return errors.Errorf("A maximum of %d disks may be specified, The range of valid disk size values are [%d, %d]", MaxDisks, MinDiskSizeGB, MaxDataDiskSizeGB)
 			case strings.HasSuffix(ns, ".IPAddressCount"):
 				return errors.Errorf("AgentPoolProfile.IPAddressCount needs to be in the range [%d,%d]", MinIPAddressCount, MaxIPAddressCount)
 			default:
@@ -336,6 +336,8 @@ const (
 const (
 	//DefaultExtensionsRootURL  Root URL for extensions
 	DefaultExtensionsRootURL = "https://raw.githubusercontent.com/Azure/aks-engine/master/"
+	// DefaultExtensionsDir is the directory under the root URL that holds the extensions
+	DefaultExtensionsDir = "extensions"
 )
 
 const (
@@ -377,6 +377,8 @@ func convertExtensionProfileToVLabs(api *ExtensionProfile, obj *vlabs.ExtensionP
 	obj.RootURL = api.RootURL
 	obj.Script = api.Script
 	obj.URLQuery = api.URLQuery
+	obj.ExtensionsDir = api.ExtensionsDir
+	obj.ScriptRetries = api.ScriptRetries
 }
 
 func convertExtensionToVLabs(api *Extension, vlabs *vlabs.Extension) {
@@ -527,6 +529,9 @@ func convertKubernetesConfigToVLabs(api *KubernetesConfig, vlabs *vlabs.Kubernet
 	vlabs.AzureCNIVersion = api.AzureCNIVersion
 	vlabs.AzureCNIURLLinux = api.AzureCNIURLLinux
 	vlabs.AzureCNIURLWindows = api.AzureCNIURLWindows
+	vlabs.DisableBGPRoutePropagation = api.DisableBGPRoutePropagation
+	vlabs.InternalLbIdleTimeoutInMinutes = api.InternalLbIdleTimeoutInMinutes
+	vlabs.MasterLbNumberOfProbes = api.MasterLbNumberOfProbes
 	convertAddonsToVlabs(api, vlabs)
 	convertKubeletConfigToVlabs(api, vlabs)
 	convertControllerManagerConfigToVlabs(api, vlabs)
@@ -615,10 +620,11 @@ func convertAddonsToVlabs(a *KubernetesConfig, v *vlabs.KubernetesConfig) {
 	v.Addons = []vlabs.KubernetesAddon{}
 	for i := range a.Addons {
 		v.Addons = append(v.Addons, vlabs.KubernetesAddon{
-			Name:    a.Addons[i].Name,
-			Enabled: a.Addons[i].Enabled,
-			Config:  map[string]string{},
-			Data:    a.Addons[i].Data,
+			Name:        a.Addons[i].Name,
+			Enabled:     a.Addons[i].Enabled,
+			Config:      map[string]string{},
+			Data:        a.Addons[i].Data,
+			Destination: a.Addons[i].Destination,
 		})
 		for j := range a.Addons[i].Containers {
 			v.Addons[i].Containers = append(v.Addons[i].Containers, vlabs.KubernetesContainerSpec{
@@ -630,12 +636,39 @@ func convertAddonsToVlabs(a *KubernetesConfig, v *vlabs.KubernetesConfig) {
 				MemoryLimits:   a.Addons[i].Containers[j].MemoryLimits,
 			})
 		}
+		for j := range a.Addons[i].InitContainers {
+			initContainer := vlabs.KubernetesInitContainerSpec{
+				Name:           a.Addons[i].InitContainers[j].Name,
+				Image:          a.Addons[i].InitContainers[j].Image,
+				CPURequests:    a.Addons[i].InitContainers[j].CPURequests,
+				MemoryRequests: a.Addons[i].InitContainers[j].MemoryRequests,
+				CPULimits:      a.Addons[i].InitContainers[j].CPULimits,
+				MemoryLimits:   a.Addons[i].InitContainers[j].MemoryLimits,
+				Command:        a.Addons[i].InitContainers[j].Command,
+				Args:           a.Addons[i].InitContainers[j].Args,
+			}
+			if a.Addons[i].InitContainers[j].SecurityContext != nil {
+				initContainer.SecurityContext = &vlabs.KubernetesSecurityContext{
+					Privileged:   a.Addons[i].InitContainers[j].SecurityContext.Privileged,
+					RunAsUser:    a.Addons[i].InitContainers[j].SecurityContext.RunAsUser,
+					RunAsNonRoot: a.Addons[i].InitContainers[j].SecurityContext.RunAsNonRoot,
+				}
+			}
+			v.Addons[i].InitContainers = append(v.Addons[i].InitContainers, initContainer)
+		}
 
 		if a.Addons[i].Config != nil {
 			for key, val := range a.Addons[i].Config {
 				v.Addons[i].Config[key] = val
 			}
 		}
+
+		if a.Addons[i].Overrides != nil {
+			v.Addons[i].Overrides = map[string]string{}
+			for key, val := range a.Addons[i].Overrides {
+				v.Addons[i].Overrides[key] = val
+			}
+		}
 	}
 }
 
@@ -703,6 +736,7 @@ func convertMasterProfileToVLabs(api *MasterProfile, vlabsProfile *vlabs.MasterP
 	vlabsProfile.AgentSubnet = api.AgentSubnet
 	vlabsProfile.AvailabilityZones = api.AvailabilityZones
 	vlabsProfile.SinglePlacementGroup = api.SinglePlacementGroup
+	vlabsProfile.NATGatewayID = api.NATGatewayID
 	convertCustomFilesToVlabs(api, vlabsProfile)
 }
 
@@ -767,6 +801,10 @@ func convertAgentPoolProfileToVLabs(api *AgentPoolProfile, p *vlabs.AgentPoolPro
 	p.StorageProfile = api.StorageProfile
 	p.DiskSizesGB = []int{}
 	p.DiskSizesGB = append(p.DiskSizesGB, api.DiskSizesGB...)
+	p.DiskStorageAccountTypes = api.DiskStorageAccountTypes
+	p.DataDiskStorageAccountType = api.DataDiskStorageAccountType
+	p.DataDiskNameTemplate = api.DataDiskNameTemplate
+	p.DataDiskStorageAccountName = api.DataDiskStorageAccountName
 	p.VnetSubnetID = api.VnetSubnetID
 	p.SetSubnet(api.Subnet)
 	p.FQDN = api.FQDN
@@ -379,6 +379,8 @@ func convertVLabsExtensionProfile(vlabs *vlabs.ExtensionProfile, api *ExtensionP
 	api.RootURL = vlabs.RootURL
 	api.Script = vlabs.Script
 	api.URLQuery = vlabs.URLQuery
+	api.ExtensionsDir = vlabs.ExtensionsDir
+	api.ScriptRetries = vlabs.ScriptRetries
 }
 
 func convertVLabsExtension(vlabs *vlabs.Extension, api *Extension) {
@@ -541,6 +543,9 @@ func convertVLabsKubernetesConfig(vlabs *vlabs.KubernetesConfig, api *Kubernetes
 	api.AzureCNIVersion = vlabs.AzureCNIVersion
 	api.AzureCNIURLLinux = vlabs.AzureCNIURLLinux
 	api.AzureCNIURLWindows = vlabs.AzureCNIURLWindows
+	api.DisableBGPRoutePropagation = vlabs.DisableBGPRoutePropagation
+	api.InternalLbIdleTimeoutInMinutes = vlabs.InternalLbIdleTimeoutInMinutes
+	api.MasterLbNumberOfProbes = vlabs.MasterLbNumberOfProbes
 	convertAddonsToAPI(vlabs, api)
 	convertKubeletConfigToAPI(vlabs, api)
 	convertControllerManagerConfigToAPI(vlabs, api)
@@ -583,10 +588,11 @@ func convertAddonsToAPI(v *vlabs.KubernetesConfig, a *KubernetesConfig) {
 	a.Addons = []KubernetesAddon{}
 	for i := range v.Addons {
 		a.Addons = append(a.Addons, KubernetesAddon{
-			Name:    v.Addons[i].Name,
-			Enabled: v.Addons[i].Enabled,
-			Config:  map[string]string{},
-			Data:    v.Addons[i].Data,
+			Name:        v.Addons[i].Name,
+			Enabled:     v.Addons[i].Enabled,
+			Config:      map[string]string{},
+			Data:        v.Addons[i].Data,
+			Destination: v.Addons[i].Destination,
 		})
 		for j := range v.Addons[i].Containers {
 			a.Addons[i].Containers = append(a.Addons[i].Containers, KubernetesContainerSpec{
@@ -598,12 +604,39 @@ func convertAddonsToAPI(v *vlabs.KubernetesConfig, a *KubernetesConfig) {
 				MemoryLimits:   v.Addons[i].Containers[j].MemoryLimits,
 			})
 		}
+		for j := range v.Addons[i].InitContainers {
+			initContainer := KubernetesInitContainerSpec{
+				Name:           v.Addons[i].InitContainers[j].Name,
+				Image:          v.Addons[i].InitContainers[j].Image,
+				CPURequests:    v.Addons[i].InitContainers[j].CPURequests,
+				MemoryRequests: v.Addons[i].InitContainers[j].MemoryRequests,
+				CPULimits:      v.Addons[i].InitContainers[j].CPULimits,
+				MemoryLimits:   v.Addons[i].InitContainers[j].MemoryLimits,
+				Command:        v.Addons[i].InitContainers[j].Command,
+				Args:           v.Addons[i].InitContainers[j].Args,
+			}
+			if v.Addons[i].InitContainers[j].SecurityContext != nil {
+				initContainer.SecurityContext = &KubernetesSecurityContext{
+					Privileged:   v.Addons[i].InitContainers[j].SecurityContext.Privileged,
+					RunAsUser:    v.Addons[i].InitContainers[j].SecurityContext.RunAsUser,
+					RunAsNonRoot: v.Addons[i].InitContainers[j].SecurityContext.RunAsNonRoot,
+				}
+			}
+			a.Addons[i].InitContainers = append(a.Addons[i].InitContainers, initContainer)
+		}
 
 		if v.Addons[i].Config != nil {
 			for key, val := range v.Addons[i].Config {
 				a.Addons[i].Config[key] = val
 			}
 		}
+
+		if v.Addons[i].Overrides != nil {
+			a.Addons[i].Overrides = map[string]string{}
+			for key, val := range v.Addons[i].Overrides {
+				a.Addons[i].Overrides[key] = val
+			}
+		}
 	}
 }
 
@@ -764,6 +797,7 @@ func convertVLabsMasterProfile(vlabs *vlabs.MasterProfile, api *MasterProfile) {
 	api.AgentSubnet = vlabs.AgentSubnet
 	api.AvailabilityZones = vlabs.AvailabilityZones
 	api.SinglePlacementGroup = vlabs.SinglePlacementGroup
+	api.NATGatewayID = vlabs.NATGatewayID
 	convertCustomFilesToAPI(vlabs, api)
 }
 
@@ -828,6 +862,10 @@ func convertVLabsAgentPoolProfile(vlabs *vlabs.AgentPoolProfile, api *AgentPoolP
 	api.StorageProfile = vlabs.StorageProfile
 	api.DiskSizesGB = []int{}
 	api.DiskSizesGB = append(api.DiskSizesGB, vlabs.DiskSizesGB...)
+	api.DiskStorageAccountTypes = vlabs.DiskStorageAccountTypes
+	api.DataDiskStorageAccountType = vlabs.DataDiskStorageAccountType
+	api.DataDiskNameTemplate = vlabs.DataDiskNameTemplate
+	api.DataDiskStorageAccountName = vlabs.DataDiskStorageAccountName
 	api.VnetSubnetID = vlabs.VnetSubnetID
 	api.Subnet = vlabs.GetSubnet()
 	api.IPAddressCount = vlabs.IPAddressCount
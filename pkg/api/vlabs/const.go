@@ -45,6 +45,10 @@ const (
 	MinDiskSizeGB = 1
 	// MaxDiskSizeGB specifies the maximum attached disk size
 	MaxDiskSizeGB = 1023
+	// MaxDataDiskSizeGB specifies the maximum managed data disk size
+	MaxDataDiskSizeGB = 32767
+	// MaxStorageAccountDataDiskSizeGB specifies the maximum data disk size in a storage account
+	MaxStorageAccountDataDiskSizeGB = 4095
 	// MinIPAddressCount specifies the minimum number of IP addresses per network interface
 	MinIPAddressCount = 1
 	// MaxIPAddressCount specifies the maximum number of IP addresses per network interface
@@ -83,6 +87,10 @@ var (
 const (
 	// KubernetesMinMaxPods is the minimum valid value for MaxPods, necessary for running kube-system pods
 	KubernetesMinMaxPods = 5
+	// MinLoadBalancerIdleTimeoutInMinutes is the smallest load balancer rule idle timeout Azure accepts
+	MinLoadBalancerIdleTimeoutInMinutes = 4
+	// MaxLoadBalancerIdleTimeoutInMinutes is the largest load balancer rule idle timeout Azure accepts
+	MaxLoadBalancerIdleTimeoutInMinutes = 30
 )
 
 // vlabs default configuration
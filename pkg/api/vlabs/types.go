@@ -230,13 +230,36 @@ type KubernetesContainerSpec struct {
 	MemoryLimits   string `json:"memoryLimits,omitempty"`
 }
 
+// KubernetesInitContainerSpec defines configuration for an init container spec
+type KubernetesInitContainerSpec struct {
+	Name            string                     `json:"name,omitempty"`
+	Image           string                     `json:"image,omitempty"`
+	CPURequests     string                     `json:"cpuRequests,omitempty"`
+	MemoryRequests  string                     `json:"memoryRequests,omitempty"`
+	CPULimits       string                     `json:"cpuLimits,omitempty"`
+	MemoryLimits    string                     `json:"memoryLimits,omitempty"`
+	Command         []string                   `json:"command,omitempty"`
+	Args            []string                   `json:"args,omitempty"`
+	SecurityContext *KubernetesSecurityContext `json:"securityContext,omitempty"`
+}
+
+// KubernetesSecurityContext defines configuration for the security context of a container
+type KubernetesSecurityContext struct {
+	Privileged   *bool  `json:"privileged,omitempty"`
+	RunAsUser    *int64 `json:"runAsUser,omitempty"`
+	RunAsNonRoot *bool  `json:"runAsNonRoot,omitempty"`
+}
+
 // KubernetesAddon defines a list of addons w/ configuration to include with the cluster deployment
 type KubernetesAddon struct {
-	Name       string                    `json:"name,omitempty"`
-	Enabled    *bool                     `json:"enabled,omitempty"`
-	Containers []KubernetesContainerSpec `json:"containers,omitempty"`
-	Config     map[string]string         `json:"config,omitempty"`
-	Data       string                    `json:"data,omitempty"`
+	Name           string                        `json:"name,omitempty"`
+	Enabled        *bool                         `json:"enabled,omitempty"`
+	Containers     []KubernetesContainerSpec     `json:"containers,omitempty"`
+	InitContainers []KubernetesInitContainerSpec `json:"initContainers,omitempty"`
+	Config         map[string]string             `json:"config,omitempty"`
+	Data           string                        `json:"data,omitempty"`
+	Destination    string                        `json:"destination,omitempty"`
+	Overrides      map[string]string             `json:"overrides,omitempty"`
 }
 
 // IsEnabled returns if the addon is explicitly enabled, or the user-provided default if non explicitly enabled
@@ -317,6 +340,9 @@ type KubernetesConfig struct {
 	AzureCNIVersion                 string            `json:"azureCNIVersion,omitempty"`
 	AzureCNIURLLinux                string            `json:"azureCNIURLLinux,omitempty"`
 	AzureCNIURLWindows              string            `json:"azureCNIURLWindows,omitempty"`
+	DisableBGPRoutePropagation      *bool             `json:"disableBgpRoutePropagation,omitempty"`
+	InternalLbIdleTimeoutInMinutes  int               `json:"internalLbIdleTimeoutInMinutes,omitempty"`
+	MasterLbNumberOfProbes          int               `json:"masterLbNumberOfProbes,omitempty"`
 }
 
 // CustomFile has source as the full absolute source path to a file and dest
@@ -351,6 +377,7 @@ type MasterProfile struct {
 	AgentSubnet              string            `json:"agentSubnet,omitempty"`
 	AvailabilityZones        []string          `json:"availabilityZones,omitempty"`
 	SinglePlacementGroup     *bool             `json:"singlePlacementGroup,omitempty"`
+	NATGatewayID             string            `json:"natGatewayID,omitempty"`
 
 	// subnet is internal
 	subnet string
@@ -377,6 +404,11 @@ type ExtensionProfile struct {
 	// This is only needed for preprovision extensions and it needs to be a bash script
 	Script   string `json:"script,omitempty"`
 	URLQuery string `json:"urlQuery,omitempty"`
+	// ExtensionsDir is the directory between RootURL and the extension name, "extensions" if empty
+	ExtensionsDir string `json:"extensionsDir,omitempty"`
+	// ScriptRetries is the number of times the chmod and execute steps of a Linux preprovision
+	// extension script are retried when they fail, not retried if zero
+	ScriptRetries int `json:"scriptRetries,omitempty"`
 }
 
 // Extension represents an extension definition in the master or agentPoolProfile
@@ -399,7 +431,11 @@ type AgentPoolProfile struct {
 	ScaleSetPriority                    string               `json:"scaleSetPriority,omitempty" validate:"eq=Regular|eq=Low|len=0"`
 	ScaleSetEvictionPolicy              string               `json:"scaleSetEvictionPolicy,omitempty" validate:"eq=Delete|eq=Deallocate|len=0"`
 	StorageProfile                      string               `json:"storageProfile" validate:"eq=StorageAccount|eq=ManagedDisks|len=0"`
-	DiskSizesGB                         []int                `json:"diskSizesGB,omitempty" validate:"max=4,dive,min=1,max=1023"`
+	DiskSizesGB                         []int                `json:"diskSizesGB,omitempty" validate:"max=4,dive,min=1,max=32767"`
+	DiskStorageAccountTypes             []string             `json:"diskStorageAccountTypes,omitempty"`
+	DataDiskStorageAccountType          string               `json:"dataDiskStorageAccountType,omitempty"`
+	DataDiskNameTemplate                string               `json:"dataDiskNameTemplate,omitempty"`
+	DataDiskStorageAccountName          string               `json:"dataDiskStorageAccountName,omitempty"`
 	VnetSubnetID                        string               `json:"vnetSubnetID,omitempty"`
 	IPAddressCount                      int                  `json:"ipAddressCount,omitempty" validate:"min=0,max=256"`
 	Distro                              Distro               `json:"distro,omitempty"`
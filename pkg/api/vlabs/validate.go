@@ -22,10 +22,11 @@ import (
 )
 
 var (
-	validate        *validator.Validate
-	keyvaultIDRegex *regexp.Regexp
-	labelValueRegex *regexp.Regexp
-	labelKeyRegex   *regexp.Regexp
+	validate          *validator.Validate
+	keyvaultIDRegex   *regexp.Regexp
+	natGatewayIDRegex *regexp.Regexp
+	labelValueRegex   *regexp.Regexp
+	labelKeyRegex     *regexp.Regexp
 	// Any version has to be mirrored in https://acs-mirror.azureedge.net/github-coreos/etcd-v[Version]-linux-amd64.tar.gz
 	etcdValidVersions = [...]string{"2.2.5", "2.3.0", "2.3.1", "2.3.2", "2.3.3", "2.3.4", "2.3.5", "2.3.6", "2.3.7", "2.3.8",
 		"3.0.0", "3.0.1", "3.0.2", "3.0.3", "3.0.4", "3.0.5", "3.0.6", "3.0.7", "3.0.8", "3.0.9", "3.0.10", "3.0.11", "3.0.12", "3.0.13", "3.0.14", "3.0.15", "3.0.16", "3.0.17",
@@ -102,6 +103,7 @@ type k8sNetworkConfig struct {
 func init() {
 	validate = validator.New()
 	keyvaultIDRegex = regexp.MustCompile(`^/subscriptions/\S+/resourceGroups/\S+/providers/Microsoft.KeyVault/vaults/[^/\s]+$`)
+	natGatewayIDRegex = regexp.MustCompile(`^/subscriptions/\S+/resourceGroups/\S+/providers/Microsoft.Network/natGateways/[^/\s]+$`)
 	labelValueRegex = regexp.MustCompile(labelValueFormat)
 	labelKeyRegex = regexp.MustCompile(labelKeyFormat)
 }
@@ -338,9 +340,28 @@ func (a *Properties) validateMasterProfile() error {
 	if m.SinglePlacementGroup != nil && m.AvailabilityProfile == AvailabilitySet {
 		return errors.New("singlePlacementGroup is only supported with VirtualMachineScaleSets")
 	}
+	if m.NATGatewayID != "" {
+		if e := a.validateNATGateway(); e != nil {
+			return e
+		}
+	}
 	return common.ValidateDNSPrefix(m.DNSPrefix)
 }
 
+func (a *Properties) validateNATGateway() error {
+	m := a.MasterProfile
+	if !natGatewayIDRegex.MatchString(m.NATGatewayID) {
+		return errors.Errorf("natGatewayID '%s' is invalid, it should be the resource ID of a NAT gateway (/subscriptions/{subscription}/resourceGroups/{resourceGroup}/providers/Microsoft.Network/natGateways/{name})", m.NATGatewayID)
+	}
+	if m.IsCustomVNET() {
+		return errors.New("natGatewayID is not supported with a custom VNET, associate the NAT gateway with the custom VNET subnets instead")
+	}
+	if a.OrchestratorProfile.KubernetesConfig == nil || a.OrchestratorProfile.KubernetesConfig.LoadBalancerSku != "Standard" {
+		return errors.New("natGatewayID requires Standard LoadBalancer. Please set KubernetesConfig \"LoadBalancerSku\" to \"Standard\"")
+	}
+	return nil
+}
+
 func (a *Properties) validateAgentPoolProfiles(isUpdate bool) error {
 
 	profileNames := make(map[string]bool)
@@ -532,6 +553,30 @@ func (a *Properties) validateExtensions() error {
 				return errors.Errorf("Extension %s's keyvault secret reference is of incorrect format", extension.Name)
 			}
 		}
+		if e := validateExtensionURLQuery(extension.URLQuery); e != nil {
+			return errors.Wrapf(e, "invalid URL query for Extension %s", extension.Name)
+		}
+	}
+	return nil
+}
+
+// validateExtensionURLQuery returns an error if a parameter of query, which may start with a "?", has
+// an empty key or an invalid percent-encoding. Unescaped characters are allowed as they are encoded
+// when the extension URLs are built
+func validateExtensionURLQuery(query string) error {
+	for _, param := range strings.Split(strings.TrimPrefix(query, "?"), "&") {
+		if param == "" {
+			continue
+		}
+		kv := strings.SplitN(param, "=", 2)
+		if kv[0] == "" {
+			return errors.Errorf("parameter %s has an empty key", param)
+		}
+		for _, s := range kv {
+			if _, err := url.QueryUnescape(s); err != nil {
+				return errors.Wrapf(err, "parameter %s is not properly encoded", param)
+			}
+		}
 	}
 	return nil
 }
@@ -856,6 +901,13 @@ func (a *AgentPoolProfile) validateOrchestratorSpecificProperties(orchestratorTy
 		if a.StorageProfile == StorageAccount && (a.AvailabilityProfile == VirtualMachineScaleSets) {
 			return errors.Errorf("VirtualMachineScaleSets does not support storage account attached disks.  Instead specify 'StorageAccount': '%s' or specify AvailabilityProfile '%s'", ManagedDisks, AvailabilitySet)
 		}
+		if a.StorageProfile == StorageAccount {
+			for _, diskSizeGB := range a.DiskSizesGB {
+				if diskSizeGB > MaxStorageAccountDataDiskSizeGB {
+					return errors.Errorf("disk size of %d GB is invalid for storage account attached disks in agent pool '%s', the maximum is %d GB", diskSizeGB, a.Name, MaxStorageAccountDataDiskSizeGB)
+				}
+			}
+		}
 	}
 	return nil
 }
@@ -960,6 +1012,16 @@ func (k *KubernetesConfig) Validate(k8sVersion string, hasWindows bool) error {
 		}
 	}
 
+	if k.InternalLbIdleTimeoutInMinutes != 0 {
+		if k.InternalLbIdleTimeoutInMinutes < MinLoadBalancerIdleTimeoutInMinutes || k.InternalLbIdleTimeoutInMinutes > MaxLoadBalancerIdleTimeoutInMinutes {
+			return errors.Errorf("OrchestratorProfile.KubernetesConfig.InternalLbIdleTimeoutInMinutes '%v' must be between %v and %v", k.InternalLbIdleTimeoutInMinutes, MinLoadBalancerIdleTimeoutInMinutes, MaxLoadBalancerIdleTimeoutInMinutes)
+		}
+	}
+
+	if k.MasterLbNumberOfProbes < 0 {
+		return errors.Errorf("OrchestratorProfile.KubernetesConfig.MasterLbNumberOfProbes '%v' must be at least 1", k.MasterLbNumberOfProbes)
+	}
+
 	if k.KubeletConfig != nil {
 		if _, ok := k.KubeletConfig["--node-status-update-frequency"]; ok {
 			val := k.KubeletConfig["--node-status-update-frequency"]
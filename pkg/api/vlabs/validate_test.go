@@ -280,6 +280,22 @@ func Test_KubernetesConfig_Validate(t *testing.T) {
 			t.Error("should error on invalid MaxPods")
 		}
 
+		for _, timeout := range []int{MinLoadBalancerIdleTimeoutInMinutes - 1, MaxLoadBalancerIdleTimeoutInMinutes + 1} {
+			c = KubernetesConfig{
+				InternalLbIdleTimeoutInMinutes: timeout,
+			}
+			if err := c.Validate(k8sVersion, false); err == nil {
+				t.Errorf("should error on invalid InternalLbIdleTimeoutInMinutes %d", timeout)
+			}
+		}
+
+		c = KubernetesConfig{
+			MasterLbNumberOfProbes: -1,
+		}
+		if err := c.Validate(k8sVersion, false); err == nil {
+			t.Error("should error on invalid MasterLbNumberOfProbes")
+		}
+
 		c = KubernetesConfig{
 			KubeletConfig: map[string]string{
 				"--node-status-update-frequency": "invalid",
@@ -659,6 +675,79 @@ func TestProperties_ValidateInvalidExtensionProfiles(t *testing.T) {
 	}
 }
 
+func TestProperties_ValidateExtensionURLQuery(t *testing.T) {
+	tests := []struct {
+		name        string
+		urlQuery    string
+		expectedMsg string
+	}{
+		{
+			name: "no query",
+		},
+		{
+			name:     "well-formed query",
+			urlQuery: "sv=2018-03-28&sig=a%2Bb%2Fc",
+		},
+		{
+			name:     "leading question mark",
+			urlQuery: "?sv=1",
+		},
+		{
+			name:     "unescaped characters",
+			urlQuery: "se=2019-01-01T00:00:00Z&sig=a/c d",
+		},
+		{
+			name:     "empty parameters",
+			urlQuery: "sv=1&&sp=r&",
+		},
+		{
+			name:     "flag without a value",
+			urlQuery: "sv=1&debug",
+		},
+		{
+			name:        "invalid percent-encoding in a value",
+			urlQuery:    "sig=a%zzb",
+			expectedMsg: `invalid URL query for Extension FakeExtensionProfile: parameter sig=a%zzb is not properly encoded: invalid URL escape "%zz"`,
+		},
+		{
+			name:        "truncated percent-encoding in a key",
+			urlQuery:    "s%2=1",
+			expectedMsg: `invalid URL query for Extension FakeExtensionProfile: parameter s%2=1 is not properly encoded: invalid URL escape "%2"`,
+		},
+		{
+			name:        "empty key",
+			urlQuery:    "sv=1&=r",
+			expectedMsg: "invalid URL query for Extension FakeExtensionProfile: parameter =r has an empty key",
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			p := getK8sDefaultProperties(true)
+			p.ExtensionProfiles = []*ExtensionProfile{
+				{
+					Name:     "FakeExtensionProfile",
+					Version:  "v1",
+					RootURL:  "https://example.com/",
+					URLQuery: test.urlQuery,
+				},
+			}
+			err := p.validateExtensions()
+			if test.expectedMsg == "" {
+				if err != nil {
+					t.Errorf("expected no error, but got %s", err.Error())
+				}
+				return
+			}
+			if err == nil || err.Error() != test.expectedMsg {
+				t.Errorf("expected error with message : %s, but got %v", test.expectedMsg, err)
+			}
+		})
+	}
+}
+
 func Test_ServicePrincipalProfile_ValidateSecretOrKeyvaultSecretRef(t *testing.T) {
 
 	t.Run("ServicePrincipalProfile with secret should pass", func(t *testing.T) {
@@ -1785,6 +1874,70 @@ func TestProperties_ValidateSinglePlacementGroup(t *testing.T) {
 	}
 }
 
+func TestProperties_ValidateNATGateway(t *testing.T) {
+	natGatewayID := "/subscriptions/SUB_ID/resourceGroups/RG_NAME/providers/Microsoft.Network/natGateways/NAT_GATEWAY_NAME"
+	tests := []struct {
+		name            string
+		natGatewayID    string
+		vnetSubnetID    string
+		loadBalancerSku string
+		expectedMsg     string
+	}{
+		{
+			name:            "NAT gateway with a Standard load balancer",
+			natGatewayID:    natGatewayID,
+			loadBalancerSku: "Standard",
+		},
+		{
+			name:            "invalid NAT gateway resource ID",
+			natGatewayID:    "/subscriptions/SUB_ID/resourceGroups/RG_NAME/providers/Microsoft.Network/publicIPAddresses/IP_NAME",
+			loadBalancerSku: "Standard",
+			expectedMsg:     "natGatewayID '/subscriptions/SUB_ID/resourceGroups/RG_NAME/providers/Microsoft.Network/publicIPAddresses/IP_NAME' is invalid, it should be the resource ID of a NAT gateway (/subscriptions/{subscription}/resourceGroups/{resourceGroup}/providers/Microsoft.Network/natGateways/{name})",
+		},
+		{
+			name:            "NAT gateway with a custom VNET",
+			natGatewayID:    natGatewayID,
+			vnetSubnetID:    "/subscriptions/SUB_ID/resourceGroups/RG_NAME/providers/Microsoft.Network/virtualNetworks/VNET_NAME/subnets/SUBNET_NAME",
+			loadBalancerSku: "Standard",
+			expectedMsg:     "natGatewayID is not supported with a custom VNET, associate the NAT gateway with the custom VNET subnets instead",
+		},
+		{
+			name:            "NAT gateway with a Basic load balancer",
+			natGatewayID:    natGatewayID,
+			loadBalancerSku: "Basic",
+			expectedMsg:     "natGatewayID requires Standard LoadBalancer. Please set KubernetesConfig \"LoadBalancerSku\" to \"Standard\"",
+		},
+		{
+			name:         "NAT gateway with the default load balancer",
+			natGatewayID: natGatewayID,
+			expectedMsg:  "natGatewayID requires Standard LoadBalancer. Please set KubernetesConfig \"LoadBalancerSku\" to \"Standard\"",
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			p := getK8sDefaultProperties(false)
+			p.MasterProfile.NATGatewayID = test.natGatewayID
+			p.MasterProfile.VnetSubnetID = test.vnetSubnetID
+			p.OrchestratorProfile.KubernetesConfig = &KubernetesConfig{
+				LoadBalancerSku: test.loadBalancerSku,
+			}
+			err := p.validateMasterProfile()
+			if test.expectedMsg == "" {
+				if err != nil {
+					t.Errorf("expected no error, but got %s", err.Error())
+				}
+				return
+			}
+			if err == nil || err.Error() != test.expectedMsg {
+				t.Errorf("expected error with message : %s, but got %v", test.expectedMsg, err)
+			}
+		})
+	}
+}
+
 func TestProperties_ValidateVNET(t *testing.T) {
 	validVNetSubnetID := "/subscriptions/SUB_ID/resourceGroups/RG_NAME/providers/Microsoft.Network/virtualNetworks/VNET_NAME/subnets/SUBNET_NAME"
 	validVNetSubnetID2 := "/subscriptions/SUB_ID2/resourceGroups/RG_NAME2/providers/Microsoft.Network/virtualNetworks/VNET_NAME2/subnets/SUBNET_NAME"
@@ -2157,6 +2310,70 @@ func TestValidateProperties_CustomNodeLabels(t *testing.T) {
 	})
 }
 
+func TestAgentPoolProfile_ValidateDiskSizes(t *testing.T) {
+	t.Run("Should accept the largest managed data disk", func(t *testing.T) {
+		t.Parallel()
+		p := getK8sDefaultProperties(false)
+		p.AgentPoolProfiles[0].StorageProfile = ManagedDisks
+		p.AgentPoolProfiles[0].DiskSizesGB = []int{1, MaxDataDiskSizeGB}
+		if err := p.Validate(false); err != nil {
+			t.Errorf("unexpected error: %s", err.Error())
+		}
+	})
+
+	t.Run("Should fail for a managed data disk above the maximum size", func(t *testing.T) {
+		t.Parallel()
+		p := getK8sDefaultProperties(false)
+		p.AgentPoolProfiles[0].StorageProfile = ManagedDisks
+		p.AgentPoolProfiles[0].DiskSizesGB = []int{MaxDataDiskSizeGB + 1}
+		expectedMsg := "A maximum of 4 disks may be specified, The range of valid disk size values are [1, 32767]"
+		if err := p.Validate(false); err == nil || err.Error() != expectedMsg {
+			t.Errorf("expected error with message : %s, but got %v", expectedMsg, err)
+		}
+	})
+
+	t.Run("Should fail for a storage account data disk above the maximum size", func(t *testing.T) {
+		t.Parallel()
+		p := getK8sDefaultProperties(false)
+		p.AgentPoolProfiles[0].StorageProfile = StorageAccount
+		p.AgentPoolProfiles[0].DiskSizesGB = []int{128, MaxStorageAccountDataDiskSizeGB + 1}
+		expectedMsg := "disk size of 4096 GB is invalid for storage account attached disks in agent pool 'agentpool', the maximum is 4095 GB"
+		if err := p.validateAgentPoolProfiles(true); err == nil || err.Error() != expectedMsg {
+			t.Errorf("expected error with message : %s, but got %v", expectedMsg, err)
+		}
+	})
+}
+
+func TestAgentPoolProfile_ValidatePoolNames(t *testing.T) {
+	t.Run("Should fail for duplicate pool names", func(t *testing.T) {
+		t.Parallel()
+		p := getK8sDefaultProperties(false)
+		p.AgentPoolProfiles = append(p.AgentPoolProfiles, &AgentPoolProfile{
+			Name:                "agentpool",
+			VMSize:              "Standard_D2_v2",
+			Count:               1,
+			AvailabilityProfile: AvailabilitySet,
+		})
+		expectedMsg := "profile name 'agentpool' already exists, profile names must be unique across pools"
+		if err := p.validateAgentPoolProfiles(true); err == nil || err.Error() != expectedMsg {
+			t.Errorf("expected error with message : %s, but got %v", expectedMsg, err)
+		}
+	})
+
+	for _, name := range []string{"Agentpool", "1agentpool", "agent-pool", "agentpool12345"} {
+		name := name
+		t.Run("Should fail for the invalid pool name "+name, func(t *testing.T) {
+			t.Parallel()
+			p := getK8sDefaultProperties(false)
+			p.AgentPoolProfiles[0].Name = name
+			expectedMsg := fmt.Sprintf("pool name '%s' is invalid. A pool name must start with a lowercase letter, have max length of 12, and only have characters a-z0-9", name)
+			if err := p.validateAgentPoolProfiles(true); err == nil || err.Error() != expectedMsg {
+				t.Errorf("expected error with message : %s, but got %v", expectedMsg, err)
+			}
+		})
+	}
+}
+
 func TestAgentPoolProfile_ValidateAvailabilityProfile(t *testing.T) {
 	t.Run("Should fail for invalid availability profile", func(t *testing.T) {
 		t.Parallel()
@@ -5,11 +5,13 @@ package engine
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 
 	"github.com/Azure/aks-engine/pkg/api"
 	"github.com/Azure/aks-engine/pkg/api/common"
 	"github.com/Azure/aks-engine/pkg/helpers"
+	"github.com/pkg/errors"
 )
 
 type kubernetesFeatureSetting struct {
@@ -117,6 +119,60 @@ func kubernetesContainerAddonSettingsInit(profile *api.Properties) map[string]ku
 	}
 }
 
+// GetContainerAddonsStatus reports, for each container addon known to the engine, whether
+// getContainerAddonsString will render it and the reason for that decision
+func GetContainerAddonsStatus(properties *api.Properties) []AddonStatus {
+	settingsMap := kubernetesContainerAddonSettingsInit(properties)
+
+	var addonNames []string
+	for addonName := range settingsMap {
+		addonNames = append(addonNames, addonName)
+	}
+	sort.Strings(addonNames)
+
+	statuses := make([]AddonStatus, 0, len(addonNames))
+	for _, addonName := range addonNames {
+		addon := properties.OrchestratorProfile.KubernetesConfig.GetAddonByName(addonName)
+		status := AddonStatus{
+			Name:    addonName,
+			Enabled: settingsMap[addonName].isEnabled,
+		}
+		switch {
+		case status.Enabled && addon.Enabled != nil:
+			status.Reason = AddonReasonExplicitlyEnabled
+		case status.Enabled:
+			status.Reason = AddonReasonEnabledByDefault
+		case addon.Enabled == nil:
+			status.Reason = AddonReasonDisabledByDefault
+		case !*addon.Enabled:
+			status.Reason = AddonReasonExplicitlyDisabled
+		default:
+			// explicitly enabled, but the cluster version or configuration rules it out
+			status.Reason = AddonReasonIncompatible
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// ValidateContainerAddonSourceFiles returns an error listing the source files beneath sourcePath of
+// the container addons that are not embedded assets, for every addon the settings declare whether
+// or not it is enabled, so a missing asset is caught before the addon is turned on
+func ValidateContainerAddonSourceFiles(properties *api.Properties, sourcePath string) error {
+	var missing []string
+	for _, setting := range kubernetesContainerAddonSettingsInit(properties) {
+		addonFile := sourcePath + "/" + setting.sourceFile
+		if _, err := Asset(addonFile); err != nil {
+			missing = append(missing, addonFile)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return errors.Errorf("container addon source files %s are missing", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
 func kubernetesAddonSettingsInit(profile *api.Properties) []kubernetesFeatureSetting {
 	return []kubernetesFeatureSetting{
 		{
@@ -277,17 +333,25 @@ func kubernetesArtifactSettingsInitAgent(profile *api.Properties) []kubernetesFe
 	}
 }
 
-func getAddonString(input, destinationPath, destinationFile string) string {
-	addonString := getBase64CustomScriptFromStr(input)
+func getAddonString(input, destinationPath, destinationFile string) (string, error) {
+	return getAddonStringWithOptions(input, destinationPath, destinationFile, CustomDataEncodingOptions{})
+}
+
+// getAddonStringWithOptions returns the cloud-init write_files entry of the addon, encoded according to options
+func getAddonStringWithOptions(input, destinationPath, destinationFile string, options CustomDataEncodingOptions) (string, error) {
+	addonString, encoding, err := getEncodedCustomScriptFromStr(input, options)
+	if err != nil {
+		return "", err
+	}
 	contents := []string{
 		fmt.Sprintf("- path: %s/%s", destinationPath, destinationFile),
 		"  permissions: \\\"0644\\\"",
-		"  encoding: gzip",
+		fmt.Sprintf("  encoding: %s", encoding),
 		"  owner: \\\"root\\\"",
 		"  content: !!binary |",
 		fmt.Sprintf("    %s\\n\\n", addonString),
 	}
-	return strings.Join(contents, "\\n")
+	return strings.Join(contents, "\\n"), nil
 }
 
 func substituteConfigString(input string, kubernetesFeatureSettings []kubernetesFeatureSetting, sourcePath string, destinationPath string, placeholder string, orchestratorVersion string) string {
@@ -337,5 +401,5 @@ func getCustomScriptFromFile(sourceFile, sourcePath, version string) string {
 	if err == nil {
 		sourceFileFullPath = sourceFileFullPathVersioned
 	}
-	return getBase64CustomScript(sourceFileFullPath)
+	return getBase64CustomScript(sourceFileFullPath, false)
 }
@@ -0,0 +1,110 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package engine
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Azure/aks-engine/pkg/api"
+	"github.com/Azure/aks-engine/pkg/helpers"
+)
+
+func TestGetContainerAddonsStatus(t *testing.T) {
+	cs := api.CreateMockContainerService("testcluster", "1.11.6", 1, 2, false)
+	cs.Properties.OrchestratorProfile.KubernetesConfig.Addons = []api.KubernetesAddon{
+		{
+			Name:    DefaultTillerAddonName,
+			Enabled: helpers.PointerToBool(true),
+		},
+		{
+			Name:    DefaultDashboardAddonName,
+			Enabled: helpers.PointerToBool(false),
+		},
+		{
+			// the network monitor only applies to Azure CNI clusters
+			Name:    DefaultAzureCNINetworkMonitorAddonName,
+			Enabled: helpers.PointerToBool(true),
+		},
+	}
+	cs.Properties.OrchestratorProfile.KubernetesConfig.NetworkPlugin = NetworkPluginKubenet
+
+	expected := map[string]AddonStatus{
+		DefaultTillerAddonName:                 {Name: DefaultTillerAddonName, Enabled: true, Reason: AddonReasonExplicitlyEnabled},
+		DefaultMetricsServerAddonName:          {Name: DefaultMetricsServerAddonName, Enabled: true, Reason: AddonReasonEnabledByDefault},
+		DefaultDashboardAddonName:              {Name: DefaultDashboardAddonName, Enabled: false, Reason: AddonReasonExplicitlyDisabled},
+		DefaultACIConnectorAddonName:           {Name: DefaultACIConnectorAddonName, Enabled: false, Reason: AddonReasonDisabledByDefault},
+		DefaultAzureCNINetworkMonitorAddonName: {Name: DefaultAzureCNINetworkMonitorAddonName, Enabled: false, Reason: AddonReasonIncompatible},
+	}
+
+	statuses := GetContainerAddonsStatus(cs.Properties)
+	if len(statuses) != len(kubernetesContainerAddonSettingsInit(cs.Properties)) {
+		t.Fatalf("expected a status for every container addon, got %d", len(statuses))
+	}
+	for i, status := range statuses {
+		if i > 0 && statuses[i-1].Name > status.Name {
+			t.Errorf("expected statuses sorted by name, got %s before %s", statuses[i-1].Name, status.Name)
+		}
+		if e, ok := expected[status.Name]; ok && e != status {
+			t.Errorf("expected status %+v, got %+v", e, status)
+		}
+	}
+}
+
+func TestValidateContainerAddonSourceFiles(t *testing.T) {
+	cs := api.CreateMockContainerService("testcluster", "1.11.6", 1, 2, false)
+
+	cases := []struct {
+		name        string
+		sourcePath  string
+		expectedErr bool
+	}{
+		{
+			name:       "default addon assets",
+			sourcePath: "k8s/containeraddons",
+		},
+		{
+			name:        "missing addon assets",
+			sourcePath:  "k8s/missingaddons",
+			expectedErr: true,
+		},
+	}
+
+	for _, c := range cases {
+		err := ValidateContainerAddonSourceFiles(cs.Properties, c.sourcePath)
+		if !c.expectedErr {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", c.name, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Fatalf("%s: expected an error", c.name)
+		}
+		// every declared addon is listed, enabled or not
+		for _, setting := range kubernetesContainerAddonSettingsInit(cs.Properties) {
+			if !strings.Contains(err.Error(), c.sourcePath+"/"+setting.sourceFile) {
+				t.Errorf("%s: expected the error to list %s, got %v", c.name, setting.sourceFile, err)
+			}
+		}
+	}
+}
+
+func TestGetAddonStringWithOptions(t *testing.T) {
+	addon, err := getAddonString("apiVersion: v1", "/etc/kubernetes/addons", "addon.yaml")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(addon, "  encoding: gzip") {
+		t.Errorf("expected the addon to be gzipped by default, got: %s", addon)
+	}
+
+	addon, err = getAddonStringWithOptions("apiVersion: v1", "/etc/kubernetes/addons", "addon.yaml", CustomDataEncodingOptions{Uncompressed: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(addon, "  encoding: b64") || !strings.Contains(addon, "YXBpVmVyc2lvbjogdjE=") {
+		t.Errorf("expected the addon as plain base64, got: %s", addon)
+	}
+}
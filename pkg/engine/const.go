@@ -3,6 +3,8 @@
 
 package engine
 
+import "time"
+
 const (
 	// DefaultVNETCIDR is the default CIDR block for the VNET
 	DefaultVNETCIDR = "10.0.0.0/8"
@@ -93,6 +95,102 @@ const (
 	DefaultMasterEtcdClientPort = 2379
 )
 
+const (
+	// AddonReasonExplicitlyEnabled is reported for an addon enabled in the cluster configuration
+	AddonReasonExplicitlyEnabled = "explicitly enabled"
+	// AddonReasonEnabledByDefault is reported for an addon enabled by the aks-engine defaults
+	AddonReasonEnabledByDefault = "enabled by default"
+	// AddonReasonExplicitlyDisabled is reported for an addon disabled in the cluster configuration
+	AddonReasonExplicitlyDisabled = "explicitly disabled"
+	// AddonReasonDisabledByDefault is reported for an addon disabled by the aks-engine defaults
+	AddonReasonDisabledByDefault = "disabled by default"
+	// AddonReasonIncompatible is reported for an addon that is enabled in the cluster configuration
+	// but is not supported by the cluster's Kubernetes version or configuration
+	AddonReasonIncompatible = "not supported by the cluster version or configuration"
+)
+
+const (
+	// DefaultSecurityRuleBasePriority is the priority of the first generated NSG rule
+	DefaultSecurityRuleBasePriority = 200
+	// MinSecurityRulePriority is the lowest priority value, i.e. the highest precedence, Azure accepts for an NSG rule
+	MinSecurityRulePriority = 100
+	// MaxSecurityRulePriority is the highest priority value Azure accepts for an NSG rule
+	MaxSecurityRulePriority = 4096
+	// MaxSecurityRulesPerNSG is the number of rules Azure accepts in a network security group
+	MaxSecurityRulesPerNSG = 1000
+	// SecurityRuleCountWarningThreshold is the number of rules in a network security group past which
+	// it is reported as close to MaxSecurityRulesPerNSG
+	SecurityRuleCountWarningThreshold = 900
+)
+
+const (
+	// DefaultLoadBalancerIdleTimeoutInMinutes is the idle timeout of the master load balancer rules
+	DefaultLoadBalancerIdleTimeoutInMinutes = 5
+	// DefaultLoadBalancerNumberOfProbes is the number of failed probes after which a backend is taken out of rotation
+	DefaultLoadBalancerNumberOfProbes = 2
+	// DefaultLoadBalancerProbeIntervalInSeconds is the interval between the health probes of a backend
+	DefaultLoadBalancerProbeIntervalInSeconds = 5
+	// MinLoadBalancerProbeIntervalInSeconds is the shortest probe interval Azure accepts
+	MinLoadBalancerProbeIntervalInSeconds = 5
+)
+
+const (
+	// MasterAPIServerPort is the port the master load balancer exposes the API server on
+	MasterAPIServerPort = 443
+	// MasterVMSSSSHNatPortStart is the first frontend port of the SSH NAT pool of VMSS masters
+	MasterVMSSSSHNatPortStart = 50001
+	// MasterVMSSSSHNatPortEnd is the last frontend port of the SSH NAT pool of VMSS masters
+	MasterVMSSSSHNatPortEnd = 50119
+)
+
+// masterSSHNatPorts are the frontend ports of the SSH NAT rules of availability set masters, see sshNatPorts
+var masterSSHNatPorts = []int{22, 2201, 2202, 2203, 2204}
+
+const (
+	// CustomDataEncodingGzip is the cloud-init encoding of gzipped base64 file content
+	CustomDataEncodingGzip = "gzip"
+	// CustomDataEncodingBase64 is the cloud-init encoding of plain base64 file content
+	CustomDataEncodingBase64 = "b64"
+)
+
+const (
+	// DefaultExtensionFetchBackoff is the delay before the first retry of a failed extension resource request
+	DefaultExtensionFetchBackoff = time.Second
+)
+
+const (
+	// DataStorageAccountPrefixSeed offsets the index into the storage account prefixes of the data
+	// storage accounts, see GetAgentPoolDataStorageAccountPrefixSeed
+	DataStorageAccountPrefixSeed = 97
+	// MaxVMsPerPool is the number of VMs the storage accounts of an agent pool are sized for
+	MaxVMsPerPool = 100
+	// MaxVMsPerStorageAccount is the number of VMs whose disks are stored in a single storage account
+	MaxVMsPerStorageAccount = 20
+)
+
+const (
+	// ExtensionScriptRetryDelayInSeconds is the delay between the attempts of a failed extension script step
+	ExtensionScriptRetryDelayInSeconds = 10
+)
+
+const (
+	// CombinedAddonsManifestFile is the file of the addon manifests combined into a single multi-document YAML
+	CombinedAddonsManifestFile = "combined-addons.yaml"
+)
+
+// provisionedAddonFiles are the container addon files the provisioning scripts substitute placeholders
+// in once written, which are left out of the combined addon manifest for the scripts to find them.
+// The other addon files the scripts edit, such as kube-proxy-daemonset.yaml, are never combined
+var provisionedAddonFiles = map[string]bool{
+	"aci-connector-deployment.yaml":      true,
+	"cluster-autoscaler-deployment.yaml": true,
+}
+
+const (
+	// KubeConfigAuthModeToken authenticates the kubeconfig user with a static bearer token
+	KubeConfigAuthModeToken = "token"
+)
+
 const (
 	//DefaultExtensionsRootURL  Root URL for extensions
 	DefaultExtensionsRootURL = "https://raw.githubusercontent.com/Azure/aks-engine/master/"
@@ -72,5 +72,9 @@ func getBase64CustomFile(source io.Reader) string {
 	buf.ReadFrom(source)
 	cfStr := buf.String()
 	cfStr = strings.Replace(cfStr, "\r\n", "\n", -1)
-	return getBase64CustomScriptFromStr(cfStr)
+	b64Str, err := getBase64CustomScriptFromStr(cfStr)
+	if err != nil {
+		panic(fmt.Sprintf("BUG: %s", err.Error()))
+	}
+	return b64Str
 }
@@ -6,82 +6,215 @@ package engine
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"text/template" //log "github.com/sirupsen/logrus"
+	"time"
 
 	"github.com/Azure/aks-engine/pkg/api"
+	"github.com/Azure/aks-engine/pkg/api/common"
 	"github.com/Azure/aks-engine/pkg/helpers"
 	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
 )
 
 var commonTemplateFiles = []string{agentOutputs, agentParams, masterOutputs, iaasOutputs, masterParams, windowsParams}
 var kubernetesTemplateFiles = []string{kubernetesBaseFile, kubernetesAgentResourcesVMAS, kubernetesAgentResourcesVMSS, kubernetesAgentVars, kubernetesMasterResourcesVMAS, kubernetesMasterResourcesVMSS, kubernetesMasterVars, kubernetesParams, kubernetesWinAgentVars, kubernetesWinAgentVarsVMSS}
 
+// GetTemplateFiles returns the names of the template assets the template of the container service
+// is composed of, the common files followed by the files of its orchestrator. It returns an error for
+// an orchestrator the engine does not generate templates for
+func GetTemplateFiles(cs *api.ContainerService) ([]string, error) {
+	if cs == nil || cs.Properties == nil || cs.Properties.OrchestratorProfile == nil {
+		return nil, errors.New("OrchestratorProfile property may not be nil in GetTemplateFiles")
+	}
+	if !cs.Properties.OrchestratorProfile.IsKubernetes() {
+		return nil, errors.Errorf("orchestrator %s has no template files", cs.Properties.OrchestratorProfile.OrchestratorType)
+	}
+	files := make([]string, 0, len(commonTemplateFiles)+len(kubernetesTemplateFiles))
+	files = append(files, commonTemplateFiles...)
+	return append(files, kubernetesTemplateFiles...), nil
+}
+
 var keyvaultSecretPathRe *regexp.Regexp
 
+// keyvaultSecretNameRegex matches the names KeyVault accepts for a secret
+var keyvaultSecretNameRegex = regexp.MustCompile(`^[a-zA-Z0-9-]{1,127}$`)
+
+// dataDiskNameRegex matches the characters allowed in a managed disk name
+var dataDiskNameRegex = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+// storageAccountNameRegex matches valid Azure storage account names
+var storageAccountNameRegex = regexp.MustCompile(`^[a-z0-9]{3,24}$`)
+
+// probeNamePrefixRegex matches the probe name prefixes that keep a probe name valid
+var probeNamePrefixRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// serviceTagRegex matches Azure service tags, optionally scoped to a region as in Storage.WestUS
+var serviceTagRegex = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9]*(\.[a-zA-Z0-9]+)?$`)
+
+// kubernetesNamespaceRegex matches the RFC 1123 labels Kubernetes accepts as namespace names
+var kubernetesNamespaceRegex = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,61}[a-z0-9])?$`)
+
+// kubernetesSecretNameRegex matches the RFC 1123 subdomains Kubernetes accepts as secret names
+var kubernetesSecretNameRegex = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+
+// kubernetesContainerNameRegex matches the RFC 1123 labels Kubernetes accepts as container names
+var kubernetesContainerNameRegex = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,61}[a-z0-9])?$`)
+
+// linuxUserNameRegex matches the user names useradd accepts by default
+var linuxUserNameRegex = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,31}$`)
+
+// managedDiskStorageAccountTypes are the storage tiers that may be set on a managed data disk
+var managedDiskStorageAccountTypes = []string{"Standard_LRS", "StandardSSD_LRS", "Premium_LRS"}
+
+// unsupportedManagedDiskStorageAccountTypes are the storage tiers the compute API version of the
+// templates can't create data disks with
+var unsupportedManagedDiskStorageAccountTypes = []string{"PremiumV2_LRS", "UltraSSD_LRS"}
+
+// premiumStorageAccountTypes are the storage tiers that may only be attached to VM sizes supporting
+// premium storage, see SupportsPremiumStorage
+var premiumStorageAccountTypes = []string{"Premium_LRS"}
+
 func init() {
 	keyvaultSecretPathRe = regexp.MustCompile(`^(/subscriptions/\S+/resourceGroups/\S+/providers/Microsoft.KeyVault/vaults/\S+)/secrets/([^/\s]+)(/(\S+))?$`)
 }
 
 // GenerateKubeConfig returns a JSON string representing the KubeConfig
 func GenerateKubeConfig(properties *api.Properties, location string) (string, error) {
+	return GenerateKubeConfigWithOptions(properties, location, KubeConfigOptions{})
+}
+
+// GenerateKubeConfigWithOptions returns a JSON string representing the KubeConfig customized by options
+func GenerateKubeConfigWithOptions(properties *api.Properties, location string, options KubeConfigOptions) (string, error) {
 	if properties == nil {
 		return "", errors.New("Properties nil in GenerateKubeConfig")
 	}
 	if properties.CertificateProfile == nil {
 		return "", errors.New("CertificateProfile property may not be nil in GenerateKubeConfig")
 	}
+	if properties.MasterProfile == nil {
+		return "", errors.New("MasterProfile property may not be nil in GenerateKubeConfig")
+	}
+	if err := ValidateFirstConsecutiveStaticIP(properties); err != nil {
+		return "", errors.Wrap(err, "invalid master addresses in GenerateKubeConfig")
+	}
+	cloud := options.CloudEnvironment
+	if cloud != nil && (cloud.Name == "" || cloud.ResourceManagerVMDNSSuffix == "") {
+		return "", errors.New("a cloud environment requires a name and a VM DNS suffix in GenerateKubeConfig")
+	}
+	fqdn := getMasterFQDN(properties.MasterProfile.DNSPrefix, location, cloud)
+	if err := validateFQDNPrefix(properties.MasterProfile.DNSPrefix, fqdn); err != nil {
+		return "", errors.Wrap(err, "invalid MasterProfile.DNSPrefix in GenerateKubeConfig")
+	}
 	b, err := Asset(kubeConfigJSON)
 	if err != nil {
 		return "", errors.Wrapf(err, "error reading kube config template file %s", kubeConfigJSON)
 	}
 	kubeconfig := string(b)
+	// the alternate endpoints reuse the placeholders of the default cluster and context
+	additionalClusters, additionalContexts, err := getKubeConfigAlternateEndpoints(properties.MasterProfile.DNSPrefix, options.AlternateEndpoints)
+	if err != nil {
+		return "", err
+	}
+	kubeconfig = strings.Replace(kubeconfig, "{{additionalClusters}}", additionalClusters, -1)
+	kubeconfig = strings.Replace(kubeconfig, "{{additionalContexts}}", additionalContexts, -1)
 	// variable replacement
-	kubeconfig = strings.Replace(kubeconfig, "{{WrapAsVerbatim \"parameters('caCertificate')\"}}", base64.StdEncoding.EncodeToString([]byte(properties.CertificateProfile.CaCertificate)), -1)
-	if properties.OrchestratorProfile != nil &&
-		properties.OrchestratorProfile.KubernetesConfig != nil &&
-		properties.OrchestratorProfile.KubernetesConfig.PrivateCluster != nil &&
-		helpers.IsTrueBoolPointer(properties.OrchestratorProfile.KubernetesConfig.PrivateCluster.Enabled) {
-		if properties.MasterProfile.Count > 1 {
-			// more than 1 master, use the internal lb IP
-			firstMasterIP := net.ParseIP(properties.MasterProfile.FirstConsecutiveStaticIP).To4()
-			if firstMasterIP == nil {
-				return "", errors.Errorf("MasterProfile.FirstConsecutiveStaticIP '%s' is an invalid IP address", properties.MasterProfile.FirstConsecutiveStaticIP)
-			}
-			lbIP := net.IP{firstMasterIP[0], firstMasterIP[1], firstMasterIP[2], firstMasterIP[3] + byte(DefaultInternalLbStaticIPOffset)}
-			kubeconfig = strings.Replace(kubeconfig, "{{WrapAsVerbatim \"reference(concat('Microsoft.Network/publicIPAddresses/', variables('masterPublicIPAddressName'))).dnsSettings.fqdn\"}}", lbIP.String(), -1)
-		} else {
-			// Master count is 1, use the master IP
-			kubeconfig = strings.Replace(kubeconfig, "{{WrapAsVerbatim \"reference(concat('Microsoft.Network/publicIPAddresses/', variables('masterPublicIPAddressName'))).dnsSettings.fqdn\"}}", properties.MasterProfile.FirstConsecutiveStaticIP, -1)
+	caCertificate := properties.CertificateProfile.CaCertificate
+	if options.CAFilePath != "" {
+		if caCertificate, err = readPEMCertificateFile(options.CAFilePath); err != nil {
+			return "", err
+		}
+	}
+	kubeconfig = strings.Replace(kubeconfig, "{{WrapAsVerbatim \"parameters('caCertificate')\"}}", base64.StdEncoding.EncodeToString([]byte(caCertificate)), -1)
+	serverEndpoint, err := resolveAPIServerEndpoint(properties, fqdn)
+	if err != nil {
+		return "", err
+	}
+	if options.MasterIndex != nil {
+		if properties.MasterProfile.IsVirtualMachineScaleSets() {
+			return "", errors.New("master index is not supported in GenerateKubeConfig for virtual machine scale set masters, whose IPs are dynamic")
+		}
+		if index := *options.MasterIndex; index < 0 || index >= properties.MasterProfile.Count {
+			return "", errors.Errorf("master index %d is out of range for %d masters in GenerateKubeConfig", index, properties.MasterProfile.Count)
+		}
+		if serverEndpoint, err = MasterIP(properties.MasterProfile.FirstConsecutiveStaticIP, *options.MasterIndex); err != nil {
+			return "", err
 		}
-	} else {
-		kubeconfig = strings.Replace(kubeconfig, "{{WrapAsVerbatim \"reference(concat('Microsoft.Network/publicIPAddresses/', variables('masterPublicIPAddressName'))).dnsSettings.fqdn\"}}", api.FormatAzureProdFQDNByLocation(properties.MasterProfile.DNSPrefix, location), -1)
 	}
+	kubeconfig = strings.Replace(kubeconfig, "{{WrapAsVerbatim \"reference(concat('Microsoft.Network/publicIPAddresses/', variables('masterPublicIPAddressName'))).dnsSettings.fqdn\"}}", serverEndpoint, -1)
 	kubeconfig = strings.Replace(kubeconfig, "{{WrapAsVariable \"resourceGroup\"}}", properties.MasterProfile.DNSPrefix, -1)
 
+	var proxyURL string
+	if options.ProxyURL != "" {
+		u, err := url.Parse(options.ProxyURL)
+		if err != nil || u.Host == "" {
+			return "", errors.Errorf("invalid proxy URL %s in GenerateKubeConfig", options.ProxyURL)
+		}
+		b, _ := json.Marshal(options.ProxyURL)
+		proxyURL = fmt.Sprintf(",\"proxy-url\":%s", b)
+	}
+	kubeconfig = strings.Replace(kubeconfig, "{{proxyURL}}", proxyURL, -1)
+
+	var namespace string
+	if options.Namespace != "" {
+		if !kubernetesNamespaceRegex.MatchString(options.Namespace) {
+			return "", errors.Errorf("invalid namespace %s in GenerateKubeConfig, it must be a lowercase RFC 1123 label of at most 63 characters", options.Namespace)
+		}
+		namespace = fmt.Sprintf(",\"namespace\":\"%s\"", options.Namespace)
+	}
+	kubeconfig = strings.Replace(kubeconfig, "{{namespace}}", namespace, -1)
+
+	userName := properties.MasterProfile.DNSPrefix + "-admin"
+	if options.UserName != "" {
+		if strings.TrimSpace(options.UserName) != options.UserName {
+			return "", errors.Errorf("invalid user name %q in GenerateKubeConfig, it may not have leading or trailing whitespace", options.UserName)
+		}
+		userName = options.UserName
+	}
+	b, _ = json.Marshal(userName)
+	kubeconfig = strings.Replace(kubeconfig, "{{userName}}", string(b), -1)
+
 	var authInfo string
-	if properties.AADProfile == nil {
+	switch {
+	case options.AuthMode == KubeConfigAuthModeToken:
+		if options.Token == "" {
+			return "", errors.New("a token is required for token auth in GenerateKubeConfig")
+		}
+		b, _ := json.Marshal(options.Token)
+		authInfo = fmt.Sprintf("{\"token\":%s}", b)
+	case options.AuthMode != "":
+		return "", errors.Errorf("unsupported auth mode %s in GenerateKubeConfig", options.AuthMode)
+	case properties.AADProfile == nil:
 		authInfo = fmt.Sprintf("{\"client-certificate-data\":\"%v\",\"client-key-data\":\"%v\"}",
 			base64.StdEncoding.EncodeToString([]byte(properties.CertificateProfile.KubeConfigCertificate)),
 			base64.StdEncoding.EncodeToString([]byte(properties.CertificateProfile.KubeConfigPrivateKey)))
-	} else {
+	default:
 		tenantID := properties.AADProfile.TenantID
 		if len(tenantID) == 0 {
 			tenantID = "common"
 		}
+		environment := helpers.GetCloudTargetEnv(location)
+		if cloud != nil {
+			environment = cloud.Name
+		}
 
 		authInfo = fmt.Sprintf("{\"auth-provider\":{\"name\":\"azure\",\"config\":{\"environment\":\"%v\",\"tenant-id\":\"%v\",\"apiserver-id\":\"%v\",\"client-id\":\"%v\"}}}",
-			helpers.GetCloudTargetEnv(location),
+			environment,
 			tenantID,
 			properties.AADProfile.ServerAppID,
 			properties.AADProfile.ClientAppID)
@@ -91,6 +224,388 @@ func GenerateKubeConfig(properties *api.Properties, location string) (string, er
 	return kubeconfig, nil
 }
 
+// readPEMCertificateFile returns the contents of a file holding a PEM encoded certificate
+func readPEMCertificateFile(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", errors.Wrapf(err, "error reading CA file %s", path)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return "", errors.Errorf("CA file %s does not contain a PEM encoded certificate", path)
+	}
+	if _, err = x509.ParseCertificate(block.Bytes); err != nil {
+		return "", errors.Wrapf(err, "error parsing the certificate in CA file %s", path)
+	}
+	return string(b), nil
+}
+
+// getKubeConfigAlternateEndpoints returns the kubeconfig clusters and contexts of the alternate
+// endpoints, each prefixed with a comma to follow the default cluster and context. The contexts use the
+// user of the default context and the clusters reuse the certificate authority of the default cluster
+func getKubeConfigAlternateEndpoints(dnsPrefix string, endpoints []KubeConfigEndpoint) (string, string, error) {
+	var clusters, contexts bytes.Buffer
+	names := map[string]bool{dnsPrefix: true}
+	for _, endpoint := range endpoints {
+		if endpoint.Name == "" || endpoint.Server == "" {
+			return "", "", errors.New("kubeconfig alternate endpoints require a name and a server")
+		}
+		if names[endpoint.Name] {
+			return "", "", errors.Errorf("kubeconfig alternate endpoint name %s is not unique", endpoint.Name)
+		}
+		names[endpoint.Name] = true
+		name, _ := json.Marshal(endpoint.Name)
+		server, _ := json.Marshal("https://" + endpoint.Server)
+		clusters.WriteString(fmt.Sprintf(",{\"cluster\":{\"certificate-authority-data\":\"{{WrapAsVerbatim \"parameters('caCertificate')\"}}\",\"server\":%s},\"name\":%s}", server, name))
+		contexts.WriteString(fmt.Sprintf(",{\"context\":{\"cluster\":%s,\"user\":{{userName}}{{namespace}}},\"name\":%s}", name, name))
+	}
+	return clusters.String(), contexts.String(), nil
+}
+
+// ValidateFQDNPrefix checks that dnsPrefix is a legal DNS label that yields a valid Azure FQDN
+// for the given location
+func ValidateFQDNPrefix(dnsPrefix, location string) error {
+	return validateFQDNPrefix(dnsPrefix, api.FormatAzureProdFQDNByLocation(dnsPrefix, location))
+}
+
+// getMasterFQDN returns the FQDN of the masters, formatted with the DNS suffix of cloud if set and
+// of the cloud of the location otherwise
+func getMasterFQDN(dnsPrefix, location string, cloud *KubeConfigCloudEnvironment) string {
+	if cloud != nil {
+		return fmt.Sprintf("%s.%s.%s", dnsPrefix, location, cloud.ResourceManagerVMDNSSuffix)
+	}
+	return api.FormatAzureProdFQDNByLocation(dnsPrefix, location)
+}
+
+// validateFQDNPrefix checks that dnsPrefix is a legal DNS label and fqdn, formatted from it, a valid FQDN
+func validateFQDNPrefix(dnsPrefix, fqdn string) error {
+	if err := common.ValidateDNSPrefix(dnsPrefix); err != nil {
+		return err
+	}
+	if len(fqdn) > 253 {
+		return errors.Errorf("FQDN '%s' is invalid, it must not exceed 253 characters (length was %d)", fqdn, len(fqdn))
+	}
+	for _, label := range strings.Split(fqdn, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return errors.Errorf("FQDN '%s' is invalid, each label must contain between 1 and 63 characters", fqdn)
+		}
+	}
+	return nil
+}
+
+// ResolveAPIServerEndpoint returns the API server endpoint used by GenerateKubeConfig:
+// the internal LB IP for multi-master private clusters, the master IP for single-master
+// private clusters, and the master FQDN otherwise
+func ResolveAPIServerEndpoint(properties *api.Properties, location string) (string, error) {
+	if properties == nil || properties.MasterProfile == nil {
+		return resolveAPIServerEndpoint(properties, "")
+	}
+	return resolveAPIServerEndpoint(properties, api.FormatAzureProdFQDNByLocation(properties.MasterProfile.DNSPrefix, location))
+}
+
+// resolveAPIServerEndpoint is ResolveAPIServerEndpoint with the master FQDN already formatted
+func resolveAPIServerEndpoint(properties *api.Properties, fqdn string) (string, error) {
+	if properties == nil {
+		return "", errors.New("Properties nil in ResolveAPIServerEndpoint")
+	}
+	if properties.MasterProfile == nil {
+		return "", errors.New("MasterProfile property may not be nil in ResolveAPIServerEndpoint")
+	}
+	if properties.OrchestratorProfile != nil &&
+		properties.OrchestratorProfile.KubernetesConfig != nil &&
+		properties.OrchestratorProfile.KubernetesConfig.PrivateCluster != nil &&
+		helpers.IsTrueBoolPointer(properties.OrchestratorProfile.KubernetesConfig.PrivateCluster.Enabled) {
+		if properties.MasterProfile.Count > 1 {
+			// more than 1 master, use the internal lb IP
+			if err := ValidateInternalLoadBalancerIP(properties); err != nil {
+				return "", err
+			}
+			if err := ValidateInternalLoadBalancerIPOffset(properties); err != nil {
+				return "", err
+			}
+			return InternalLoadBalancerIP(properties.MasterProfile.FirstConsecutiveStaticIP)
+		}
+		// Master count is 1, use the master IP
+		return properties.MasterProfile.FirstConsecutiveStaticIP, nil
+	}
+	return fqdn, nil
+}
+
+// InternalLoadBalancerIP returns the static IP of the internal load balancer in front of the
+// masters of a private cluster, which is DefaultInternalLbStaticIPOffset addresses past the first
+// master's IP. It returns an error if firstConsecutiveStaticIP is not an IPv4 address or the offset
+// would overflow its last octet
+func InternalLoadBalancerIP(firstConsecutiveStaticIP string) (string, error) {
+	firstMasterIP := net.ParseIP(firstConsecutiveStaticIP).To4()
+	if firstMasterIP == nil {
+		return "", errors.Errorf("MasterProfile.FirstConsecutiveStaticIP '%s' is an invalid IP address", firstConsecutiveStaticIP)
+	}
+	if int(firstMasterIP[3])+DefaultInternalLbStaticIPOffset > 255 {
+		return "", errors.Errorf("MasterProfile.FirstConsecutiveStaticIP '%s' leaves no room for the internal load balancer IP at offset %d", firstConsecutiveStaticIP, DefaultInternalLbStaticIPOffset)
+	}
+	lbIP := net.IP{firstMasterIP[0], firstMasterIP[1], firstMasterIP[2], firstMasterIP[3] + byte(DefaultInternalLbStaticIPOffset)}
+	return lbIP.String(), nil
+}
+
+// MasterIP returns the static IP of the master at index, which is index addresses past the first
+// master's IP. It returns an error if firstConsecutiveStaticIP is not an IPv4 address or the index
+// would overflow its last octet
+func MasterIP(firstConsecutiveStaticIP string, index int) (string, error) {
+	firstMasterIP := net.ParseIP(firstConsecutiveStaticIP).To4()
+	if firstMasterIP == nil {
+		return "", errors.Errorf("MasterProfile.FirstConsecutiveStaticIP '%s' is an invalid IP address", firstConsecutiveStaticIP)
+	}
+	if index < 0 || int(firstMasterIP[3])+index > 255 {
+		return "", errors.Errorf("MasterProfile.FirstConsecutiveStaticIP '%s' leaves no room for the IP of master %d", firstConsecutiveStaticIP, index)
+	}
+	masterIP := net.IP{firstMasterIP[0], firstMasterIP[1], firstMasterIP[2], firstMasterIP[3] + byte(index)}
+	return masterIP.String(), nil
+}
+
+// ValidateInternalLoadBalancerIPOffset returns an error if the internal load balancer IP, which is
+// DefaultInternalLbStaticIPOffset addresses past MasterProfile.FirstConsecutiveStaticIP, is not past
+// the IP of the last master, so that the two collide, or if the IP of the last master is outside of
+// MasterProfile.Subnet
+func ValidateInternalLoadBalancerIPOffset(properties *api.Properties) error {
+	if properties.MasterProfile == nil {
+		return nil
+	}
+	masterCount := properties.MasterProfile.Count
+	if masterCount < 1 {
+		return errors.Errorf("master count %d must be at least 1", masterCount)
+	}
+	lastMasterIP, err := MasterIP(properties.MasterProfile.FirstConsecutiveStaticIP, masterCount-1)
+	if err != nil {
+		return err
+	}
+	if masterCount > DefaultInternalLbStaticIPOffset {
+		lbIP, err := InternalLoadBalancerIP(properties.MasterProfile.FirstConsecutiveStaticIP)
+		if err != nil {
+			return err
+		}
+		return errors.Errorf("the IPs of %d masters from %s to %s include the internal load balancer IP %s at offset %d",
+			masterCount, properties.MasterProfile.FirstConsecutiveStaticIP, lastMasterIP, lbIP, DefaultInternalLbStaticIPOffset)
+	}
+	if properties.MasterProfile.Subnet == "" {
+		return nil
+	}
+	_, subnet, err := net.ParseCIDR(properties.MasterProfile.Subnet)
+	if err != nil {
+		return errors.Wrapf(err, "MasterProfile.Subnet '%s' is an invalid CIDR", properties.MasterProfile.Subnet)
+	}
+	if !subnet.Contains(net.ParseIP(lastMasterIP)) {
+		return errors.Errorf("the IP %s of master %d is outside of MasterProfile.Subnet %s", lastMasterIP, masterCount-1, properties.MasterProfile.Subnet)
+	}
+	return nil
+}
+
+// ValidateFirstConsecutiveStaticIP returns an error if MasterProfile.FirstConsecutiveStaticIP is not
+// a valid IPv4 address inside of MasterProfile.Subnet
+func ValidateFirstConsecutiveStaticIP(properties *api.Properties) error {
+	if properties.MasterProfile == nil || properties.MasterProfile.Subnet == "" {
+		return nil
+	}
+	_, subnet, err := net.ParseCIDR(properties.MasterProfile.Subnet)
+	if err != nil {
+		return errors.Wrapf(err, "MasterProfile.Subnet '%s' is an invalid CIDR", properties.MasterProfile.Subnet)
+	}
+	firstConsecutiveStaticIP := properties.MasterProfile.FirstConsecutiveStaticIP
+	ip := net.ParseIP(firstConsecutiveStaticIP).To4()
+	if ip == nil {
+		return errors.Errorf("MasterProfile.FirstConsecutiveStaticIP '%s' is an invalid IPv4 address", firstConsecutiveStaticIP)
+	}
+	if !subnet.Contains(ip) {
+		return errors.Errorf("MasterProfile.FirstConsecutiveStaticIP %s is outside of MasterProfile.Subnet %s", firstConsecutiveStaticIP, properties.MasterProfile.Subnet)
+	}
+	return nil
+}
+
+// ValidateInternalLoadBalancerIP returns an error if the internal load balancer IP computed from
+// MasterProfile.FirstConsecutiveStaticIP is outside of MasterProfile.Subnet or lands on one of the
+// addresses Azure reserves in it: the network address, the next three addresses and the broadcast address
+func ValidateInternalLoadBalancerIP(properties *api.Properties) error {
+	if properties.MasterProfile == nil || properties.MasterProfile.Subnet == "" {
+		return nil
+	}
+	_, subnet, err := net.ParseCIDR(properties.MasterProfile.Subnet)
+	if err != nil {
+		return errors.Wrapf(err, "MasterProfile.Subnet '%s' is an invalid CIDR", properties.MasterProfile.Subnet)
+	}
+	lbIP, err := InternalLoadBalancerIP(properties.MasterProfile.FirstConsecutiveStaticIP)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(lbIP).To4()
+	if !subnet.Contains(ip) {
+		return errors.Errorf("internal load balancer IP %s is outside of MasterProfile.Subnet %s", lbIP, properties.MasterProfile.Subnet)
+	}
+	if isReservedSubnetAddress(ip, subnet) {
+		return errors.Errorf("internal load balancer IP %s is a reserved address of MasterProfile.Subnet %s, change MasterProfile.FirstConsecutiveStaticIP", lbIP, properties.MasterProfile.Subnet)
+	}
+	return nil
+}
+
+// GetMasterSubnet returns the masterSubnet variable value for the intended master subnet CIDR. It
+// returns an error unless the subnet can hold masterCount masters from its first usable address, and
+// the internal load balancer address DefaultInternalLbStaticIPOffset addresses past the first master
+func GetMasterSubnet(cidr string, masterCount int) (string, error) {
+	if masterCount < 1 {
+		return "", errors.Errorf("master count %d must be at least 1", masterCount)
+	}
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return "", errors.Wrapf(err, "master subnet '%s' is an invalid CIDR", cidr)
+	}
+	ones, bits := subnet.Mask.Size()
+	if bits != 8*net.IPv4len {
+		return "", errors.Errorf("master subnet %s must be an IPv4 CIDR", cidr)
+	}
+	// Azure reserves the network address, the next three addresses and the broadcast address
+	usable := 1<<uint(bits-ones) - 5
+	required := masterCount
+	if DefaultInternalLbStaticIPOffset+1 > required {
+		required = DefaultInternalLbStaticIPOffset + 1
+	}
+	if usable < required {
+		return "", errors.Errorf("master subnet %s has %d usable addresses, %d masters and the internal load balancer at offset %d need %d", cidr, usable, masterCount, DefaultInternalLbStaticIPOffset, required)
+	}
+	return subnet.String(), nil
+}
+
+// isReservedSubnetAddress returns true if the IPv4 address ip is one of the addresses Azure reserves in subnet
+func isReservedSubnetAddress(ip net.IP, subnet *net.IPNet) bool {
+	network := subnet.IP.To4()
+	mask := net.IP(subnet.Mask).To4()
+	if network == nil || mask == nil {
+		return false
+	}
+	var first, broadcast, address uint32
+	for i := 0; i < net.IPv4len; i++ {
+		first = first<<8 | uint32(network[i])
+		broadcast = broadcast<<8 | uint32(network[i]|^mask[i])
+		address = address<<8 | uint32(ip[i])
+	}
+	return address-first <= 3 || address == broadcast
+}
+
+// GetSecurityRuleCount returns the number of rules in the cluster NSG the template generates: the SSH
+// and API server rules, the RDP rule of clusters with Windows nodes and the VNET and outbound rules of
+// the BlockOutboundInternet feature. The NSG of a hosted master cluster has no rules
+func GetSecurityRuleCount(properties *api.Properties) int {
+	if properties.IsHostedMasterProfile() {
+		return 0
+	}
+	count := 2
+	if properties.HasWindows() {
+		count++
+	}
+	if properties.FeatureFlags.IsFeatureEnabled("BlockOutboundInternet") {
+		count += 2
+	}
+	return count
+}
+
+// validateSecurityRuleCount returns an error if count exceeds the rules Azure accepts in an NSG
+func validateSecurityRuleCount(count int) error {
+	if count > MaxSecurityRulesPerNSG {
+		return errors.Errorf("the cluster NSG has %d rules, more than the %d Azure accepts", count, MaxSecurityRulesPerNSG)
+	}
+	return nil
+}
+
+// GetPublicIPCount returns the number of public IP addresses the template provisions for the
+// cluster: one for the master load balancer, unless the masters of a private cluster run in an
+// availability set, and one for the jumpbox of a private cluster, which only the availability set
+// master template provisions. Agent pools get no public IPs
+func GetPublicIPCount(properties *api.Properties) int {
+	count := 0
+	var kubernetesConfig *api.KubernetesConfig
+	if properties.OrchestratorProfile != nil {
+		kubernetesConfig = properties.OrchestratorProfile.KubernetesConfig
+	}
+	if hasPublicMasterLoadBalancer(properties) {
+		count++
+	}
+	if properties.MasterProfile != nil && !properties.MasterProfile.IsVirtualMachineScaleSets() && kubernetesConfig.PrivateJumpboxProvision() {
+		count++
+	}
+	return count
+}
+
+// hasPublicMasterLoadBalancer returns true if the masters are fronted by a public load balancer,
+// which private clusters only keep for VMSS masters
+func hasPublicMasterLoadBalancer(properties *api.Properties) bool {
+	if properties.MasterProfile == nil {
+		return false
+	}
+	var kubernetesConfig *api.KubernetesConfig
+	if properties.OrchestratorProfile != nil {
+		kubernetesConfig = properties.OrchestratorProfile.KubernetesConfig
+	}
+	isPrivateCluster := kubernetesConfig != nil && kubernetesConfig.PrivateCluster != nil &&
+		helpers.IsTrueBoolPointer(kubernetesConfig.PrivateCluster.Enabled)
+	return !isPrivateCluster || properties.MasterProfile.IsVirtualMachineScaleSets()
+}
+
+// GetPublicPorts returns the sorted frontend ports the master load balancer of the cluster exposes
+// publicly: the API server port and the master SSH ports. VMSS masters expose the whole range of
+// the SSH NAT pool. The agent pools' load balancers open no ports in the templates
+func GetPublicPorts(properties *api.Properties) []int {
+	if !hasPublicMasterLoadBalancer(properties) {
+		return []int{}
+	}
+	ports := []int{MasterAPIServerPort}
+	if properties.MasterProfile.IsVirtualMachineScaleSets() {
+		for port := MasterVMSSSSHNatPortStart; port <= MasterVMSSSSHNatPortEnd; port++ {
+			ports = append(ports, port)
+		}
+	} else {
+		for i := 0; i < properties.MasterProfile.Count && i < len(masterSSHNatPorts); i++ {
+			ports = append(ports, masterSSHNatPorts[i])
+		}
+	}
+	sort.Ints(ports)
+	return ports
+}
+
+// ValidateAddonImageTags returns an error if a container image of an addon rendered from its
+// template has no tag or uses the mutable latest tag. Images pinned by digest are accepted
+func ValidateAddonImageTags(properties *api.Properties) error {
+	settingsMap := kubernetesContainerAddonSettingsInit(properties)
+
+	var addonNames []string
+	for addonName := range settingsMap {
+		addonNames = append(addonNames, addonName)
+	}
+	sort.Strings(addonNames)
+
+	for _, addonName := range addonNames {
+		setting := settingsMap[addonName]
+		if !setting.isEnabled || setting.rawScript != "" {
+			continue
+		}
+		addon := properties.OrchestratorProfile.KubernetesConfig.GetAddonByName(addonName)
+		for _, container := range addon.Containers {
+			if isMutableImageReference(container.Image) {
+				return errors.Errorf("addon %s container %s uses the mutable image %q, pin it to a tag other than latest", addonName, container.Name, container.Image)
+			}
+		}
+	}
+	return nil
+}
+
+// isMutableImageReference returns true if image has no tag or digest, or is tagged latest
+func isMutableImageReference(image string) bool {
+	if strings.Contains(image, "@") {
+		return false
+	}
+	i := strings.LastIndex(image, ":")
+	if i < 0 || i < strings.LastIndex(image, "/") {
+		return true
+	}
+	return image[i+1:] == "" || image[i+1:] == "latest"
+}
+
 // validateDistro checks if the requested orchestrator type is supported on the requested Linux distro.
 func validateDistro(cs *api.ContainerService) bool {
 	// Check Master distro
@@ -126,11 +641,11 @@ func addKeyvaultReference(m paramsMap, k string, vaultID, secretName, secretVers
 	}
 }
 
-func addSecret(m paramsMap, k string, v interface{}, encode bool) {
+func addSecret(m paramsMap, k string, v interface{}, encode bool) error {
 	str, ok := v.(string)
 	if !ok {
 		addValue(m, k, v)
-		return
+		return nil
 	}
 	parts := keyvaultSecretPathRe.FindStringSubmatch(str)
 	if parts == nil || len(parts) != 5 {
@@ -139,22 +654,79 @@ func addSecret(m paramsMap, k string, v interface{}, encode bool) {
 		} else {
 			addValue(m, k, str)
 		}
-		return
+		return nil
+	}
+	if err := validateKeyvaultSecretName(parts[2]); err != nil {
+		return errors.Wrapf(err, "invalid KeyVault reference for parameter %s", k)
 	}
 	addKeyvaultReference(m, k, parts[1], parts[2], parts[4])
+	return nil
+}
+
+// CanonicalizeParameters returns the parameters JSON indented, with the keys of every object sorted,
+// including the fields of KeyVault references, and numbers kept as written. Equal parameters always
+// canonicalize to the same text, which keeps diffs of generated parameters to the changed values
+func CanonicalizeParameters(parametersRaw string) (string, error) {
+	var parameters interface{}
+	decoder := json.NewDecoder(strings.NewReader(parametersRaw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&parameters); err != nil {
+		return "", errors.Wrap(err, "error parsing parameters")
+	}
+	// maps are marshalled with sorted keys, the generic decoding turns every object into one
+	b, err := helpers.JSONMarshalIndent(parameters, "", "  ", false)
+	if err != nil {
+		return "", errors.Wrap(err, "error marshalling parameters")
+	}
+	return string(b), nil
+}
+
+// validateKeyvaultSecretName returns an error if name is not a valid KeyVault secret name,
+// which would only fail the reference at deployment
+func validateKeyvaultSecretName(name string) error {
+	if !keyvaultSecretNameRegex.MatchString(name) {
+		return errors.Errorf("KeyVault secret name %s must be 1 to 127 letters, digits and dashes", name)
+	}
+	return nil
 }
 
 // getStorageAccountType returns the support managed disk storage tier for a give VM size
 func getStorageAccountType(sizeName string) (string, error) {
+	premium, err := SupportsPremiumStorage(sizeName)
+	if err != nil {
+		return "", err
+	}
+	if premium {
+		return "Premium_LRS", nil
+	}
+	return "Standard_LRS", nil
+}
+
+// SupportsPremiumStorage returns true if the VM size supports premium storage, which the sizes
+// with an s in their capability segment, e.g. Standard_DS2_v2 or Standard_D2s_v3, do
+func SupportsPremiumStorage(sizeName string) (bool, error) {
 	spl := strings.Split(sizeName, "_")
 	if len(spl) < 2 {
-		return "", errors.Errorf("Invalid sizeName: %s", sizeName)
+		return false, errors.Errorf("Invalid sizeName: %s", sizeName)
 	}
 	capability := spl[1]
-	if strings.Contains(strings.ToLower(capability), "s") {
-		return "Premium_LRS", nil
+	return strings.Contains(strings.ToLower(capability), "s"), nil
+}
+
+// getAcceleratedNetworkingEnabled returns whether the agent pool NICs should enable accelerated networking.
+// It returns an error if accelerated networking is requested on a VM size that does not support it
+func getAcceleratedNetworkingEnabled(a *api.AgentPoolProfile) (bool, error) {
+	enabled := a.AcceleratedNetworkingEnabled
+	if a.OSType == api.Windows {
+		enabled = a.AcceleratedNetworkingEnabledWindows
 	}
-	return "Standard_LRS", nil
+	if !helpers.IsTrueBoolPointer(enabled) {
+		return false, nil
+	}
+	if !helpers.AcceleratedNetworkingSupported(a.VMSize) {
+		return false, errors.Errorf("accelerated networking is not supported on VM size %s for agent pool %s", a.VMSize, a.Name)
+	}
+	return true, nil
 }
 
 func makeMasterExtensionScriptCommands(cs *api.ContainerService) string {
@@ -180,106 +752,324 @@ func makeAgentExtensionScriptCommands(cs *api.ContainerService, profile *api.Age
 }
 
 func makeExtensionScriptCommands(extension *api.Extension, extensionProfiles []*api.ExtensionProfile, copyIndex string) string {
-	var extensionProfile *api.ExtensionProfile
-	for _, eP := range extensionProfiles {
-		if strings.EqualFold(eP.Name, extension.Name) {
-			extensionProfile = eP
-			break
-		}
-	}
-
+	extensionProfile := getExtensionProfile(extension, extensionProfiles)
 	if extensionProfile == nil {
 		panic(fmt.Sprintf("%s extension referenced was not found in the extension profile", extension.Name))
 	}
 
-	extensionsParameterReference := fmt.Sprintf("parameters('%sParameters')", extensionProfile.Name)
-	scriptURL := getExtensionURL(extensionProfile.RootURL, extensionProfile.Name, extensionProfile.Version, extensionProfile.Script, extensionProfile.URLQuery)
+	extensionsParameterReference := fmt.Sprintf("parameters('%s')", getExtensionParametersName(extensionProfile.Name))
+	scriptURL := getExtensionURL(extensionProfile.RootURL, extensionProfile.ExtensionsDir, extensionProfile.Name, extensionProfile.Version, extensionProfile.Script, extensionProfile.URLQuery)
 	scriptFilePath := fmt.Sprintf("/opt/azure/containers/extensions/%s/%s", extensionProfile.Name, extensionProfile.Script)
-	return fmt.Sprintf("- sudo /usr/bin/curl --retry 5 --retry-delay 10 --retry-max-time 30 -o %s --create-dirs \"%s\" \n- sudo /bin/chmod 744 %s \n- sudo %s ',%s,' > /var/log/%s-output.log",
-		scriptFilePath, scriptURL, scriptFilePath, scriptFilePath, extensionsParameterReference, extensionProfile.Name)
+	return fmt.Sprintf("- sudo /usr/bin/curl --retry 5 --retry-delay 10 --retry-max-time 30 -o %s --create-dirs \"%s\" \n- %s \n- %s",
+		scriptFilePath, scriptURL,
+		retryExtensionScriptCommand(fmt.Sprintf("sudo /bin/chmod 744 %s", scriptFilePath), extensionProfile.ScriptRetries),
+		retryExtensionScriptCommand(fmt.Sprintf("sudo %s ',%s,' > /var/log/%s-output.log", scriptFilePath, extensionsParameterReference, extensionProfile.Name), extensionProfile.ScriptRetries))
 }
 
-func makeWindowsExtensionScriptCommands(extension *api.Extension, extensionProfiles []*api.ExtensionProfile, copyIndex string) string {
-	var extensionProfile *api.ExtensionProfile
-	for _, eP := range extensionProfiles {
-		if strings.EqualFold(eP.Name, extension.Name) {
-			extensionProfile = eP
-			break
-		}
+// retryExtensionScriptCommand returns command wrapped in a loop running it up to retries more times
+// while it fails, ExtensionScriptRetryDelayInSeconds apart, or command itself if retries is not positive
+func retryExtensionScriptCommand(command string, retries int) string {
+	return retryExtensionScriptCommandWithDelay(command, retries, ExtensionScriptRetryDelayInSeconds)
+}
+
+// retryExtensionScriptCommandWithDelay returns command wrapped in a loop running it up to retries more
+// times while it fails, delayInSeconds apart. The loop runs in a subshell exiting with the status of
+// the last attempt, so a command that never succeeds still fails the provisioning
+func retryExtensionScriptCommandWithDelay(command string, retries, delayInSeconds int) string {
+	if retries <= 0 {
+		return command
 	}
+	return fmt.Sprintf("(for i in $(seq 1 %d); do %s && exit 0; status=$?; [ $i -eq %d ] && exit $status; sleep %d; done)",
+		retries+1, command, retries+1, delayInSeconds)
+}
 
+func makeWindowsExtensionScriptCommands(extension *api.Extension, extensionProfiles []*api.ExtensionProfile, copyIndex string) string {
+	extensionProfile := getExtensionProfile(extension, extensionProfiles)
 	if extensionProfile == nil {
 		panic(fmt.Sprintf("%s extension referenced was not found in the extension profile", extension.Name))
 	}
 
-	scriptURL := getExtensionURL(extensionProfile.RootURL, extensionProfile.Name, extensionProfile.Version, extensionProfile.Script, extensionProfile.URLQuery)
+	scriptURL := getExtensionURL(extensionProfile.RootURL, extensionProfile.ExtensionsDir, extensionProfile.Name, extensionProfile.Version, extensionProfile.Script, extensionProfile.URLQuery)
 	scriptFileDir := fmt.Sprintf("$env:SystemDrive:/AzureData/extensions/%s", extensionProfile.Name)
 	scriptFilePath := fmt.Sprintf("%s/%s", scriptFileDir, extensionProfile.Script)
 	return fmt.Sprintf("New-Item -ItemType Directory -Force -Path \"%s\" ; Invoke-WebRequest -Uri \"%s\" -OutFile \"%s\" ; powershell \"%s %s\"\n", scriptFileDir, scriptURL, scriptFilePath, scriptFilePath, "$preprovisionExtensionParams")
 }
 
-func getVNETAddressPrefixes(properties *api.Properties) string {
-	visitedSubnets := make(map[string]bool)
-	var buf bytes.Buffer
-	buf.WriteString(`"[variables('masterSubnet')]"`)
-	visitedSubnets[properties.MasterProfile.Subnet] = true
-	for _, profile := range properties.AgentPoolProfiles {
-		if _, ok := visitedSubnets[profile.Subnet]; !ok {
-			buf.WriteString(fmt.Sprintf(",\n            \"[variables('%sSubnet')]\"", profile.Name))
-		}
+// makeInlineExtensionScriptCommands returns the commands writing the embedded extension script
+// and running it, for nodes that can't download the script at boot
+func makeInlineExtensionScriptCommands(extensionProfile *api.ExtensionProfile, script []byte) string {
+	extensionsParameterReference := fmt.Sprintf("parameters('%s')", getExtensionParametersName(extensionProfile.Name))
+	scriptFileDir := fmt.Sprintf("/opt/azure/containers/extensions/%s", extensionProfile.Name)
+	scriptFilePath := fmt.Sprintf("%s/%s", scriptFileDir, extensionProfile.Script)
+	return fmt.Sprintf("- sudo /bin/mkdir -p %s \n- echo %s | /usr/bin/base64 -d | sudo /usr/bin/tee %s > /dev/null \n- %s \n- %s",
+		scriptFileDir, base64.StdEncoding.EncodeToString(script), scriptFilePath,
+		retryExtensionScriptCommand(fmt.Sprintf("sudo /bin/chmod 744 %s", scriptFilePath), extensionProfile.ScriptRetries),
+		retryExtensionScriptCommand(fmt.Sprintf("sudo %s ',%s,' > /var/log/%s-output.log", scriptFilePath, extensionsParameterReference, extensionProfile.Name), extensionProfile.ScriptRetries))
+}
+
+// makeInlineWindowsExtensionScriptCommands is the Windows counterpart of makeInlineExtensionScriptCommands
+func makeInlineWindowsExtensionScriptCommands(extensionProfile *api.ExtensionProfile, script []byte) string {
+	scriptFileDir := fmt.Sprintf("$env:SystemDrive:/AzureData/extensions/%s", extensionProfile.Name)
+	scriptFilePath := fmt.Sprintf("%s/%s", scriptFileDir, extensionProfile.Script)
+	return fmt.Sprintf("New-Item -ItemType Directory -Force -Path \"%s\" ; [IO.File]::WriteAllBytes(\"%s\", [Convert]::FromBase64String(\"%s\")) ; powershell \"%s %s\"\n",
+		scriptFileDir, scriptFilePath, base64.StdEncoding.EncodeToString(script), scriptFilePath, "$preprovisionExtensionParams")
+}
+
+// getContainerRuntime returns the container runtime the cluster provisions its nodes with, in lower
+// case, or DefaultContainerRuntime when none is set
+func getContainerRuntime(cs *api.ContainerService) string {
+	if cs.Properties.OrchestratorProfile == nil || cs.Properties.OrchestratorProfile.KubernetesConfig == nil ||
+		cs.Properties.OrchestratorProfile.KubernetesConfig.ContainerRuntime == "" {
+		return api.DefaultContainerRuntime
 	}
-	return buf.String()
+	return strings.ToLower(cs.Properties.OrchestratorProfile.KubernetesConfig.ContainerRuntime)
 }
 
-func getVNETSubnetDependencies(properties *api.Properties) string {
-	agentString := `        "[concat('Microsoft.Network/networkSecurityGroups/', variables('%sNSGName'))]"`
-	var buf bytes.Buffer
-	for index, agentProfile := range properties.AgentPoolProfiles {
-		if index > 0 {
-			buf.WriteString(",\n")
-		}
-		buf.WriteString(fmt.Sprintf(agentString, agentProfile.Name))
+// getAgentPoolContainerRuntime returns the container runtime the agent pool provisions its nodes
+// with, in lower case, its own when it overrides the one of the cluster, see getContainerRuntime
+func getAgentPoolContainerRuntime(cs *api.ContainerService, profile *api.AgentPoolProfile) string {
+	if profile.KubernetesConfig != nil && profile.KubernetesConfig.ContainerRuntime != "" {
+		return strings.ToLower(profile.KubernetesConfig.ContainerRuntime)
 	}
-	return buf.String()
+	return getContainerRuntime(cs)
 }
 
-func getVNETSubnets(properties *api.Properties, addNSG bool) string {
-	masterString := `{
-            "name": "[variables('masterSubnetName')]",
-            "properties": {
-              "addressPrefix": "[variables('masterSubnet')]"
-            }
-          }`
-	agentString := `          {
-            "name": "[variables('%sSubnetName')]",
-            "properties": {
-              "addressPrefix": "[variables('%sSubnet')]"
-            }
-          }`
-	agentStringNSG := `          {
-            "name": "[variables('%sSubnetName')]",
-            "properties": {
-              "addressPrefix": "[variables('%sSubnet')]",
-              "networkSecurityGroup": {
-                "id": "[resourceId('Microsoft.Network/networkSecurityGroups', variables('%sNSGName'))]"
-              }
-            }
-          }`
-	var buf bytes.Buffer
-	buf.WriteString(masterString)
+// getProxyEnvironmentVariables returns the proxy environment variables of proxy, in upper and lower
+// case as tools disagree on which they read
+func getProxyEnvironmentVariables(proxy ProxyConfig) ([]string, error) {
+	var variables []string
+	for _, setting := range []struct {
+		name  string
+		value string
+	}{
+		{"HTTP_PROXY", proxy.HTTPProxy},
+		{"HTTPS_PROXY", proxy.HTTPSProxy},
+	} {
+		if setting.value == "" {
+			continue
+		}
+		proxyURL, err := url.Parse(setting.value)
+		if err != nil || (proxyURL.Scheme != "http" && proxyURL.Scheme != "https") || proxyURL.Host == "" {
+			return nil, errors.Errorf("%s %s must be an http or https URL", strings.ToLower(setting.name), setting.value)
+		}
+		if strings.ContainsAny(setting.value, "'\"\\ ") {
+			return nil, errors.Errorf("%s %s may not contain quotes, backslashes or spaces", strings.ToLower(setting.name), setting.value)
+		}
+		variables = append(variables, setting.name+"="+setting.value, strings.ToLower(setting.name)+"="+setting.value)
+	}
+	if len(proxy.NoProxy) > 0 {
+		for _, host := range proxy.NoProxy {
+			if host == "" || strings.ContainsAny(host, "'\"\\ ,") {
+				return nil, errors.Errorf("no_proxy entry %q must be a host, domain or CIDR", host)
+			}
+		}
+		noProxy := strings.Join(proxy.NoProxy, ",")
+		variables = append(variables, "NO_PROXY="+noProxy, "no_proxy="+noProxy)
+	}
+	return variables, nil
+}
+
+// getExtensionParametersName returns the name of the ARM parameter holding the parameters of an extension
+func getExtensionParametersName(extensionName string) string {
+	return fmt.Sprintf("%sParameters", extensionName)
+}
+
+// validateExtensionParameters returns an error if an extension referenced by the master or an agent
+// pool has no parameter in parametersMap, which the linked template and preprovision commands of
+// the extension reference. Only the extensions with a profile get a parameter, see getParameters
+func validateExtensionParameters(properties *api.Properties, parametersMap paramsMap) error {
+	type extensionReference struct {
+		profileName   string
+		extensionName string
+	}
+	var references []extensionReference
+	addReferences := func(profileName string, extensions []api.Extension, preprovisionExtension *api.Extension) {
+		for _, extension := range extensions {
+			references = append(references, extensionReference{profileName, extension.Name})
+		}
+		if preprovisionExtension != nil {
+			extensionName := preprovisionExtension.Name
+			// preprovision extensions match their profile regardless of case
+			if extensionProfile := getExtensionProfile(preprovisionExtension, properties.ExtensionProfiles); extensionProfile != nil {
+				extensionName = extensionProfile.Name
+			}
+			references = append(references, extensionReference{profileName, extensionName})
+		}
+	}
+	if properties.MasterProfile != nil {
+		addReferences("master profile", properties.MasterProfile.Extensions, properties.MasterProfile.PreprovisionExtension)
+	}
 	for _, agentProfile := range properties.AgentPoolProfiles {
-		buf.WriteString(",\n")
-		if addNSG {
-			buf.WriteString(fmt.Sprintf(agentStringNSG, agentProfile.Name, agentProfile.Name, agentProfile.Name))
-		} else {
-			buf.WriteString(fmt.Sprintf(agentString, agentProfile.Name, agentProfile.Name))
+		addReferences(fmt.Sprintf("agent pool %s", agentProfile.Name), agentProfile.Extensions, agentProfile.PreprovisionExtension)
+	}
+
+	for _, reference := range references {
+		parameterName := getExtensionParametersName(reference.extensionName)
+		if _, ok := parametersMap[parameterName]; !ok {
+			return errors.Errorf("extension %s referenced by the %s has no parameter %s, it must have an extension profile",
+				reference.extensionName, reference.profileName, parameterName)
+		}
+	}
+	return nil
+}
+
+// getExtensionProfile returns the extension profile defining extension, or nil if none does
+func getExtensionProfile(extension *api.Extension, extensionProfiles []*api.ExtensionProfile) *api.ExtensionProfile {
+	for _, eP := range extensionProfiles {
+		if strings.EqualFold(eP.Name, extension.Name) {
+			return eP
+		}
+	}
+	return nil
+}
+
+// ValidateAgentPoolSubnets checks that the subnet of every agent pool lies within the VNET address
+// space declared by MasterProfile.VnetCidr. Nothing is checked when no VNET CIDR is declared
+func ValidateAgentPoolSubnets(properties *api.Properties) error {
+	if properties.MasterProfile == nil || properties.MasterProfile.VnetCidr == "" {
+		return nil
+	}
+	_, vnet, err := net.ParseCIDR(properties.MasterProfile.VnetCidr)
+	if err != nil {
+		return errors.Wrapf(err, "MasterProfile.VnetCidr '%s' is an invalid CIDR", properties.MasterProfile.VnetCidr)
+	}
+	vnetOnes, _ := vnet.Mask.Size()
+	for _, profile := range properties.AgentPoolProfiles {
+		if profile.Subnet == "" {
+			continue
+		}
+		_, subnet, err := net.ParseCIDR(profile.Subnet)
+		if err != nil {
+			return errors.Wrapf(err, "agent pool %s subnet '%s' is an invalid CIDR", profile.Name, profile.Subnet)
+		}
+		subnetOnes, _ := subnet.Mask.Size()
+		if !vnet.Contains(subnet.IP) || subnetOnes < vnetOnes {
+			return errors.Errorf("agent pool %s subnet %s is outside of the VNET address space %s", profile.Name, profile.Subnet, properties.MasterProfile.VnetCidr)
+		}
+	}
+	return nil
+}
+
+func getVNETAddressPrefixes(properties *api.Properties) string {
+	visitedSubnets := make(map[string]bool)
+	var buf bytes.Buffer
+	buf.WriteString(`"[variables('masterSubnet')]"`)
+	visitedSubnets[properties.MasterProfile.Subnet] = true
+	for _, profile := range properties.AgentPoolProfiles {
+		if _, ok := visitedSubnets[profile.Subnet]; !ok {
+			buf.WriteString(fmt.Sprintf(",\n            \"[variables('%sSubnet')]\"", profile.Name))
 		}
+	}
+	return buf.String()
+}
 
+func getVNETSubnetDependencies(properties *api.Properties) string {
+	agentString := `        "[concat('Microsoft.Network/networkSecurityGroups/', variables('%sNSGName'))]"`
+	var buf bytes.Buffer
+	for index, agentProfile := range properties.AgentPoolProfiles {
+		if index > 0 {
+			buf.WriteString(",\n")
+		}
+		buf.WriteString(fmt.Sprintf(agentString, agentProfile.Name))
 	}
 	return buf.String()
 }
 
+func getVNETSubnets(properties *api.Properties, addNSG bool) string {
+	options := VNETSubnetOptions{AddNSG: addNSG}
+	if properties.MasterProfile != nil {
+		options.NATGatewayID = properties.MasterProfile.NATGatewayID
+	}
+	return getVNETSubnetsWithOptions(properties, options)
+}
+
+// getVNETSubnetsWithOptions returns the subnets of the cluster VNET customized by options
+func getVNETSubnetsWithOptions(properties *api.Properties, options VNETSubnetOptions) string {
+	var buf bytes.Buffer
+	buf.WriteString(getVNETSubnet("[variables('masterSubnetName')]", "[variables('masterSubnet')]", "", options.MasterPrivateEndpointNetworkPolicies, options.NATGatewayID))
+	for _, agentProfile := range properties.AgentPoolProfiles {
+		buf.WriteString(",\n          ")
+		nsgID := ""
+		if options.AddNSG {
+			nsgID = fmt.Sprintf("[resourceId('Microsoft.Network/networkSecurityGroups', variables('%sNSGName'))]", agentProfile.Name)
+		}
+		var privateEndpointNetworkPolicies *bool
+		if enabled, ok := options.PrivateEndpointNetworkPolicies[agentProfile.Name]; ok {
+			privateEndpointNetworkPolicies = &enabled
+		}
+		buf.WriteString(getVNETSubnet(fmt.Sprintf("[variables('%sSubnetName')]", agentProfile.Name), fmt.Sprintf("[variables('%sSubnet')]", agentProfile.Name), nsgID, privateEndpointNetworkPolicies, options.NATGatewayID))
+	}
+	return buf.String()
+}
+
+// getVNETSubnet returns a VNET subnet, emitting the NSG, the private endpoint network policies and
+// the NAT gateway only when set
+func getVNETSubnet(name, addressPrefix, nsgID string, privateEndpointNetworkPolicies *bool, natGatewayID string) string {
+	var properties bytes.Buffer
+	properties.WriteString(fmt.Sprintf(`              "addressPrefix": "%s"`, addressPrefix))
+	if nsgID != "" {
+		properties.WriteString(fmt.Sprintf(`,
+              "networkSecurityGroup": {
+                "id": "%s"
+              }`, nsgID))
+	}
+	if privateEndpointNetworkPolicies != nil {
+		policies := "Disabled"
+		if *privateEndpointNetworkPolicies {
+			policies = "Enabled"
+		}
+		properties.WriteString(fmt.Sprintf(`,
+              "privateEndpointNetworkPolicies": "%s"`, policies))
+	}
+	if natGatewayID != "" {
+		properties.WriteString(fmt.Sprintf(`,
+              "natGateway": {
+                "id": "%s"
+              }`, natGatewayID))
+	}
+	return fmt.Sprintf(`{
+            "name": "%s",
+            "properties": {
+%s
+            }
+          }`, name, properties.String())
+}
+
 func getLBRule(name string, port int) string {
+	return getLoadBalancerRule(name, LoadBalancerRule{Port: port})
+}
+
+func getLBRules(name string, ports []int) string {
+	var buf bytes.Buffer
+	for index, port := range ports {
+		if index > 0 {
+			buf.WriteString(",\n")
+		}
+		buf.WriteString(getLBRule(name, port))
+	}
+	return buf.String()
+}
+
+// getLoadBalancerRules returns the LB rules for the given rule specs, each referencing its own probe
+func getLoadBalancerRules(name string, rules []LoadBalancerRule) (string, error) {
+	var buf bytes.Buffer
+	for index, rule := range rules {
+		if err := validateLoadBalancerRule(rule); err != nil {
+			return "", err
+		}
+		// the rules are emitted into a single load balancer, which owns either frontend
+		if rule.InternalFrontend != rules[0].InternalFrontend {
+			return "", errors.Errorf("load balancer rules for ports %d and %d target different frontends, the internal and public frontends belong to separate load balancers", rules[0].Port, rule.Port)
+		}
+		if index > 0 {
+			buf.WriteString(",\n")
+		}
+		buf.WriteString(getLoadBalancerRule(name, rule))
+	}
+	return buf.String(), nil
+}
+
+func getLoadBalancerRule(name string, rule LoadBalancerRule) string {
 	return fmt.Sprintf(`	          {
             "name": "LBRule%d",
             "properties": {
@@ -287,6 +1077,7 @@ func getLBRule(name string, port int) string {
                 "id": "[concat(variables('%sLbID'), '/backendAddressPools/', variables('%sLbBackendPoolName'))]"
               },
               "backendPort": %d,
+              "disableOutboundSnat": %t,
               "enableFloatingIP": false,
               "frontendIPConfiguration": {
                 "id": "[variables('%sLbIPConfigID')]"
@@ -295,69 +1086,306 @@ func getLBRule(name string, port int) string {
               "idleTimeoutInMinutes": 5,
               "loadDistribution": "Default",
               "probe": {
-                "id": "[concat(variables('%sLbID'),'/probes/tcp%dProbe')]"
+                "id": "[concat(variables('%sLbID'),'/probes/%s')]"
               },
-              "protocol": "tcp"
+              "protocol": "%s"
             }
-          }`, port, name, name, port, name, port, name, port)
+          }`, rule.Port, rule.getLbName(name), name, rule.getBackendPort(), rule.DisableOutboundSnat,
+		rule.getLbName(name), rule.Port, rule.getLbName(name), getProbeName(rule), rule.getProtocol())
 }
 
-func getLBRules(name string, ports []int) string {
+func getProbe(port int) string {
+	return getLoadBalancerProbe(LoadBalancerRule{Port: port})
+}
+
+func getProbes(ports []int) string {
 	var buf bytes.Buffer
 	for index, port := range ports {
 		if index > 0 {
 			buf.WriteString(",\n")
 		}
-		buf.WriteString(getLBRule(name, port))
+		buf.WriteString(getProbe(port))
 	}
 	return buf.String()
 }
 
-func getProbe(port int) string {
+// getLoadBalancerProbes returns the probes referenced by the given rule specs
+func getLoadBalancerProbes(rules []LoadBalancerRule) (string, error) {
+	var buf bytes.Buffer
+	for index, rule := range rules {
+		if err := validateLoadBalancerRule(rule); err != nil {
+			return "", err
+		}
+		if index > 0 {
+			buf.WriteString(",\n")
+		}
+		buf.WriteString(getLoadBalancerProbe(rule))
+	}
+	return buf.String(), nil
+}
+
+func getLoadBalancerProbe(rule LoadBalancerRule) string {
+	var requestPath string
+	if rule.getProbeProtocol() != "tcp" {
+		requestPath = fmt.Sprintf(`,
+              "requestPath": "%s"`, rule.getProbePath())
+	}
 	return fmt.Sprintf(`          {
-            "name": "tcp%dProbe",
+            "name": "%s",
             "properties": {
-              "intervalInSeconds": "5",
-              "numberOfProbes": "2",
+              "intervalInSeconds": "%d",
+              "numberOfProbes": "%d",
               "port": %d,
-              "protocol": "tcp"
+              "protocol": "%s"%s
             }
-          }`, port, port)
+          }`, getProbeName(rule), rule.getProbeIntervalInSeconds(), rule.getNumberOfProbes(), rule.getBackendPort(), rule.getProbeProtocol(), requestPath)
 }
 
-func getProbes(ports []int) string {
-	var buf bytes.Buffer
-	for index, port := range ports {
-		if index > 0 {
-			buf.WriteString(",\n")
+// getProbeName returns the name of the probe referenced by the LB rule, which getLoadBalancerProbe
+// also uses to name the probe
+func getProbeName(rule LoadBalancerRule) string {
+	prefix := rule.ProbeNamePrefix
+	if prefix == "" {
+		prefix = rule.getProbeProtocol()
+	}
+	return fmt.Sprintf("%s%dProbe", prefix, rule.Port)
+}
+
+func validateLoadBalancerRule(rule LoadBalancerRule) error {
+	if rule.Port < 1 || rule.Port > 65535 {
+		return errors.Errorf("load balancer rule port %d must be between 1 and 65535", rule.Port)
+	}
+	if rule.BackendPort < 0 || rule.BackendPort > 65535 {
+		return errors.Errorf("load balancer rule for port %d has backend port %d, which must be between 1 and 65535", rule.Port, rule.BackendPort)
+	}
+	if protocol := rule.getProtocol(); protocol != "tcp" && protocol != "udp" {
+		return errors.Errorf("load balancer rule for port %d has unsupported protocol %s, must be tcp or udp", rule.Port, rule.Protocol)
+	}
+	switch rule.getProbeProtocol() {
+	case "tcp":
+		if rule.ProbePath != "" {
+			return errors.Errorf("load balancer rule for port %d sets a probe path, which requires an http or https probe", rule.Port)
 		}
-		buf.WriteString(getProbe(port))
+	case "http", "https":
+		if !strings.HasPrefix(rule.getProbePath(), "/") {
+			return errors.Errorf("load balancer rule for port %d has probe path %s, which must start with /", rule.Port, rule.ProbePath)
+		}
+	default:
+		return errors.Errorf("load balancer rule for port %d has unsupported probe protocol %s, must be tcp, http or https", rule.Port, rule.ProbeProtocol)
 	}
-	return buf.String()
+	if rule.ProbeNamePrefix != "" && !probeNamePrefixRegex.MatchString(rule.ProbeNamePrefix) {
+		return errors.Errorf("load balancer rule for port %d has probe name prefix %s, which may only contain letters, digits, '_', '-' and '.'", rule.Port, rule.ProbeNamePrefix)
+	}
+	if rule.NumberOfProbes < 0 {
+		return errors.Errorf("load balancer rule for port %d has %d probes, which must be at least 1", rule.Port, rule.NumberOfProbes)
+	}
+	if rule.ProbeIntervalInSeconds != 0 && rule.ProbeIntervalInSeconds < MinLoadBalancerProbeIntervalInSeconds {
+		return errors.Errorf("load balancer rule for port %d has a probe interval of %d seconds, which must be at least %d",
+			rule.Port, rule.ProbeIntervalInSeconds, MinLoadBalancerProbeIntervalInSeconds)
+	}
+	return nil
+}
+
+// GetPlannedSecurityRules returns the inbound NSG rules that will be generated for the given ports,
+// so that they can be reviewed before deployment. It returns an error if the ports do not fit in the
+// NSG priority range, see GetPlannedSecurityRulesWithOptions
+func GetPlannedSecurityRules(ports []int) ([]SecurityRule, error) {
+	return GetPlannedSecurityRulesWithOptions(ports, SecurityRuleOptions{})
 }
 
-func getSecurityRule(port int, portIndex int) string {
-	// BaseLBPriority specifies the base lb priority.
-	BaseLBPriority := 200
+// GetPlannedSecurityRulesWithOptions returns the inbound NSG rules that will be generated for the
+// given ports. Priorities are allocated consecutively from the base priority, skipping the reserved
+// ranges, and an error is returned if they run past MaxSecurityRulePriority
+func GetPlannedSecurityRulesWithOptions(ports []int, options SecurityRuleOptions) ([]SecurityRule, error) {
+	source := options.Source
+	if source == "" {
+		source = "Internet"
+	} else if !serviceTagRegex.MatchString(source) {
+		return nil, errors.Errorf("security rule source %s is not an Azure service tag", source)
+	}
+	rules := make([]SecurityRule, 0, len(ports)+1)
+	if options.AllowIntraCluster {
+		rules = append(rules, getIntraClusterSecurityRule())
+	}
+	for _, port := range ports {
+		protocols, err := getSecurityRuleProtocols(port, options.Protocols[port])
+		if err != nil {
+			return nil, err
+		}
+		for _, protocol := range protocols {
+			name := fmt.Sprintf("Allow_%d", port)
+			if protocol != "" {
+				name = fmt.Sprintf("Allow_%d_%s", port, protocol)
+			}
+			rules = append(rules, SecurityRule{
+				Name:        name,
+				Port:        port,
+				Source:      source,
+				Access:      "Allow",
+				Protocol:    protocol,
+				Description: options.Descriptions[port],
+			})
+		}
+	}
+	priorities, err := allocateSecurityRulePriorities(len(rules), options)
+	if err != nil {
+		return nil, err
+	}
+	for index := range rules {
+		rules[index].Priority = priorities[index]
+	}
+	return rules, nil
+}
+
+// getIntraClusterSecurityRule returns the rule allowing any traffic from the VNET to the VNET, which
+// the node to node and pod to pod traffic of the cluster needs. Its priority is left to the caller
+func getIntraClusterSecurityRule() SecurityRule {
+	return SecurityRule{
+		Name:        "Allow_IntraCluster",
+		Source:      "VirtualNetwork",
+		Destination: "VirtualNetwork",
+		Access:      "Allow",
+		Description: "Allow node to node and pod to pod traffic within the cluster VNET",
+	}
+}
+
+// getSecurityRuleProtocols returns the normalized protocols of the rules for port, a single empty
+// protocol allowing any protocol if none are requested
+func getSecurityRuleProtocols(port int, requested []string) ([]string, error) {
+	if len(requested) == 0 {
+		return []string{""}, nil
+	}
+	protocols := make([]string, 0, len(requested))
+	for _, protocol := range requested {
+		var normalized string
+		switch strings.ToLower(protocol) {
+		case "tcp":
+			normalized = "Tcp"
+		case "udp":
+			normalized = "Udp"
+		default:
+			return nil, errors.Errorf("security rule for port %d has unsupported protocol %s, must be Tcp or Udp", port, protocol)
+		}
+		if stringInSlice(normalized, protocols) {
+			return nil, errors.Errorf("security rule for port %d requests protocol %s more than once", port, normalized)
+		}
+		protocols = append(protocols, normalized)
+	}
+	return protocols, nil
+}
+
+// allocateSecurityRulePriorities returns count consecutive NSG rule priorities starting at the
+// base priority that fall outside of the reserved ranges
+func allocateSecurityRulePriorities(count int, options SecurityRuleOptions) ([]int, error) {
+	basePriority := options.BasePriority
+	if basePriority == 0 {
+		basePriority = DefaultSecurityRuleBasePriority
+	}
+	if basePriority < MinSecurityRulePriority || basePriority > MaxSecurityRulePriority {
+		return nil, errors.Errorf("security rule base priority %d must be between %d and %d", basePriority, MinSecurityRulePriority, MaxSecurityRulePriority)
+	}
+	for _, reserved := range options.ReservedPriorities {
+		if reserved.Min > reserved.Max {
+			return nil, errors.Errorf("reserved security rule priority range %d-%d is empty", reserved.Min, reserved.Max)
+		}
+	}
+
+	priorities := make([]int, 0, count)
+	for priority := basePriority; len(priorities) < count; priority++ {
+		if priority > MaxSecurityRulePriority {
+			return nil, errors.Errorf("%d security rules do not fit between priority %d and %d outside of the reserved ranges", count, basePriority, MaxSecurityRulePriority)
+		}
+		isReserved := false
+		for _, reserved := range options.ReservedPriorities {
+			if reserved.contains(priority) {
+				isReserved = true
+				break
+			}
+		}
+		if !isReserved {
+			priorities = append(priorities, priority)
+		}
+	}
+	return priorities, nil
+}
+
+func getSecurityRule(rule SecurityRule) string {
+	description := rule.Description
+	if description == "" && rule.Source == "Internet" {
+		description = fmt.Sprintf("Allow traffic from the Internet to port %d", rule.Port)
+	} else if description == "" {
+		description = fmt.Sprintf("Allow traffic from %s to port %d", rule.Source, rule.Port)
+	}
+	b, _ := json.Marshal(description)
+	protocol := rule.Protocol
+	if protocol == "" {
+		protocol = "*"
+	}
+	destination := rule.Destination
+	if destination == "" {
+		destination = "*"
+	}
+	portRange := "*"
+	if rule.Port != 0 {
+		portRange = strconv.Itoa(rule.Port)
+	}
 	return fmt.Sprintf(`          {
-            "name": "Allow_%d",
+            "name": "%s",
             "properties": {
-              "access": "Allow",
-              "description": "Allow traffic from the Internet to port %d",
-              "destinationAddressPrefix": "*",
-              "destinationPortRange": "%d",
+              "access": "%s",
+              "description": %s,
+              "destinationAddressPrefix": "%s",
+              "destinationPortRange": "%s",
               "direction": "Inbound",
               "priority": %d,
-              "protocol": "*",
-              "sourceAddressPrefix": "Internet",
+              "protocol": "%s",
+              "sourceAddressPrefix": "%s",
               "sourcePortRange": "*"
             }
-          }`, port, port, port, BaseLBPriority+portIndex)
+          }`, rule.Name, rule.Access, b, destination, portRange, rule.Priority, protocol, rule.Source)
+}
+
+// GetAgentPoolDataStorageAccountPrefixSeed returns the index into the storage account prefixes of the
+// first data storage account of an agent pool, the sum of dataStorageAccountPrefixSeed and the
+// %sStorageAccountOffset variables getDataDisks builds the VHD URIs from. Each pool reserves the
+// MaxVMsPerPool / MaxVMsPerStorageAccount indexes past the offset of the pools before it, so the seed
+// only depends on the position of the pool in properties
+func GetAgentPoolDataStorageAccountPrefixSeed(properties *api.Properties, a *api.AgentPoolProfile) (int, error) {
+	for index, agentPoolProfile := range properties.AgentPoolProfiles {
+		if agentPoolProfile == a {
+			return DataStorageAccountPrefixSeed + index*(MaxVMsPerPool/MaxVMsPerStorageAccount), nil
+		}
+	}
+	return 0, errors.Errorf("agent pool %s is not an agent pool of the cluster", a.Name)
 }
 
-func getDataDisks(a *api.AgentPoolProfile) string {
+func getDataDisks(a *api.AgentPoolProfile) (string, error) {
 	if !a.HasDisks() {
-		return ""
+		return "", nil
+	}
+	// Zonal pools run as scale sets, which create each instance's managed data disks in that
+	// instance's zone. Unmanaged disks live in a regional storage account and cannot follow it
+	if a.HasAvailabilityZones() && a.StorageProfile != api.ManagedDisks {
+		return "", errors.Errorf("agent pool %s uses availability zones, which requires the %s storage profile for data disks to be zone aligned", a.Name, api.ManagedDisks)
+	}
+	if a.DataDiskStorageAccountType != "" && a.StorageProfile != api.ManagedDisks {
+		return "", errors.Errorf("agent pool %s sets dataDiskStorageAccountType, which requires the %s storage profile", a.Name, api.ManagedDisks)
+	}
+	if a.DataDiskStorageAccountName != "" {
+		if a.StorageProfile != api.StorageAccount {
+			return "", errors.Errorf("agent pool %s sets dataDiskStorageAccountName, which requires the %s storage profile", a.Name, api.StorageAccount)
+		}
+		if !storageAccountNameRegex.MatchString(a.DataDiskStorageAccountName) {
+			return "", errors.Errorf("agent pool %s dataDiskStorageAccountName %s must be 3 to 24 lowercase letters and digits", a.Name, a.DataDiskStorageAccountName)
+		}
+	}
+	if len(a.DiskStorageAccountTypes) > 0 {
+		if a.StorageProfile != api.ManagedDisks {
+			return "", errors.Errorf("agent pool %s sets diskStorageAccountTypes, which requires the %s storage profile", a.Name, api.ManagedDisks)
+		}
+		if len(a.DiskStorageAccountTypes) > len(a.DiskSizesGB) {
+			return "", errors.Errorf("agent pool %s declares %d diskStorageAccountTypes for %d data disks", a.Name, len(a.DiskStorageAccountTypes), len(a.DiskSizesGB))
+		}
 	}
 	var buf bytes.Buffer
 	buf.WriteString("\"dataDisks\": [\n")
@@ -370,32 +1398,159 @@ func getDataDisks(a *api.AgentPoolProfile) string {
                 "uri": "[concat('http://',variables('storageAccountPrefixes')[mod(add(add(div(copyIndex(),variables('maxVMsPerStorageAccount')),variables('%sStorageAccountOffset')),variables('dataStorageAccountPrefixSeed')),variables('storageAccountPrefixesCount'))],variables('storageAccountPrefixes')[div(add(add(div(copyIndex(),variables('maxVMsPerStorageAccount')),variables('%sStorageAccountOffset')),variables('dataStorageAccountPrefixSeed')),variables('storageAccountPrefixesCount'))],variables('%sDataAccountName'),'.blob.core.windows.net/vhds/',variables('%sVMNamePrefix'),copyIndex(), '--datadisk%d.vhd')]"
               }
             }`
-	managedDataDisks := `            {
+	// an existing storage account replaces the one picked among the generated accounts
+	existingAccountDataDisks := `            {
+              "createOption": "Empty",
               "diskSizeGB": "%d",
               "lun": %d,
-              "createOption": "Empty"
+              "name": "[concat(variables('%sVMNamePrefix'), copyIndex(),'-datadisk%d')]",
+              "vhd": {
+                "uri": "[concat('http://','%s','.blob.core.windows.net/vhds/',variables('%sVMNamePrefix'),copyIndex(), '--datadisk%d.vhd')]"
+              }
             }`
 	for i, diskSize := range a.DiskSizesGB {
 		if i > 0 {
 			buf.WriteString(",\n")
 		}
-		if a.StorageProfile == api.StorageAccount {
+		if a.StorageProfile == api.StorageAccount && a.DataDiskStorageAccountName != "" {
+			buf.WriteString(fmt.Sprintf(existingAccountDataDisks, diskSize, i, a.Name, i, a.DataDiskStorageAccountName, a.Name, i))
+		} else if a.StorageProfile == api.StorageAccount {
 			buf.WriteString(fmt.Sprintf(dataDisks, diskSize, i, a.Name, i, a.Name, a.Name, a.Name, a.Name, i))
 		} else if a.StorageProfile == api.ManagedDisks {
-			buf.WriteString(fmt.Sprintf(managedDataDisks, diskSize, i))
+			managedDataDisk, err := getManagedDataDisk(a, i, diskSize)
+			if err != nil {
+				return "", err
+			}
+			buf.WriteString(managedDataDisk)
 		}
 	}
 	buf.WriteString("\n          ],")
-	return buf.String()
+	return buf.String(), nil
+}
+
+// getManagedDataDisk returns the managed data disk definition for the given lun of the agent pool
+func getManagedDataDisk(a *api.AgentPoolProfile, lun int, diskSizeGB int) (string, error) {
+	properties := []string{
+		fmt.Sprintf(`"diskSizeGB": "%d"`, diskSizeGB),
+		fmt.Sprintf(`"lun": %d`, lun),
+		`"createOption": "Empty"`,
+	}
+	if a.DataDiskNameTemplate != "" {
+		name, err := getDataDiskName(a, lun)
+		if err != nil {
+			return "", err
+		}
+		properties = append(properties, fmt.Sprintf(`"name": "%s"`, name))
+	}
+	storageAccountType, err := getDataDiskStorageAccountType(a, lun)
+	if err != nil {
+		return "", err
+	}
+	if err = validateDataDiskVMSize(a, lun, storageAccountType); err != nil {
+		return "", err
+	}
+	properties = append(properties, fmt.Sprintf(`"managedDisk": {
+                "storageAccountType": "%s"
+              }`, storageAccountType))
+	return fmt.Sprintf(`            {
+              %s
+            }`, strings.Join(properties, ",\n              ")), nil
+}
+
+// validateDataDiskVMSize returns an error if the data disk at the given lun is on a premium storage tier
+// but the pool's VM size does not support premium storage, which Azure rejects at deployment
+func validateDataDiskVMSize(a *api.AgentPoolProfile, lun int, storageAccountType string) error {
+	if !stringInSlice(storageAccountType, premiumStorageAccountTypes) {
+		return nil
+	}
+	premium, err := SupportsPremiumStorage(a.VMSize)
+	if err != nil {
+		return errors.Wrapf(err, "agent pool %s", a.Name)
+	}
+	if !premium {
+		return errors.Errorf("agent pool %s data disk %d has storage account type %s, which VM size %s does not support, use a VM size supporting premium storage or a standard tier",
+			a.Name, lun, storageAccountType, a.VMSize)
+	}
+	return nil
+}
+
+// getDataDiskName returns the name expression of the managed data disk at the given lun, rendered
+// from the pool's dataDiskNameTemplate. The template may reference {pool}, {lun} and {zones}, which is
+// replaced by the pool's zone, e.g. z1, or "regional". The name is prefixed with the VM name, so {lun}
+// keeps the names of a VM's disks unique. A scale set model can't name the zone each instance lands in,
+// so {zones} is rejected for pools spread across several zones
+func getDataDiskName(a *api.AgentPoolProfile, lun int) (string, error) {
+	if !strings.Contains(a.DataDiskNameTemplate, "{lun}") {
+		return "", errors.Errorf("agent pool %s dataDiskNameTemplate %s must reference {lun}", a.Name, a.DataDiskNameTemplate)
+	}
+	zones := "regional"
+	if a.HasAvailabilityZones() {
+		if len(a.AvailabilityZones) > 1 && strings.Contains(a.DataDiskNameTemplate, "{zones}") {
+			return "", errors.Errorf("agent pool %s spans zones %s, so dataDiskNameTemplate %s can't reference {zones}", a.Name, strings.Join(a.AvailabilityZones, ", "), a.DataDiskNameTemplate)
+		}
+		zones = "z" + a.AvailabilityZones[0]
+	}
+	name := strings.NewReplacer("{pool}", a.Name, "{lun}", strconv.Itoa(lun), "{zones}", zones).Replace(a.DataDiskNameTemplate)
+	if !dataDiskNameRegex.MatchString(name) {
+		return "", errors.Errorf("agent pool %s data disk name %s may only contain letters, digits, '_', '-' and '.'", a.Name, name)
+	}
+	if a.IsVirtualMachineScaleSets() {
+		return fmt.Sprintf("[concat(variables('%sVMNamePrefix'), '-%s')]", a.Name, name), nil
+	}
+	return fmt.Sprintf("[concat(variables('%sVMNamePrefix'), copyIndex(), '-%s')]", a.Name, name), nil
 }
 
-func getSecurityRules(ports []int) string {
+// getDataDiskStorageAccountType returns the storage tier of the data disk at the given lun. A tier set
+// for the disk takes precedence over the pool's dataDiskStorageAccountType, which defaults to the tier
+// the pool's VM size supports
+func getDataDiskStorageAccountType(a *api.AgentPoolProfile, lun int) (string, error) {
+	storageAccountType := a.DataDiskStorageAccountType
+	if lun < len(a.DiskStorageAccountTypes) && a.DiskStorageAccountTypes[lun] != "" {
+		storageAccountType = a.DiskStorageAccountTypes[lun]
+	}
+	if storageAccountType == "" {
+		return getStorageAccountType(a.VMSize)
+	}
+	if stringInSlice(storageAccountType, unsupportedManagedDiskStorageAccountTypes) {
+		return "", errors.Errorf("agent pool %s data disk %d has storage account type %s, which the compute API version of the templates can't create, use Premium_LRS instead", a.Name, lun, storageAccountType)
+	}
+	if !stringInSlice(storageAccountType, managedDiskStorageAccountTypes) {
+		return "", errors.Errorf("agent pool %s data disk %d has unsupported storage account type %s, must be one of %s", a.Name, lun, storageAccountType, strings.Join(managedDiskStorageAccountTypes, ", "))
+	}
+	return storageAccountType, nil
+}
+
+func getSecurityRules(ports []int) (string, error) {
+	return getSecurityRulesWithOptions(ports, SecurityRuleOptions{})
+}
+
+// getSecurityRulesWithOptions returns the NSG rules for the given ports with priorities allocated
+// according to options
+func getSecurityRulesWithOptions(ports []int, options SecurityRuleOptions) (string, error) {
+	rules, err := GetPlannedSecurityRulesWithOptions(ports, options)
+	if err != nil {
+		return "", err
+	}
+	return joinSecurityRules(rules), nil
+}
+
+// joinSecurityRules returns the rules sorted by priority, and by name for equal priorities, so that
+// the emitted order matches the order the NSG evaluates them in whatever order they were planned in
+func joinSecurityRules(rules []SecurityRule) string {
+	sorted := make([]SecurityRule, len(rules))
+	copy(sorted, rules)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Priority != sorted[j].Priority {
+			return sorted[i].Priority < sorted[j].Priority
+		}
+		return sorted[i].Name < sorted[j].Name
+	})
 	var buf bytes.Buffer
-	for index, port := range ports {
+	for index, rule := range sorted {
 		if index > 0 {
 			buf.WriteString(",\n")
 		}
-		buf.WriteString(getSecurityRule(port, index))
+		buf.WriteString(getSecurityRule(rule))
 	}
 	return buf.String()
 }
@@ -422,83 +1577,487 @@ func (t *TemplateGenerator) getSingleLine(textFilename string, cs *api.Container
 	return expandedTemplate, nil
 }
 
-// getSingleLineForTemplate returns the file as a single line for embedding in an arm template
-func (t *TemplateGenerator) getSingleLineForTemplate(textFilename string, cs *api.ContainerService, profile interface{}) (string, error) {
-	expandedTemplate, err := t.getSingleLine(textFilename, cs, profile)
-	if err != nil {
-		return "", err
+// getSingleLineForTemplate returns the file as a single line for embedding in an arm template
+func (t *TemplateGenerator) getSingleLineForTemplate(textFilename string, cs *api.ContainerService, profile interface{}) (string, error) {
+	expandedTemplate, err := t.getSingleLine(textFilename, cs, profile)
+	if err != nil {
+		return "", err
+	}
+
+	textStr := escapeSingleLine(string(expandedTemplate))
+
+	return textStr, nil
+}
+
+// templateReferenceRegex matches the ARM variable and parameter references with a literal name
+var templateReferenceRegex = regexp.MustCompile(`\b(variables|parameters)\('([^']+)'\)`)
+
+// getDefinedTemplateReferences returns the names of the variables and parameters declared by the
+// generated ARM template
+func getDefinedTemplateReferences(templateRaw string) (TemplateReferences, error) {
+	var template struct {
+		Parameters map[string]json.RawMessage `json:"parameters"`
+		Variables  map[string]json.RawMessage `json:"variables"`
+	}
+	if err := json.Unmarshal([]byte(templateRaw), &template); err != nil {
+		return TemplateReferences{}, errors.Wrap(err, "error parsing the generated template")
+	}
+	var defined TemplateReferences
+	for name := range template.Variables {
+		defined.Variables = append(defined.Variables, name)
+	}
+	for name := range template.Parameters {
+		defined.Parameters = append(defined.Parameters, name)
+	}
+	return defined, nil
+}
+
+// validateTemplateReferences returns an error listing the variables and parameters referenced in
+// text that are not in defined. Names are case-insensitive, as in ARM, and references with a
+// computed name are not checked
+func validateTemplateReferences(text string, defined TemplateReferences) error {
+	definedNames := map[string]map[string]bool{
+		"variables":  {},
+		"parameters": {},
+	}
+	for _, name := range defined.Variables {
+		definedNames["variables"][strings.ToLower(name)] = true
+	}
+	for _, name := range defined.Parameters {
+		definedNames["parameters"][strings.ToLower(name)] = true
+	}
+
+	var unknown []string
+	seen := map[string]bool{}
+	for _, match := range templateReferenceRegex.FindAllStringSubmatch(text, -1) {
+		reference := match[0]
+		if definedNames[match[1]][strings.ToLower(match[2])] || seen[reference] {
+			continue
+		}
+		seen[reference] = true
+		unknown = append(unknown, reference)
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return errors.Errorf("template references undefined %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+func escapeSingleLine(escapedStr string) string {
+	// template.JSEscapeString leaves undesirable chars that don't work with pretty print
+	escapedStr = strings.Replace(escapedStr, "\\", "\\\\", -1)
+	escapedStr = strings.Replace(escapedStr, "\r\n", "\\n", -1)
+	escapedStr = strings.Replace(escapedStr, "\n", "\\n", -1)
+	escapedStr = strings.Replace(escapedStr, "\"", "\\\"", -1)
+	return escapedStr
+}
+
+// getBase64CustomScript will return a base64 of the CSE, minified first if minify is set
+func getBase64CustomScript(csFilename string, minify bool) string {
+	b, err := Asset(csFilename)
+	if err != nil {
+		// this should never happen and this is a bug
+		panic(fmt.Sprintf("BUG: %s", err.Error()))
+	}
+	// translate the parameters
+	csStr := string(b)
+	csStr = strings.Replace(csStr, "\r\n", "\n", -1)
+	if minify {
+		csStr = minifyCustomScript(csStr)
+	}
+	b64Str, err := getBase64CustomScriptFromStr(csStr)
+	if err != nil {
+		panic(fmt.Sprintf("BUG: %s", err.Error()))
+	}
+	return b64Str
+}
+
+// getBase64CustomScriptFromStr will return a base64 of the gzipped str
+func getBase64CustomScriptFromStr(str string) (string, error) {
+	var gzipB bytes.Buffer
+	if err := writeGzip(&gzipB, str); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gzipB.Bytes()), nil
+}
+
+// getEncodedCustomScriptFromStr returns str encoded according to options, along with the cloud-init
+// write_files encoding the boot time decoder needs: gzipped base64 by default, or plain base64 when
+// requested or when str is shorter than the threshold, as gzip grows such small payloads
+func getEncodedCustomScriptFromStr(str string, options CustomDataEncodingOptions) (string, string, error) {
+	if options.Minify {
+		str = minifyCustomScript(str)
+	}
+	if options.Uncompressed || len(str) < options.UncompressedThreshold {
+		return base64.StdEncoding.EncodeToString([]byte(str)), CustomDataEncodingBase64, nil
+	}
+	b64Str, err := getBase64CustomScriptFromStr(str)
+	if err != nil {
+		return "", "", err
+	}
+	return b64Str, CustomDataEncodingGzip, nil
+}
+
+// heredocRegex matches the redirection starting a shell here-document and captures its delimiter
+var heredocRegex = regexp.MustCompile(`(?:^|[^<])<<(-?)\s*\\?['"]?([A-Za-z_][A-Za-z0-9_]*)['"]?`)
+
+// blockScalarRegex matches a YAML line whose value is a literal or folded block scalar
+var blockScalarRegex = regexp.MustCompile(`(?:^|:|-)\s*(?:!!?[A-Za-z]+\s+)?[|>][-+0-9]*\s*$`)
+
+// minifyCustomScript drops the comment lines and blank lines of a shell script or YAML document to
+// shrink the custom data. The shebang, comments trailing a command and the lines of here-documents,
+// YAML block scalars and multiline quoted strings are kept as is, since they may be content
+func minifyCustomScript(str string) string {
+	lines := strings.Split(strings.TrimSuffix(str, "\n"), "\n")
+	var minified []string
+	var quote byte
+	heredoc, heredocStripsTabs := "", false
+	blockIndent := -1
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if heredoc != "" {
+			minified = append(minified, line)
+			if line == heredoc || (heredocStripsTabs && strings.TrimLeft(line, "\t") == heredoc) {
+				heredoc = ""
+			}
+			continue
+		}
+		if quote != 0 {
+			minified = append(minified, line)
+			quote = getOpenQuote(line, quote)
+			continue
+		}
+		if blockIndent >= 0 {
+			if trimmed == "" || len(line)-len(strings.TrimLeft(line, " \t")) > blockIndent {
+				minified = append(minified, line)
+				continue
+			}
+			blockIndent = -1
+		}
+		if i == 0 && strings.HasPrefix(line, "#!") {
+			minified = append(minified, line)
+			continue
+		}
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		minified = append(minified, line)
+		quote = getOpenQuote(line, 0)
+		if match := heredocRegex.FindStringSubmatch(line); match != nil {
+			heredoc, heredocStripsTabs = match[2], match[1] == "-"
+		} else if blockScalarRegex.MatchString(line) {
+			blockIndent = len(line) - len(strings.TrimLeft(line, " \t"))
+		}
+	}
+	result := strings.Join(minified, "\n")
+	if strings.HasSuffix(str, "\n") {
+		result += "\n"
+	}
+	return result
+}
+
+// getOpenQuote returns the shell quote left open at the end of line, given the quote open at its
+// start, or 0 if none is. A # starting a word outside of quotes comments out the rest of the line
+func getOpenQuote(line string, quote byte) byte {
+	escaped := false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			}
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return 0
+		}
+	}
+	return quote
+}
+
+// writeGzip compresses str into w. Both the write and the final flush on Close
+// are checked, since a failure in either leaves a truncated gzip stream behind
+func writeGzip(w io.Writer, str string) error {
+	gw := gzip.NewWriter(w)
+	if _, err := gw.Write([]byte(str)); err != nil {
+		return errors.Wrap(err, "error writing gzip stream")
+	}
+	if err := gw.Close(); err != nil {
+		return errors.Wrap(err, "error closing gzip stream")
+	}
+	return nil
+}
+
+func getAddonFuncMap(addon api.KubernetesAddon) template.FuncMap {
+	return template.FuncMap{
+		"ContainerImage": func(name string) string {
+			i := addon.GetAddonContainersIndexByName(name)
+			return addon.Containers[i].Image
+		},
+
+		"ContainerCPUReqs": func(name string) string {
+			i := addon.GetAddonContainersIndexByName(name)
+			return addon.Containers[i].CPURequests
+		},
+
+		"ContainerCPULimits": func(name string) string {
+			i := addon.GetAddonContainersIndexByName(name)
+			return addon.Containers[i].CPULimits
+		},
+
+		"ContainerMemReqs": func(name string) string {
+			i := addon.GetAddonContainersIndexByName(name)
+			return addon.Containers[i].MemoryRequests
+		},
+
+		"ContainerMemLimits": func(name string) string {
+			i := addon.GetAddonContainersIndexByName(name)
+			return addon.Containers[i].MemoryLimits
+		},
+		"ContainerConfig": func(name string) string {
+			return addon.Config[name]
+		},
+
+		"Override": func(key, defaultValue string) string {
+			if v, ok := addon.Overrides[key]; ok {
+				return v
+			}
+			return defaultValue
+		},
+
+		"ImagePullSecretsYAML": func() string {
+			return getAddonImagePullSecretsYAML(addon)
+		},
+
+		"InitContainersYAML": func() string {
+			return getAddonInitContainersYAML(addon)
+		},
+	}
+}
+
+// addonImagePullSecretsConfig is the addon config listing the secrets its pods pull their images with
+const addonImagePullSecretsConfig = "imagePullSecrets"
+
+// getAddonImagePullSecrets returns the names of the secrets the pods of the addon pull their images
+// with, from the comma separated imagePullSecrets config of the addon, e.g. for a private registry.
+// The secrets must exist in the namespace of the addon's pods
+func getAddonImagePullSecrets(addon api.KubernetesAddon) []string {
+	var secrets []string
+	for _, secret := range strings.Split(addon.Config[addonImagePullSecretsConfig], ",") {
+		if secret = strings.TrimSpace(secret); secret != "" {
+			secrets = append(secrets, secret)
+		}
+	}
+	return secrets
+}
+
+// getAddonImagePullSecretsYAML returns the imagePullSecrets of the pod specs of the addon, indented
+// for the pod template spec of a deployment or daemonset, or an empty string if none are configured
+func getAddonImagePullSecretsYAML(addon api.KubernetesAddon) string {
+	secrets := getAddonImagePullSecrets(addon)
+	if len(secrets) == 0 {
+		return ""
+	}
+	var buf bytes.Buffer
+	buf.WriteString("\n      imagePullSecrets:")
+	for _, secret := range secrets {
+		name, _ := json.Marshal(secret)
+		buf.WriteString(fmt.Sprintf("\n      - name: %s", name))
+	}
+	return buf.String()
+}
+
+// getAddonInitContainersYAML returns the initContainers of the pod specs of the addon, indented for
+// the pod template spec of a deployment or daemonset, or an empty string if none are configured.
+// Strings are quoted as JSON, which YAML reads as flow scalars and sequences
+func getAddonInitContainersYAML(addon api.KubernetesAddon) string {
+	if len(addon.InitContainers) == 0 {
+		return ""
+	}
+	var buf bytes.Buffer
+	buf.WriteString("\n      initContainers:")
+	for _, container := range addon.InitContainers {
+		name, _ := json.Marshal(container.Name)
+		image, _ := json.Marshal(container.Image)
+		buf.WriteString(fmt.Sprintf("\n      - name: %s\n        image: %s", name, image))
+		if len(container.Command) > 0 {
+			command, _ := json.Marshal(container.Command)
+			buf.WriteString(fmt.Sprintf("\n        command: %s", command))
+		}
+		if len(container.Args) > 0 {
+			args, _ := json.Marshal(container.Args)
+			buf.WriteString(fmt.Sprintf("\n        args: %s", args))
+		}
+		buf.WriteString(getInitContainerResourcesYAML(container))
+		buf.WriteString(getSecurityContextYAML(container.SecurityContext))
+	}
+	return buf.String()
+}
+
+// getInitContainerResourcesYAML returns the resources of an init container, emitting only the
+// requests and limits that are set
+func getInitContainerResourcesYAML(container api.KubernetesInitContainerSpec) string {
+	var requests, limits bytes.Buffer
+	for _, resource := range []struct {
+		buf   *bytes.Buffer
+		name  string
+		value string
+	}{
+		{&requests, "cpu", container.CPURequests},
+		{&requests, "memory", container.MemoryRequests},
+		{&limits, "cpu", container.CPULimits},
+		{&limits, "memory", container.MemoryLimits},
+	} {
+		if resource.value != "" {
+			value, _ := json.Marshal(resource.value)
+			resource.buf.WriteString(fmt.Sprintf("\n            %s: %s", resource.name, value))
+		}
+	}
+	if requests.Len() == 0 && limits.Len() == 0 {
+		return ""
+	}
+	var buf bytes.Buffer
+	buf.WriteString("\n        resources:")
+	if requests.Len() > 0 {
+		buf.WriteString("\n          requests:")
+		buf.Write(requests.Bytes())
+	}
+	if limits.Len() > 0 {
+		buf.WriteString("\n          limits:")
+		buf.Write(limits.Bytes())
+	}
+	return buf.String()
+}
+
+// getSecurityContextYAML returns the securityContext of a container, emitting only the options that
+// are set, or an empty string if none are
+func getSecurityContextYAML(securityContext *api.KubernetesSecurityContext) string {
+	if securityContext == nil {
+		return ""
+	}
+	var buf bytes.Buffer
+	if securityContext.Privileged != nil {
+		buf.WriteString(fmt.Sprintf("\n          privileged: %t", *securityContext.Privileged))
+	}
+	if securityContext.RunAsUser != nil {
+		buf.WriteString(fmt.Sprintf("\n          runAsUser: %d", *securityContext.RunAsUser))
+	}
+	if securityContext.RunAsNonRoot != nil {
+		buf.WriteString(fmt.Sprintf("\n          runAsNonRoot: %t", *securityContext.RunAsNonRoot))
+	}
+	if buf.Len() == 0 {
+		return ""
+	}
+	return "\n        securityContext:" + buf.String()
+}
+
+// validateAddonImagePullSecrets returns an error if an image pull secret of the addon is not a valid
+// Kubernetes secret name, which renders a manifest the API server rejects
+func validateAddonImagePullSecrets(addon api.KubernetesAddon) error {
+	for _, secret := range getAddonImagePullSecrets(addon) {
+		if len(secret) > 253 || !kubernetesSecretNameRegex.MatchString(secret) {
+			return errors.Errorf("addon %s image pull secret %s must be a lowercase RFC 1123 subdomain of at most 253 characters", addon.Name, secret)
+		}
 	}
-
-	textStr := escapeSingleLine(string(expandedTemplate))
-
-	return textStr, nil
+	return nil
 }
 
-func escapeSingleLine(escapedStr string) string {
-	// template.JSEscapeString leaves undesirable chars that don't work with pretty print
-	escapedStr = strings.Replace(escapedStr, "\\", "\\\\", -1)
-	escapedStr = strings.Replace(escapedStr, "\r\n", "\\n", -1)
-	escapedStr = strings.Replace(escapedStr, "\n", "\\n", -1)
-	escapedStr = strings.Replace(escapedStr, "\"", "\\\"", -1)
-	return escapedStr
+// validateAddonContainerResources returns an error if a container of the addon requests more CPU
+// or memory than its limit, which renders a manifest the API server rejects
+func validateAddonContainerResources(addon api.KubernetesAddon) error {
+	for _, container := range addon.Containers {
+		if err := validateResourceRequestWithinLimit(addon.Name, container.Name, "CPU", container.CPURequests, container.CPULimits); err != nil {
+			return err
+		}
+		if err := validateResourceRequestWithinLimit(addon.Name, container.Name, "memory", container.MemoryRequests, container.MemoryLimits); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// getBase64CustomScript will return a base64 of the CSE
-func getBase64CustomScript(csFilename string) string {
-	b, err := Asset(csFilename)
-	if err != nil {
-		// this should never happen and this is a bug
-		panic(fmt.Sprintf("BUG: %s", err.Error()))
+// validateAddonInitContainers returns an error if an init container of the addon has no image, an
+// invalid name, a name taken by another container of its pods, requests exceeding its limits or a
+// security context the kubelet refuses to run, which renders a manifest the cluster can't run
+func validateAddonInitContainers(addon api.KubernetesAddon) error {
+	names := make(map[string]bool, len(addon.Containers)+len(addon.InitContainers))
+	for _, container := range addon.Containers {
+		names[container.Name] = true
 	}
-	// translate the parameters
-	csStr := string(b)
-	csStr = strings.Replace(csStr, "\r\n", "\n", -1)
-	return getBase64CustomScriptFromStr(csStr)
+	for _, container := range addon.InitContainers {
+		if !kubernetesContainerNameRegex.MatchString(container.Name) {
+			return errors.Errorf("addon %s init container name %q must be a lowercase RFC 1123 label of at most 63 characters", addon.Name, container.Name)
+		}
+		if names[container.Name] {
+			return errors.Errorf("addon %s init container name %s is not unique among the containers of the addon", addon.Name, container.Name)
+		}
+		names[container.Name] = true
+		if container.Image == "" {
+			return errors.Errorf("addon %s init container %s requires an image", addon.Name, container.Name)
+		}
+		if err := validateResourceRequestWithinLimit(addon.Name, container.Name, "CPU", container.CPURequests, container.CPULimits); err != nil {
+			return err
+		}
+		if err := validateResourceRequestWithinLimit(addon.Name, container.Name, "memory", container.MemoryRequests, container.MemoryLimits); err != nil {
+			return err
+		}
+		if securityContext := container.SecurityContext; securityContext != nil && securityContext.RunAsUser != nil {
+			if *securityContext.RunAsUser < 0 {
+				return errors.Errorf("addon %s init container %s runAsUser %d must not be negative", addon.Name, container.Name, *securityContext.RunAsUser)
+			}
+			if *securityContext.RunAsUser == 0 && helpers.IsTrueBoolPointer(securityContext.RunAsNonRoot) {
+				return errors.Errorf("addon %s init container %s runs as root with runAsUser 0, which runAsNonRoot forbids", addon.Name, container.Name)
+			}
+		}
+	}
+	return nil
 }
 
-// getBase64CustomScript will return a base64 of the CSE
-func getBase64CustomScriptFromStr(str string) string {
-	var gzipB bytes.Buffer
-	w := gzip.NewWriter(&gzipB)
-	w.Write([]byte(str))
-	w.Close()
-	return base64.StdEncoding.EncodeToString(gzipB.Bytes())
+func validateResourceRequestWithinLimit(addonName, containerName, resourceName, request, limit string) error {
+	if request == "" || limit == "" {
+		return nil
+	}
+	requestQuantity, err := resource.ParseQuantity(request)
+	if err != nil {
+		return errors.Wrapf(err, "addon %s container %s has an invalid %s request %s", addonName, containerName, resourceName, request)
+	}
+	limitQuantity, err := resource.ParseQuantity(limit)
+	if err != nil {
+		return errors.Wrapf(err, "addon %s container %s has an invalid %s limit %s", addonName, containerName, resourceName, limit)
+	}
+	if requestQuantity.Cmp(limitQuantity) > 0 {
+		return errors.Errorf("addon %s container %s requests %s %s, more than its limit of %s", addonName, containerName, resourceName, request, limit)
+	}
+	return nil
 }
 
-func getAddonFuncMap(addon api.KubernetesAddon) template.FuncMap {
-	return template.FuncMap{
-		"ContainerImage": func(name string) string {
-			i := addon.GetAddonContainersIndexByName(name)
-			return addon.Containers[i].Image
-		},
-
-		"ContainerCPUReqs": func(name string) string {
-			i := addon.GetAddonContainersIndexByName(name)
-			return addon.Containers[i].CPURequests
-		},
-
-		"ContainerCPULimits": func(name string) string {
-			i := addon.GetAddonContainersIndexByName(name)
-			return addon.Containers[i].CPULimits
-		},
-
-		"ContainerMemReqs": func(name string) string {
-			i := addon.GetAddonContainersIndexByName(name)
-			return addon.Containers[i].MemoryRequests
-		},
-
-		"ContainerMemLimits": func(name string) string {
-			i := addon.GetAddonContainersIndexByName(name)
-			return addon.Containers[i].MemoryLimits
-		},
-		"ContainerConfig": func(name string) string {
-			return addon.Config[name]
-		},
-	}
+// getContainerAddonsString returns the cloud-init files of the enabled container addons, leaving out
+// the addons named in deniedAddons even if they are enabled. If combined is set, the addons written
+// to the default destination are joined in a single multi-document CombinedAddonsManifestFile,
+// while the addons with their own destination, or edited by the provisioning scripts, keep their file
+func getContainerAddonsString(properties *api.Properties, sourcePath string, deniedAddons []string, combined bool) (string, error) {
+	return getContainerAddonsStringWithOptions(properties, sourcePath, deniedAddons, combined, CustomDataEncodingOptions{})
 }
 
-func getContainerAddonsString(properties *api.Properties, sourcePath string) string {
+// getContainerAddonsStringWithOptions returns the cloud-init write_files entries of the enabled
+// container addons, encoded according to options
+func getContainerAddonsStringWithOptions(properties *api.Properties, sourcePath string, deniedAddons []string, combined bool, options CustomDataEncodingOptions) (string, error) {
 	var result string
+	var combinedManifests []string
+	denied := make(map[string]bool, len(deniedAddons))
+	for _, addonName := range deniedAddons {
+		denied[addonName] = true
+	}
 	settingsMap := kubernetesContainerAddonSettingsInit(properties)
 
 	var addonNames []string
@@ -511,37 +2070,81 @@ func getContainerAddonsString(properties *api.Properties, sourcePath string) str
 
 	for _, addonName := range addonNames {
 		setting := settingsMap[addonName]
+		if setting.isEnabled && denied[addonName] {
+			log.Printf("addon %s is enabled but excluded by the addon deny-list", addonName)
+			continue
+		}
 		if setting.isEnabled {
+			addon := properties.OrchestratorProfile.KubernetesConfig.GetAddonByName(addonName)
 			var input string
 			if setting.rawScript != "" {
 				input = setting.rawScript
 			} else {
-				addon := properties.OrchestratorProfile.KubernetesConfig.GetAddonByName(addonName)
+				if err := validateAddonContainerResources(addon); err != nil {
+					return "", err
+				}
+				if err := validateAddonImagePullSecrets(addon); err != nil {
+					return "", err
+				}
+				if err := validateAddonInitContainers(addon); err != nil {
+					return "", err
+				}
 				templ := template.New("addon resolver template").Funcs(getAddonFuncMap(addon))
 				addonFile := sourcePath + "/" + setting.sourceFile
 				addonFileBytes, err := Asset(addonFile)
 				if err != nil {
-					return ""
+					return "", errors.Wrapf(err, "error reading the %s addon template", addonName)
 				}
 				_, err = templ.Parse(string(addonFileBytes))
 				if err != nil {
-					return ""
+					return "", errors.Wrapf(err, "error parsing the %s addon template", addonName)
 				}
 				var buffer bytes.Buffer
-				templ.Execute(&buffer, addon)
+				if err = templ.Execute(&buffer, addon); err != nil {
+					return "", errors.Wrapf(err, "error executing the %s addon template", addonName)
+				}
 				input = buffer.String()
 			}
-			result += getAddonString(input, "/etc/kubernetes/addons", setting.destinationFile)
+			if combined && addon.Destination == "" && !provisionedAddonFiles[setting.destinationFile] {
+				manifest := strings.TrimPrefix(strings.TrimSpace(input), "---")
+				combinedManifests = append(combinedManifests, strings.TrimSpace(manifest))
+				continue
+			}
+			destinationPath := defaultAddonsDestinationPath
+			if addon.Destination != "" {
+				destinationPath = strings.TrimSuffix(addon.Destination, "/")
+			}
+			addonString, err := getAddonStringWithOptions(input, destinationPath, setting.destinationFile, options)
+			if err != nil {
+				return "", err
+			}
+			result += addonString
 		}
 	}
-	return result
+	if len(combinedManifests) > 0 {
+		addonString, err := getAddonStringWithOptions(strings.Join(combinedManifests, "\n---\n")+"\n", defaultAddonsDestinationPath, CombinedAddonsManifestFile, options)
+		if err != nil {
+			return "", err
+		}
+		result += addonString
+	}
+	return result, nil
 }
 
-func getKubernetesSubnets(properties *api.Properties) string {
+// defaultAddonsDestinationPath is the directory the addon manager applies the addon manifests from
+const defaultAddonsDestinationPath = "/etc/kubernetes/addons"
+
+// getKubernetesSubnets returns the per-node podCIDR subnets. Only Windows nodes are enumerated unless
+// includeLinuxNodes is set, in which case Linux agent nodes are enumerated too, taking the indexes
+// below getKubernetesPodStartIndex so that the Windows node subnets are the same either way
+func getKubernetesSubnets(properties *api.Properties, includeLinuxNodes bool) (string, error) {
+	if err := ValidateKubernetesSubnets(properties, includeLinuxNodes); err != nil {
+		return "", err
+	}
 	subnetString := `{
             "name": "podCIDR%d",
             "properties": {
-              "addressPrefix": "10.244.%d.0/24",
+              "addressPrefix": "%s",
               "networkSecurityGroup": {
                 "id": "[variables('nsgID')]"
               },
@@ -551,18 +2154,108 @@ func getKubernetesSubnets(properties *api.Properties) string {
             }
           }`
 	var buf bytes.Buffer
+	for _, cidrIndex := range getKubernetesPodCIDRIndexes(properties, includeLinuxNodes) {
+		buf.WriteString(",\n")
+		buf.WriteString(fmt.Sprintf(subnetString, cidrIndex, getKubernetesPodCIDR(cidrIndex)))
+	}
+	return buf.String(), nil
+}
+
+// ValidateKubernetesSubnets returns an error if a podCIDR subnet emitted by getKubernetesSubnets
+// overlaps the master subnet or an agent pool subnet, which breaks the routing of pod traffic.
+// The VNET address space is not checked, the podCIDR subnets are carved out of it
+func ValidateKubernetesSubnets(properties *api.Properties, includeLinuxNodes bool) error {
+	prefixes := map[string]string{}
+	if properties.MasterProfile != nil {
+		prefixes["MasterProfile.Subnet"] = properties.MasterProfile.Subnet
+		prefixes["MasterProfile.AgentSubnet"] = properties.MasterProfile.AgentSubnet
+	}
+	for _, agentProfile := range properties.AgentPoolProfiles {
+		prefixes[fmt.Sprintf("agent pool %s subnet", agentProfile.Name)] = agentProfile.Subnet
+	}
+	var names []string
+	for name := range prefixes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, cidrIndex := range getKubernetesPodCIDRIndexes(properties, includeLinuxNodes) {
+		podCIDR := getKubernetesPodCIDR(cidrIndex)
+		_, podSubnet, err := net.ParseCIDR(podCIDR)
+		if err != nil {
+			return errors.Errorf("podCIDR%d %s is an invalid CIDR, the cluster has too many nodes", cidrIndex, podCIDR)
+		}
+		for _, name := range names {
+			if prefixes[name] == "" {
+				continue
+			}
+			_, subnet, err := net.ParseCIDR(prefixes[name])
+			if err != nil {
+				return errors.Wrapf(err, "%s '%s' is an invalid CIDR", name, prefixes[name])
+			}
+			if subnet.Contains(podSubnet.IP) || podSubnet.Contains(subnet.IP) {
+				return errors.Errorf("podCIDR%d %s overlaps %s %s", cidrIndex, podCIDR, name, prefixes[name])
+			}
+		}
+	}
+	return nil
+}
+
+// GetKubernetesNodePodCIDRs returns the pod CIDR of each node that getKubernetesSubnets emits a
+// podCIDR subnet for, keyed by the node's pool name and index within the pool, e.g. agentpool1-0
+func GetKubernetesNodePodCIDRs(properties *api.Properties, includeLinuxNodes bool) map[string]string {
+	podCIDRs := map[string]string{}
+	for _, node := range getKubernetesPodCIDRNodes(properties, includeLinuxNodes) {
+		podCIDRs[node.name] = getKubernetesPodCIDR(node.cidrIndex)
+	}
+	return podCIDRs
+}
+
+// podCIDRNode is a node assigned the podCIDR subnet of index cidrIndex
+type podCIDRNode struct {
+	name      string
+	cidrIndex int
+}
+
+// getKubernetesPodCIDRIndexes returns the indexes of the podCIDR subnets emitted by getKubernetesSubnets
+func getKubernetesPodCIDRIndexes(properties *api.Properties, includeLinuxNodes bool) []int {
+	var indexes []int
+	for _, node := range getKubernetesPodCIDRNodes(properties, includeLinuxNodes) {
+		indexes = append(indexes, node.cidrIndex)
+	}
+	return indexes
+}
+
+// getKubernetesPodCIDRNodes returns the nodes assigned a podCIDR subnet, in the order getKubernetesSubnets
+// emits their subnets. Windows nodes are indexed after all the linux nodes, from getKubernetesPodStartIndex
+func getKubernetesPodCIDRNodes(properties *api.Properties, includeLinuxNodes bool) []podCIDRNode {
+	var nodes []podCIDRNode
+	if includeLinuxNodes {
+		cidrIndex := properties.MasterProfile.Count + 1
+		for _, agentProfile := range properties.AgentPoolProfiles {
+			if agentProfile.OSType != api.Windows {
+				for i := 0; i < agentProfile.Count; i++ {
+					nodes = append(nodes, podCIDRNode{fmt.Sprintf("%s-%d", agentProfile.Name, i), cidrIndex})
+					cidrIndex++
+				}
+			}
+		}
+	}
 
 	cidrIndex := getKubernetesPodStartIndex(properties)
 	for _, agentProfile := range properties.AgentPoolProfiles {
 		if agentProfile.OSType == api.Windows {
 			for i := 0; i < agentProfile.Count; i++ {
-				buf.WriteString(",\n")
-				buf.WriteString(fmt.Sprintf(subnetString, cidrIndex, cidrIndex))
+				nodes = append(nodes, podCIDRNode{fmt.Sprintf("%s-%d", agentProfile.Name, i), cidrIndex})
 				cidrIndex++
 			}
 		}
 	}
-	return buf.String()
+	return nodes
+}
+
+func getKubernetesPodCIDR(cidrIndex int) string {
+	return fmt.Sprintf("10.244.%d.0/24", cidrIndex)
 }
 
 func getKubernetesPodStartIndex(properties *api.Properties) int {
@@ -580,7 +2273,7 @@ func getKubernetesPodStartIndex(properties *api.Properties) int {
 // getLinkedTemplatesForExtensions returns the
 // Microsoft.Resources/deployments for each extension
 //func getLinkedTemplatesForExtensions(properties api.Properties) string {
-func getLinkedTemplatesForExtensions(properties *api.Properties) string {
+func getLinkedTemplatesForExtensions(ctx context.Context, properties *api.Properties) (string, error) {
 	var result string
 
 	extensions := properties.ExtensionProfiles
@@ -593,10 +2286,13 @@ func getLinkedTemplatesForExtensions(properties *api.Properties) string {
 		masterOptedForExtension, singleOrAll := validateProfileOptedForExtension(extensionProfile.Name, masterProfileExtensions)
 		if masterOptedForExtension {
 			result += ","
-			dta, e := getMasterLinkedTemplateText(properties.MasterProfile, orchestratorType, extensionProfile, singleOrAll)
+			dta, e := getMasterLinkedTemplateText(ctx, properties.MasterProfile, orchestratorType, extensionProfile, singleOrAll)
 			if e != nil {
+				if ctx.Err() != nil {
+					return "", errors.Wrap(ctx.Err(), "fetching linked extension templates")
+				}
 				fmt.Println(e.Error())
-				return ""
+				return "", nil
 			}
 			result += dta
 		}
@@ -606,10 +2302,13 @@ func getLinkedTemplatesForExtensions(properties *api.Properties) string {
 			poolOptedForExtension, singleOrAll := validateProfileOptedForExtension(extensionProfile.Name, poolProfileExtensions)
 			if poolOptedForExtension {
 				result += ","
-				dta, e := getAgentPoolLinkedTemplateText(agentPoolProfile, orchestratorType, extensionProfile, singleOrAll)
+				dta, e := getAgentPoolLinkedTemplateText(ctx, agentPoolProfile, orchestratorType, extensionProfile, singleOrAll)
 				if e != nil {
+					if ctx.Err() != nil {
+						return "", errors.Wrap(ctx.Err(), "fetching linked extension templates")
+					}
 					fmt.Println(e.Error())
-					return ""
+					return "", nil
 				}
 				result += dta
 			}
@@ -617,10 +2316,117 @@ func getLinkedTemplatesForExtensions(properties *api.Properties) string {
 		}
 	}
 
-	return result
+	return result, nil
+}
+
+// GetLinkedTemplateForExtension returns the linked template text of the named extension for
+// the master and every agent pool that opted in to it, joined by commas. It returns an error
+// if the extension is not defined or no profile opted in to it
+func GetLinkedTemplateForExtension(ctx context.Context, properties *api.Properties, extensionName string) (string, error) {
+	var extensionProfile *api.ExtensionProfile
+	for _, e := range properties.ExtensionProfiles {
+		if e.Name == extensionName {
+			extensionProfile = e
+			break
+		}
+	}
+	if extensionProfile == nil {
+		return "", errors.Errorf("extension %s is not defined in ExtensionProfiles", extensionName)
+	}
+
+	orchestratorType := properties.OrchestratorProfile.OrchestratorType
+	var templates []string
+	if properties.MasterProfile != nil {
+		if optedIn, singleOrAll := validateProfileOptedForExtension(extensionName, properties.MasterProfile.Extensions); optedIn {
+			dta, err := getMasterLinkedTemplateText(ctx, properties.MasterProfile, orchestratorType, extensionProfile, singleOrAll)
+			if err != nil {
+				return "", err
+			}
+			templates = append(templates, dta)
+		}
+	}
+	for _, agentPoolProfile := range properties.AgentPoolProfiles {
+		if optedIn, singleOrAll := validateProfileOptedForExtension(extensionName, agentPoolProfile.Extensions); optedIn {
+			dta, err := getAgentPoolLinkedTemplateText(ctx, agentPoolProfile, orchestratorType, extensionProfile, singleOrAll)
+			if err != nil {
+				return "", err
+			}
+			templates = append(templates, dta)
+		}
+	}
+	if len(templates) == 0 {
+		return "", errors.Errorf("no profile opted in to extension %s", extensionName)
+	}
+	return strings.Join(templates, ","), nil
+}
+
+// GetExtensionURLs returns the distinct extension resource URLs that generating a template
+// for properties will request, in the order they are first requested
+func GetExtensionURLs(properties *api.Properties) []string {
+	var urls []string
+	seen := map[string]bool{}
+	for _, extensionProfile := range properties.ExtensionProfiles {
+		if !isExtensionOptedIn(properties, extensionProfile.Name) {
+			continue
+		}
+		for _, fileName := range []string{"supported-orchestrators.json", "template-link.json"} {
+			extensionURL := getExtensionURL(extensionProfile.RootURL, extensionProfile.ExtensionsDir, extensionProfile.Name, extensionProfile.Version, fileName, extensionProfile.URLQuery)
+			if !seen[extensionURL] {
+				seen[extensionURL] = true
+				urls = append(urls, extensionURL)
+			}
+		}
+	}
+	return urls
+}
+
+// GetUnusedExtensionProfiles returns the names of the extension profiles that neither the master
+// nor any agent pool opted in to, either as an extension or as its preprovision extension. Nothing
+// is deployed for them, which usually points to a misspelled or forgotten extension reference
+func GetUnusedExtensionProfiles(properties *api.Properties) []string {
+	var unused []string
+	for _, extensionProfile := range properties.ExtensionProfiles {
+		if isExtensionOptedIn(properties, extensionProfile.Name) || isPreprovisionExtensionProfile(properties, extensionProfile) {
+			continue
+		}
+		unused = append(unused, extensionProfile.Name)
+	}
+	return unused
+}
+
+// isExtensionOptedIn returns true if the master or an agent pool lists the named extension,
+// getLinkedTemplatesForExtensions deploying it for each of them
+func isExtensionOptedIn(properties *api.Properties, extensionName string) bool {
+	if properties.MasterProfile != nil {
+		if optedIn, _ := validateProfileOptedForExtension(extensionName, properties.MasterProfile.Extensions); optedIn {
+			return true
+		}
+	}
+	for _, agentPoolProfile := range properties.AgentPoolProfiles {
+		if optedIn, _ := validateProfileOptedForExtension(extensionName, agentPoolProfile.Extensions); optedIn {
+			return true
+		}
+	}
+	return false
 }
 
-func getMasterLinkedTemplateText(masterProfile *api.MasterProfile, orchestratorType string, extensionProfile *api.ExtensionProfile, singleOrAll string) (string, error) {
+// isPreprovisionExtensionProfile returns true if extensionProfile defines the preprovision
+// extension of the master or an agent pool
+func isPreprovisionExtensionProfile(properties *api.Properties, extensionProfile *api.ExtensionProfile) bool {
+	profiles := []*api.ExtensionProfile{extensionProfile}
+	if properties.MasterProfile != nil && properties.MasterProfile.PreprovisionExtension != nil &&
+		getExtensionProfile(properties.MasterProfile.PreprovisionExtension, profiles) != nil {
+		return true
+	}
+	for _, agentPoolProfile := range properties.AgentPoolProfiles {
+		if agentPoolProfile.PreprovisionExtension != nil && getExtensionProfile(agentPoolProfile.PreprovisionExtension, profiles) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func getMasterLinkedTemplateText(ctx context.Context, masterProfile *api.MasterProfile, orchestratorType string, extensionProfile *api.ExtensionProfile, singleOrAll string) (string, error) {
 	extTargetVMNamePrefix := "variables('masterVMNamePrefix')"
 
 	// Due to upgrade k8s sometimes needs to install just some of the nodes.
@@ -630,13 +2436,13 @@ func getMasterLinkedTemplateText(masterProfile *api.MasterProfile, orchestratorT
 	if strings.EqualFold(singleOrAll, "single") {
 		loopCount = "1"
 	}
-	return internalGetPoolLinkedTemplateText(extTargetVMNamePrefix, orchestratorType, loopCount,
+	return internalGetPoolLinkedTemplateText(ctx, extTargetVMNamePrefix, orchestratorType, loopCount,
 		loopOffset, extensionProfile)
 }
 
-func getAgentPoolLinkedTemplateText(agentPoolProfile *api.AgentPoolProfile, orchestratorType string, extensionProfile *api.ExtensionProfile, singleOrAll string) (string, error) {
+func getAgentPoolLinkedTemplateText(ctx context.Context, agentPoolProfile *api.AgentPoolProfile, orchestratorType string, extensionProfile *api.ExtensionProfile, singleOrAll string) (string, error) {
 	extTargetVMNamePrefix := fmt.Sprintf("variables('%sVMNamePrefix')", agentPoolProfile.Name)
-	loopCount := fmt.Sprintf("[variables('%sCount'))]", agentPoolProfile.Name)
+	loopCount := fmt.Sprintf("[variables('%sCount')]", agentPoolProfile.Name)
 	loopOffset := ""
 
 	// Availability sets can have an offset since we don't redeploy vms.
@@ -651,12 +2457,21 @@ func getAgentPoolLinkedTemplateText(agentPoolProfile *api.AgentPoolProfile, orch
 		loopCount = "1"
 	}
 
-	return internalGetPoolLinkedTemplateText(extTargetVMNamePrefix, orchestratorType, loopCount,
+	return internalGetPoolLinkedTemplateText(ctx, extTargetVMNamePrefix, orchestratorType, loopCount,
 		loopOffset, extensionProfile)
 }
 
-func internalGetPoolLinkedTemplateText(extTargetVMNamePrefix, orchestratorType, loopCount, loopOffset string, extensionProfile *api.ExtensionProfile) (string, error) {
-	dta, e := getLinkedTemplateTextForURL(extensionProfile.RootURL, orchestratorType, extensionProfile.Name, extensionProfile.Version, extensionProfile.URLQuery)
+func internalGetPoolLinkedTemplateText(ctx context.Context, extTargetVMNamePrefix, orchestratorType, loopCount, loopOffset string, extensionProfile *api.ExtensionProfile) (string, error) {
+	if loopCount == "" {
+		return "", errors.Errorf("extension %s has an empty loop count", extensionProfile.Name)
+	}
+	if err := validateBalancedExpression(loopCount); err != nil {
+		return "", errors.Wrapf(err, "extension %s has an invalid loop count", extensionProfile.Name)
+	}
+	if err := validateBalancedExpression(loopOffset); err != nil {
+		return "", errors.Wrapf(err, "extension %s has an invalid loop offset", extensionProfile.Name)
+	}
+	dta, e := getLinkedTemplateTextForURL(ctx, extensionProfile.RootURL, extensionProfile.ExtensionsDir, orchestratorType, extensionProfile.Name, extensionProfile.Version, extensionProfile.URLQuery)
 	if e != nil {
 		return "", e
 	}
@@ -665,7 +2480,7 @@ func internalGetPoolLinkedTemplateText(extTargetVMNamePrefix, orchestratorType,
 	} else {
 		dta = strings.Replace(dta, "EXTENSION_TARGET_VM_TYPE", "agent", -1)
 	}
-	extensionsParameterReference := fmt.Sprintf("[parameters('%sParameters')]", extensionProfile.Name)
+	extensionsParameterReference := fmt.Sprintf("[parameters('%s')]", getExtensionParametersName(extensionProfile.Name))
 	dta = strings.Replace(dta, "EXTENSION_PARAMETERS_REPLACE", extensionsParameterReference, -1)
 	dta = strings.Replace(dta, "EXTENSION_URL_REPLACE", extensionProfile.RootURL, -1)
 	dta = strings.Replace(dta, "EXTENSION_TARGET_VM_NAME_PREFIX", extTargetVMNamePrefix, -1)
@@ -679,6 +2494,74 @@ func internalGetPoolLinkedTemplateText(extTargetVMNamePrefix, orchestratorType,
 	return dta, nil
 }
 
+// validateBalancedExpression checks that the parentheses and brackets of an ARM template
+// expression are balanced, ignoring those inside single-quoted string literals
+func validateBalancedExpression(expression string) error {
+	var open []rune
+	inString := false
+	for _, r := range expression {
+		if r == '\'' {
+			inString = !inString
+			continue
+		}
+		if inString {
+			continue
+		}
+		switch r {
+		case '(', '[':
+			open = append(open, r)
+		case ')', ']':
+			expected := '('
+			if r == ']' {
+				expected = '['
+			}
+			if len(open) == 0 || open[len(open)-1] != expected {
+				return errors.Errorf("expression %s has an unmatched %c", expression, r)
+			}
+			open = open[:len(open)-1]
+		}
+	}
+	if inString {
+		return errors.Errorf("expression %s has an unterminated string literal", expression)
+	}
+	if len(open) > 0 {
+		return errors.Errorf("expression %s has an unclosed %c", expression, open[len(open)-1])
+	}
+	return nil
+}
+
+// ValidateExtensionSingleOrAll returns an error if the singleOrAll of an extension the master or an
+// agent pool opted in to is neither single nor all, or is single on a scale set. The linked template of
+// a single selection targets the first VM past the offset of an availability set, which a scale set,
+// redeploying all its instances, does not have
+func ValidateExtensionSingleOrAll(properties *api.Properties) error {
+	validate := func(profileName string, extensions []api.Extension, isVMSS bool) error {
+		for _, extension := range extensions {
+			switch {
+			case extension.SingleOrAll == "" || strings.EqualFold(extension.SingleOrAll, "all"):
+			case strings.EqualFold(extension.SingleOrAll, "single"):
+				if isVMSS {
+					return errors.Errorf("extension %s of the %s selects a single VM, which is only supported on availability sets", extension.Name, profileName)
+				}
+			default:
+				return errors.Errorf("extension %s of the %s has singleOrAll %s, must be single or all", extension.Name, profileName, extension.SingleOrAll)
+			}
+		}
+		return nil
+	}
+	if properties.MasterProfile != nil {
+		if err := validate("master profile", properties.MasterProfile.Extensions, properties.MasterProfile.IsVirtualMachineScaleSets()); err != nil {
+			return err
+		}
+	}
+	for _, agentPoolProfile := range properties.AgentPoolProfiles {
+		if err := validate(fmt.Sprintf("agent pool %s", agentPoolProfile.Name), agentPoolProfile.Extensions, agentPoolProfile.IsVirtualMachineScaleSets()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func validateProfileOptedForExtension(extensionName string, profileExtensions []api.Extension) (bool, string) {
 	for _, extension := range profileExtensions {
 		if extensionName == extension.Name {
@@ -690,17 +2573,17 @@ func validateProfileOptedForExtension(extensionName string, profileExtensions []
 
 // getLinkedTemplateTextForURL returns the string data from
 // template-link.json in the following directory:
-// extensionsRootURL/extensions/extensionName/version
+// extensionsRootURL/extensionsDir/extensionName/version
 // It returns an error if the extension cannot be found
 // or loaded.  getLinkedTemplateTextForURL provides the ability
 // to pass a root extensions url for testing
-func getLinkedTemplateTextForURL(rootURL, orchestrator, extensionName, version, query string) (string, error) {
-	supportsExtension, err := orchestratorSupportsExtension(rootURL, orchestrator, extensionName, version, query)
+func getLinkedTemplateTextForURL(ctx context.Context, rootURL, extensionsDir, orchestrator, extensionName, version, query string) (string, error) {
+	supportsExtension, err := orchestratorSupportsExtension(ctx, rootURL, extensionsDir, orchestrator, extensionName, version, query)
 	if !supportsExtension {
 		return "", errors.Wrap(err, "Extension not supported for orchestrator")
 	}
 
-	templateLinkBytes, err := getExtensionResource(rootURL, extensionName, version, "template-link.json", query)
+	templateLinkBytes, err := getExtensionResource(ctx, rootURL, extensionsDir, extensionName, version, "template-link.json", query)
 	if err != nil {
 		return "", err
 	}
@@ -708,8 +2591,8 @@ func getLinkedTemplateTextForURL(rootURL, orchestrator, extensionName, version,
 	return string(templateLinkBytes), nil
 }
 
-func orchestratorSupportsExtension(rootURL, orchestrator, extensionName, version, query string) (bool, error) {
-	orchestratorBytes, err := getExtensionResource(rootURL, extensionName, version, "supported-orchestrators.json", query)
+func orchestratorSupportsExtension(ctx context.Context, rootURL, extensionsDir, orchestrator, extensionName, version, query string) (bool, error) {
+	orchestratorBytes, err := getExtensionResource(ctx, rootURL, extensionsDir, extensionName, version, "supported-orchestrators.json", query)
 	if err != nil {
 		return false, err
 	}
@@ -727,35 +2610,226 @@ func orchestratorSupportsExtension(rootURL, orchestrator, extensionName, version
 	return true, nil
 }
 
-func getExtensionResource(rootURL, extensionName, version, fileName, query string) ([]byte, error) {
-	requestURL := getExtensionURL(rootURL, extensionName, version, fileName, query)
+// extensionFetchPolicyKey is the context key of the ExtensionFetchPolicy of the extension requests
+type extensionFetchPolicyKey struct{}
+
+// withExtensionFetchPolicy returns a copy of ctx carrying policy to the extension requests made with it
+func withExtensionFetchPolicy(ctx context.Context, policy ExtensionFetchPolicy) context.Context {
+	return context.WithValue(ctx, extensionFetchPolicyKey{}, policy)
+}
+
+// getExtensionFetchPolicy returns the ExtensionFetchPolicy carried by ctx, the zero policy if none
+func getExtensionFetchPolicy(ctx context.Context) ExtensionFetchPolicy {
+	policy, _ := ctx.Value(extensionFetchPolicyKey{}).(ExtensionFetchPolicy)
+	return policy
+}
+
+// getExtensionResource fetches an extension resource, retrying the transient failures according
+// to the ExtensionFetchPolicy of ctx. It is shared by every extension request, including the
+// supported-orchestrators.json check of orchestratorSupportsExtension
+func getExtensionResource(ctx context.Context, rootURL, extensionsDir, extensionName, version, fileName, query string) ([]byte, error) {
+	requestURL := getExtensionURL(rootURL, extensionsDir, extensionName, version, fileName, query)
+	policy := getExtensionFetchPolicy(ctx)
+	backoff := policy.Backoff
+	if backoff == 0 {
+		backoff = DefaultExtensionFetchBackoff
+	}
+	for attempt := 0; ; attempt++ {
+		body, retriable, err := getExtensionResourceAttempt(ctx, policy.Timeout, requestURL, extensionName, version, fileName)
+		if err == nil || !retriable || attempt >= policy.Retries || ctx.Err() != nil {
+			return body, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, errors.Wrapf(ctx.Err(), "fetching extension resource %s of extension %s", fileName, extensionName)
+		case <-time.After(backoff << uint(attempt)):
+		}
+	}
+}
 
-	res, err := http.Get(requestURL)
+// getExtensionResourceAttempt makes a single request for an extension resource, bounded by timeout
+// if set. It reports whether a failure is transient, a network error, a 5xx or a 429 status
+func getExtensionResourceAttempt(ctx context.Context, timeout time.Duration, requestURL, extensionName, version, fileName string) ([]byte, bool, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequest(http.MethodGet, requestURL, nil)
+	if err != nil {
+		return nil, false, errors.Wrapf(err, "Unable to create request for extension resource for extension: %s with version %s with filename %s at URL: %s", extensionName, version, fileName, requestURL)
+	}
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
 	if err != nil {
-		return nil, errors.Wrapf(err, "Unable to GET extension resource for extension: %s with version %s with filename %s at URL: %s", extensionName, version, fileName, requestURL)
+		return nil, true, errors.Wrapf(err, "Unable to GET extension resource for extension: %s with version %s with filename %s at URL: %s", extensionName, version, fileName, requestURL)
 	}
 
 	defer res.Body.Close()
 
 	if res.StatusCode != 200 {
-		return nil, errors.Errorf("Unable to GET extension resource for extension: %s with version %s with filename %s at URL: %s StatusCode: %s: Status: %s", extensionName, version, fileName, requestURL, strconv.Itoa(res.StatusCode), res.Status)
+		retriable := res.StatusCode >= http.StatusInternalServerError || res.StatusCode == http.StatusTooManyRequests
+		return nil, retriable, errors.Errorf("Unable to GET extension resource for extension: %s with version %s with filename %s at URL: %s StatusCode: %s: Status: %s", extensionName, version, fileName, requestURL, strconv.Itoa(res.StatusCode), res.Status)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, true, errors.Wrapf(err, "Unable to GET extension resource for extension: %s with version %s  with filename %s at URL: %s", extensionName, version, fileName, requestURL)
+	}
+
+	return body, false, nil
+}
+
+// extensionVersionLinkRegex matches the links to subdirectories in an extension directory listing
+var extensionVersionLinkRegex = regexp.MustCompile(`href="([^"/?#]+)/"`)
+
+// ValidateExtensionVersions checks that the declared version of every extension profile exists
+// under its root URL before the template generation fetches its resources
+func ValidateExtensionVersions(ctx context.Context, properties *api.Properties) error {
+	for _, extensionProfile := range properties.ExtensionProfiles {
+		if err := validateExtensionVersion(ctx, extensionProfile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateExtensionVersion probes supported-orchestrators.json, which every extension version
+// provides. When it is missing, the error lists the versions found in the directory listing
+// of the extension, if the root URL serves one
+func validateExtensionVersion(ctx context.Context, extensionProfile *api.ExtensionProfile) error {
+	requestURL := getExtensionURL(extensionProfile.RootURL, extensionProfile.ExtensionsDir, extensionProfile.Name, extensionProfile.Version, "supported-orchestrators.json", extensionProfile.URLQuery)
+	req, err := http.NewRequest(http.MethodHead, requestURL, nil)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to create request for extension %s version %s at URL: %s", extensionProfile.Name, extensionProfile.Version, requestURL)
+	}
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrapf(err, "Unable to check extension %s version %s at URL: %s", extensionProfile.Name, extensionProfile.Version, requestURL)
+	}
+	res.Body.Close()
+	if res.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	msg := fmt.Sprintf("extension %s version %s not found at root %s", extensionProfile.Name, extensionProfile.Version, extensionProfile.RootURL)
+	if versions := getExtensionVersions(ctx, extensionProfile); len(versions) > 0 {
+		msg += fmt.Sprintf(", available versions are %s", strings.Join(versions, ", "))
+	}
+	return errors.New(msg)
+}
+
+// getExtensionVersions returns the versions linked from the directory listing of an extension,
+// or nil if the listing can't be fetched
+func getExtensionVersions(ctx context.Context, extensionProfile *api.ExtensionProfile) []string {
+	extensionsDir := extensionProfile.ExtensionsDir
+	if extensionsDir == "" {
+		extensionsDir = api.DefaultExtensionsDir
+	}
+	segments := append(strings.Split(extensionsDir, "/"), extensionProfile.Name)
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	listingURL := extensionProfile.RootURL + strings.Join(segments, "/") + "/"
+	if query := normalizeExtensionURLQuery(extensionProfile.URLQuery); query != "" {
+		listingURL += "?" + query
 	}
 
+	req, err := http.NewRequest(http.MethodGet, listingURL, nil)
+	if err != nil {
+		return nil
+	}
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil
+	}
 	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		return nil, errors.Wrapf(err, "Unable to GET extension resource for extension: %s with version %s  with filename %s at URL: %s", extensionName, version, fileName, requestURL)
+		return nil
+	}
+
+	var versions []string
+	for _, match := range extensionVersionLinkRegex.FindAllStringSubmatch(string(body), -1) {
+		if version, err := url.PathUnescape(match[1]); err == nil {
+			versions = append(versions, version)
+		}
+	}
+	return versions
+}
+
+// ValidateExtensionRootURLs returns an error if the root URL of an extension profile does not use
+// one of allowedSchemes
+func ValidateExtensionRootURLs(properties *api.Properties, allowedSchemes []string) error {
+	for _, extensionProfile := range properties.ExtensionProfiles {
+		if extensionProfile.RootURL == "" {
+			continue
+		}
+		rootURL, err := url.Parse(extensionProfile.RootURL)
+		if err != nil {
+			return errors.Wrapf(err, "invalid root URL %s for extension %s", extensionProfile.RootURL, extensionProfile.Name)
+		}
+		allowed := false
+		for _, scheme := range allowedSchemes {
+			if strings.EqualFold(rootURL.Scheme, scheme) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return errors.Errorf("root URL %s for extension %s uses the scheme %q, allowed schemes are %s", extensionProfile.RootURL, extensionProfile.Name, rootURL.Scheme, strings.Join(allowedSchemes, ", "))
+		}
+	}
+	return nil
+}
+
+func getExtensionURL(rootURL, extensionsDir, extensionName, version, fileName, query string) string {
+	if extensionsDir == "" {
+		extensionsDir = api.DefaultExtensionsDir
+	}
+	segments := append(strings.Split(extensionsDir, "/"), extensionName, version, fileName)
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
 	}
+	extensionURL := rootURL + strings.Join(segments, "/")
+	if query = normalizeExtensionURLQuery(query); query != "" {
+		extensionURL += "?" + query
+	}
+	return extensionURL
+}
 
-	return body, nil
+// normalizeExtensionURLQuery strips the leading "?" and the empty parameters of query and
+// percent-encodes its keys and values, see escapeURLQuery
+func normalizeExtensionURLQuery(query string) string {
+	var params []string
+	for _, param := range strings.Split(strings.TrimPrefix(query, "?"), "&") {
+		if param != "" {
+			params = append(params, param)
+		}
+	}
+	if len(params) == 0 {
+		return ""
+	}
+	return escapeURLQuery(strings.Join(params, "&"))
 }
 
-func getExtensionURL(rootURL, extensionName, version, fileName, query string) string {
-	extensionsDir := "extensions"
-	url := rootURL + extensionsDir + "/" + extensionName + "/" + version + "/" + fileName
-	if query != "" {
-		url += "?" + query
+// escapeURLQuery percent-encodes the keys and values of a raw query string, keeping the
+// order of its parameters. Already-encoded keys and values are not encoded twice
+func escapeURLQuery(query string) string {
+	params := strings.Split(query, "&")
+	for i, param := range params {
+		kv := strings.SplitN(param, "=", 2)
+		for j, s := range kv {
+			if unescaped, err := url.QueryUnescape(s); err == nil {
+				s = unescaped
+			}
+			kv[j] = url.QueryEscape(s)
+		}
+		params[i] = strings.Join(kv, "=")
 	}
-	return url
+	return strings.Join(params, "&")
 }
 
 func stringInSlice(a string, list []string) bool {
@@ -5,18 +5,31 @@ package engine
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
 	"path"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
 	"testing"
+	"text/template"
+	"time"
 
 	"github.com/Azure/aks-engine/pkg/api"
 	"github.com/Azure/aks-engine/pkg/api/common"
 	"github.com/Azure/aks-engine/pkg/api/vlabs"
 	"github.com/Azure/aks-engine/pkg/engine/transform"
+	"github.com/Azure/aks-engine/pkg/helpers"
 	"github.com/Azure/aks-engine/pkg/i18n"
 	"github.com/leonelquinteros/gotext"
 	"github.com/pkg/errors"
@@ -255,6 +268,106 @@ func TestGetStorageAccountType(t *testing.T) {
 	}
 }
 
+func TestSupportsPremiumStorage(t *testing.T) {
+	cases := []struct {
+		sizeName    string
+		expected    bool
+		expectError bool
+	}{
+		{sizeName: "Standard_D2_v2"},
+		{sizeName: "Standard_DS2_v2", expected: true},
+		{sizeName: "Standard_D2s_v3", expected: true},
+		{sizeName: "Standard_A2_v2"},
+		{sizeName: "Standard_F4"},
+		{sizeName: "Standard_F4s", expected: true},
+		{sizeName: "Standard_E8s_v3", expected: true},
+		{sizeName: "Standard_NC6"},
+		{sizeName: "Standard_NC6s_v3", expected: true},
+		{sizeName: "Standard_GS5", expected: true},
+		{sizeName: "D2v2", expectError: true},
+	}
+
+	for _, c := range cases {
+		premium, err := SupportsPremiumStorage(c.sizeName)
+		if c.expectError {
+			if err == nil {
+				t.Errorf("%s: expected an error", c.sizeName)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.sizeName, err)
+			continue
+		}
+		if premium != c.expected {
+			t.Errorf("%s: expected premium storage support %t, got %t", c.sizeName, c.expected, premium)
+		}
+	}
+}
+
+func TestGetAcceleratedNetworkingEnabled(t *testing.T) {
+	cases := []struct {
+		name        string
+		profile     *api.AgentPoolProfile
+		expected    bool
+		expectError bool
+	}{
+		{
+			name: "default off",
+			profile: &api.AgentPoolProfile{
+				Name:   "agentpool1",
+				VMSize: "Standard_D4_v2",
+			},
+			expected: false,
+		},
+		{
+			name: "enabled on supported size",
+			profile: &api.AgentPoolProfile{
+				Name:                         "agentpool1",
+				VMSize:                       "Standard_D4_v2",
+				AcceleratedNetworkingEnabled: helpers.PointerToBool(true),
+			},
+			expected: true,
+		},
+		{
+			name: "enabled on unsupported size",
+			profile: &api.AgentPoolProfile{
+				Name:                         "agentpool1",
+				VMSize:                       "Standard_A2",
+				AcceleratedNetworkingEnabled: helpers.PointerToBool(true),
+			},
+			expectError: true,
+		},
+		{
+			name: "windows pool uses the windows setting",
+			profile: &api.AgentPoolProfile{
+				Name:                                "agentpool1",
+				VMSize:                              "Standard_D4_v2",
+				OSType:                              api.Windows,
+				AcceleratedNetworkingEnabled:        helpers.PointerToBool(true),
+				AcceleratedNetworkingEnabledWindows: helpers.PointerToBool(false),
+			},
+			expected: false,
+		},
+	}
+
+	for _, c := range cases {
+		enabled, err := getAcceleratedNetworkingEnabled(c.profile)
+		if c.expectError {
+			if err == nil {
+				t.Errorf("%s: expected an error, got nil", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+		}
+		if enabled != c.expected {
+			t.Errorf("%s: expected %t, got %t", c.name, c.expected, enabled)
+		}
+	}
+}
+
 type TestARMTemplate struct {
 	Outputs map[string]OutputElement `json:"outputs"`
 	//Parameters *json.RawMessage `json:"parameters"`
@@ -546,3 +659,5092 @@ func TestGenerateKubeConfig(t *testing.T) {
 		t.Fatalf("Expected an error result from nil Properties child properties")
 	}
 }
+
+func TestResolveAPIServerEndpoint(t *testing.T) {
+	cases := []struct {
+		name        string
+		private     bool
+		masterCount int
+		firstIP     string
+		expected    string
+		expectError bool
+	}{
+		{
+			name:        "public single master",
+			masterCount: 1,
+			firstIP:     "10.240.255.5",
+			expected:    "mycluster.westus2.cloudapp.azure.com",
+		},
+		{
+			name:        "public multi master",
+			masterCount: 3,
+			firstIP:     "10.240.255.5",
+			expected:    "mycluster.westus2.cloudapp.azure.com",
+		},
+		{
+			name:        "private single master",
+			private:     true,
+			masterCount: 1,
+			firstIP:     "10.240.255.5",
+			expected:    "10.240.255.5",
+		},
+		{
+			name:        "private multi master",
+			private:     true,
+			masterCount: 3,
+			firstIP:     "10.240.255.5",
+			expected:    "10.240.255.15",
+		},
+		{
+			name:        "private multi master with invalid IP",
+			private:     true,
+			masterCount: 3,
+			firstIP:     "not-an-ip",
+			expectError: true,
+		},
+	}
+
+	for _, c := range cases {
+		properties := &api.Properties{
+			OrchestratorProfile: &api.OrchestratorProfile{
+				OrchestratorType: api.Kubernetes,
+				KubernetesConfig: &api.KubernetesConfig{
+					PrivateCluster: &api.PrivateCluster{
+						Enabled: helpers.PointerToBool(c.private),
+					},
+				},
+			},
+			MasterProfile: &api.MasterProfile{
+				Count:                    c.masterCount,
+				DNSPrefix:                "mycluster",
+				FirstConsecutiveStaticIP: c.firstIP,
+			},
+		}
+		endpoint, err := ResolveAPIServerEndpoint(properties, "westus2")
+		if c.expectError {
+			if err == nil {
+				t.Errorf("%s: expected an error, got endpoint %s", c.name, endpoint)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+		}
+		if endpoint != c.expected {
+			t.Errorf("%s: expected endpoint %s, got %s", c.name, c.expected, endpoint)
+		}
+	}
+
+	if _, err := ResolveAPIServerEndpoint(nil, "westus2"); err == nil {
+		t.Errorf("expected an error from nil Properties")
+	}
+	if _, err := ResolveAPIServerEndpoint(&api.Properties{}, "westus2"); err == nil {
+		t.Errorf("expected an error from nil MasterProfile")
+	}
+}
+
+func TestGetContainerAddonsStringDestination(t *testing.T) {
+	cs := api.CreateMockContainerService("testcluster", "1.11.6", 1, 2, false)
+	cs.Properties.OrchestratorProfile.KubernetesConfig.Addons = []api.KubernetesAddon{
+		{
+			Name:    DefaultTillerAddonName,
+			Enabled: helpers.PointerToBool(true),
+		},
+	}
+	cs.SetPropertiesDefaults(false, false)
+
+	addons, err := getContainerAddonsString(cs.Properties, "k8s/containeraddons", nil, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(addons, "- path: /etc/kubernetes/addons/kube-tiller-deployment.yaml") {
+		t.Fatalf("expected tiller addon at the default destination path, got: %s", addons)
+	}
+
+	for i := range cs.Properties.OrchestratorProfile.KubernetesConfig.Addons {
+		if cs.Properties.OrchestratorProfile.KubernetesConfig.Addons[i].Name == DefaultTillerAddonName {
+			cs.Properties.OrchestratorProfile.KubernetesConfig.Addons[i].Destination = "/opt/custom/addons/"
+		}
+	}
+	addons, err = getContainerAddonsString(cs.Properties, "k8s/containeraddons", nil, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(addons, "- path: /opt/custom/addons/kube-tiller-deployment.yaml") {
+		t.Fatalf("expected tiller addon at the custom destination path, got: %s", addons)
+	}
+	if !strings.Contains(addons, "- path: /etc/kubernetes/addons/kube-metrics-server-deployment.yaml") {
+		t.Fatalf("expected other addons to keep the default destination path, got: %s", addons)
+	}
+}
+
+func TestGetContainerAddonsStringCombined(t *testing.T) {
+	cs := api.CreateMockContainerService("testcluster", "1.11.6", 1, 2, false)
+	cs.Properties.OrchestratorProfile.KubernetesConfig.Addons = []api.KubernetesAddon{
+		{
+			Name:        DefaultTillerAddonName,
+			Enabled:     helpers.PointerToBool(true),
+			Destination: "/opt/custom/addons",
+		},
+		{
+			Name:    DefaultClusterAutoscalerAddonName,
+			Enabled: helpers.PointerToBool(true),
+		},
+	}
+	cs.SetPropertiesDefaults(false, false)
+
+	// decodeAddonFiles returns the paths of the addon files in order and their decoded contents
+	decodeAddonFiles := func(addons string) ([]string, map[string]string) {
+		var paths []string
+		contents := map[string]string{}
+		for _, entry := range strings.Split(addons, "- path: ")[1:] {
+			path := entry[:strings.Index(entry, "\\n")]
+			encoded := entry[strings.Index(entry, "content: !!binary |\\n    ")+len("content: !!binary |\\n    "):]
+			encoded = encoded[:strings.Index(encoded, "\\n")]
+			decoded, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				t.Fatalf("expected valid base64 for %s, got %v", path, err)
+			}
+			reader, err := gzip.NewReader(bytes.NewReader(decoded))
+			if err != nil {
+				t.Fatalf("expected a gzip stream for %s, got %v", path, err)
+			}
+			content, err := ioutil.ReadAll(reader)
+			if err != nil {
+				t.Fatalf("unexpected error decompressing %s: %v", path, err)
+			}
+			paths = append(paths, path)
+			contents[path] = string(content)
+		}
+		return paths, contents
+	}
+
+	perFile, err := getContainerAddonsString(cs.Properties, "k8s/containeraddons", nil, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	combined, err := getContainerAddonsString(cs.Properties, "k8s/containeraddons", nil, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	perFilePaths, perFileContents := decodeAddonFiles(perFile)
+	combinedPaths, combinedContents := decodeAddonFiles(combined)
+
+	combinedPath := "/etc/kubernetes/addons/" + CombinedAddonsManifestFile
+	tillerPath := "/opt/custom/addons/kube-tiller-deployment.yaml"
+	var keptPaths, manifests []string
+	for _, path := range perFilePaths {
+		if path == tillerPath || provisionedAddonFiles[filepath.Base(path)] {
+			keptPaths = append(keptPaths, path)
+			continue
+		}
+		manifests = append(manifests, strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(perFileContents[path]), "---")))
+	}
+	if len(keptPaths) < 2 {
+		t.Fatalf("expected the addon with its own destination and the provisioned addons, got %v", perFilePaths)
+	}
+	if !reflect.DeepEqual(combinedPaths, append(keptPaths, combinedPath)) {
+		t.Fatalf("expected the addons keeping their file and the combined manifest, got %v", combinedPaths)
+	}
+	for _, path := range keptPaths {
+		if combinedContents[path] != perFileContents[path] {
+			t.Errorf("expected the addon file %s to be unchanged", path)
+		}
+	}
+
+	if len(manifests) < 2 {
+		t.Fatalf("expected several addons at the default destination, got %v", perFilePaths)
+	}
+	documents := strings.Split(strings.TrimSuffix(combinedContents[combinedPath], "\n"), "\n---\n")
+	if len(documents) < len(manifests) {
+		t.Fatalf("expected at least %d documents in the combined manifest, got %d", len(manifests), len(documents))
+	}
+	if expected := strings.Join(manifests, "\n---\n") + "\n"; combinedContents[combinedPath] != expected {
+		t.Errorf("expected the combined manifest to join the per-file manifests in order")
+	}
+}
+
+func TestGetMasterCustomDataCombinedAddons(t *testing.T) {
+	cs := api.CreateMockContainerService("testcluster", "1.11.6", 1, 2, false)
+	cs.Properties.OrchestratorProfile.KubernetesConfig.NetworkPolicy = NetworkPolicyCalico
+	cs.Properties.OrchestratorProfile.KubernetesConfig.Addons = []api.KubernetesAddon{
+		{
+			Name:    DefaultClusterAutoscalerAddonName,
+			Enabled: helpers.PointerToBool(true),
+		},
+	}
+	cs.SetPropertiesDefaults(false, false)
+
+	templateGenerator, err := InitializeTemplateGenerator(Context{
+		Translator:            &i18n.Translator{},
+		CombineAddonManifests: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to initialize template generator: %v", err)
+	}
+	customData := templateGenerator.getMasterCustomData(cs, kubernetesMasterCustomDataYaml, cs.Properties)
+
+	if !strings.Contains(customData, "- path: /etc/kubernetes/addons/"+CombinedAddonsManifestFile) {
+		t.Fatalf("expected the master custom data to write the combined addon manifest")
+	}
+	// every addon file the provisioning scripts edit in place must still be written on its own
+	edited := regexp.MustCompile(`/etc/kubernetes/addons/[a-z0-9-]+\.yaml`).FindAllString(customData, -1)
+	if len(edited) == 0 {
+		t.Fatalf("expected the master custom data to edit addon files")
+	}
+	for _, file := range edited {
+		if !strings.Contains(customData, "- path: "+file) {
+			t.Errorf("expected the master custom data to write %s, which the provisioning scripts edit", file)
+		}
+	}
+}
+
+// failingWriter accepts the given number of writes and fails every write after that
+type failingWriter struct {
+	allowedWrites int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.allowedWrites <= 0 {
+		return 0, errors.New("simulated write failure")
+	}
+	w.allowedWrites--
+	return len(p), nil
+}
+
+func TestWriteGzip(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeGzip(&buf, "#!/bin/bash\necho hello\n"); err != nil {
+		t.Fatalf("unexpected error writing gzip stream: %v", err)
+	}
+	if buf.Len() == 0 {
+		t.Fatalf("expected a non-empty gzip stream")
+	}
+
+	// the gzip header is written on the first Write, so failing every write fails Write
+	if err := writeGzip(&failingWriter{}, "#!/bin/bash\necho hello\n"); err == nil {
+		t.Fatalf("expected an error when the underlying writer fails on Write")
+	}
+
+	// allowing the header through moves the failure to the flush in Close
+	if err := writeGzip(&failingWriter{allowedWrites: 1}, "#!/bin/bash\necho hello\n"); err == nil {
+		t.Fatalf("expected an error when the underlying writer fails on Close")
+	}
+}
+
+func TestGetBase64CustomScriptFromStr(t *testing.T) {
+	b64Str, err := getBase64CustomScriptFromStr("test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := base64.StdEncoding.DecodeString(b64Str); err != nil {
+		t.Fatalf("expected valid base64 output, got %s: %v", b64Str, err)
+	}
+}
+
+func TestGetAgentPoolDataStorageAccountPrefixSeed(t *testing.T) {
+	properties := &api.Properties{
+		AgentPoolProfiles: []*api.AgentPoolProfile{
+			{Name: "agentpool1", StorageProfile: api.StorageAccount, DiskSizesGB: []int{128}},
+			{Name: "agentpool2", StorageProfile: api.StorageAccount, DiskSizesGB: []int{128, 256}},
+			{Name: "agentpool3", StorageProfile: api.StorageAccount, Count: 50},
+		},
+	}
+
+	cases := []struct {
+		name         string
+		pool         *api.AgentPoolProfile
+		expectedSeed int
+		expectError  bool
+	}{
+		{
+			name:         "first pool",
+			pool:         properties.AgentPoolProfiles[0],
+			expectedSeed: 97,
+		},
+		{
+			name:         "second pool",
+			pool:         properties.AgentPoolProfiles[1],
+			expectedSeed: 102,
+		},
+		{
+			name:         "third pool",
+			pool:         properties.AgentPoolProfiles[2],
+			expectedSeed: 107,
+		},
+		{
+			name:        "pool of another cluster",
+			pool:        &api.AgentPoolProfile{Name: "agentpool1"},
+			expectError: true,
+		},
+	}
+
+	for _, c := range cases {
+		seed, err := GetAgentPoolDataStorageAccountPrefixSeed(properties, c.pool)
+		if c.expectError {
+			if err == nil {
+				t.Errorf("%s: expected an error", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.name, err)
+		}
+		if seed != c.expectedSeed {
+			t.Errorf("%s: expected seed %d, got %d", c.name, c.expectedSeed, seed)
+		}
+		// the seed is stable for a given pool
+		if again, _ := GetAgentPoolDataStorageAccountPrefixSeed(properties, c.pool); again != seed {
+			t.Errorf("%s: expected the seed to be stable, got %d then %d", c.name, seed, again)
+		}
+	}
+}
+
+func TestGetDataDisksMixedStorageTiers(t *testing.T) {
+	profile := &api.AgentPoolProfile{
+		Name:                    "agentpool1",
+		VMSize:                  "Standard_DS2_v2",
+		StorageProfile:          api.ManagedDisks,
+		DiskSizesGB:             []int{128, 1024, 256},
+		DiskStorageAccountTypes: []string{"Premium_LRS", "Standard_LRS"},
+	}
+	dataDisks, err := getDataDisks(profile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := `"dataDisks": [
+            {
+              "diskSizeGB": "128",
+              "lun": 0,
+              "createOption": "Empty",
+              "managedDisk": {
+                "storageAccountType": "Premium_LRS"
+              }
+            },
+            {
+              "diskSizeGB": "1024",
+              "lun": 1,
+              "createOption": "Empty",
+              "managedDisk": {
+                "storageAccountType": "Standard_LRS"
+              }
+            },
+            {
+              "diskSizeGB": "256",
+              "lun": 2,
+              "createOption": "Empty",
+              "managedDisk": {
+                "storageAccountType": "Premium_LRS"
+              }
+            }
+          ],`
+	if dataDisks != expected {
+		t.Fatalf("unexpected data disks output, expected:\n%s\ngot:\n%s", expected, dataDisks)
+	}
+
+	profile.DiskStorageAccountTypes = []string{"Premium_LRS", "Fast_LRS"}
+	if _, err = getDataDisks(profile); err == nil {
+		t.Fatalf("expected an error for an unsupported storage account type")
+	}
+
+	profile.DiskStorageAccountTypes = []string{"Premium_LRS", "Standard_LRS", "Standard_LRS", "Standard_LRS"}
+	if _, err = getDataDisks(profile); err == nil {
+		t.Fatalf("expected an error for more storage account types than data disks")
+	}
+
+	profile.StorageProfile = api.StorageAccount
+	profile.DiskStorageAccountTypes = []string{"Premium_LRS"}
+	if _, err = getDataDisks(profile); err == nil {
+		t.Fatalf("expected an error for storage account types on a StorageAccount pool")
+	}
+}
+
+func TestGetPlannedSecurityRules(t *testing.T) {
+	ports := []int{80, 443, 8080}
+	planned, err := GetPlannedSecurityRules(ports)
+	if err != nil {
+		t.Fatalf("unexpected error planning security rules: %v", err)
+	}
+	if len(planned) != len(ports) {
+		t.Fatalf("expected %d planned rules, got %d", len(ports), len(planned))
+	}
+
+	var emitted []struct {
+		Name       string `json:"name"`
+		Properties struct {
+			Access               string `json:"access"`
+			DestinationPortRange string `json:"destinationPortRange"`
+			Priority             int    `json:"priority"`
+			SourceAddressPrefix  string `json:"sourceAddressPrefix"`
+		} `json:"properties"`
+	}
+	rules, err := getSecurityRules(ports)
+	if err != nil {
+		t.Fatalf("unexpected error getting security rules: %v", err)
+	}
+	if err := json.Unmarshal([]byte("["+rules+"]"), &emitted); err != nil {
+		t.Fatalf("couldn't unmarshal emitted security rules: %v", err)
+	}
+	if len(emitted) != len(planned) {
+		t.Fatalf("expected %d emitted rules, got %d", len(planned), len(emitted))
+	}
+
+	for i, rule := range planned {
+		if rule.Port != ports[i] {
+			t.Errorf("expected planned rule %d to be for port %d, got %d", i, ports[i], rule.Port)
+		}
+		if emitted[i].Name != rule.Name {
+			t.Errorf("expected emitted rule name %s, got %s", rule.Name, emitted[i].Name)
+		}
+		if emitted[i].Properties.Access != rule.Access {
+			t.Errorf("expected emitted rule access %s, got %s", rule.Access, emitted[i].Properties.Access)
+		}
+		if emitted[i].Properties.DestinationPortRange != strconv.Itoa(rule.Port) {
+			t.Errorf("expected emitted rule port %d, got %s", rule.Port, emitted[i].Properties.DestinationPortRange)
+		}
+		if emitted[i].Properties.Priority != rule.Priority {
+			t.Errorf("expected emitted rule priority %d, got %d", rule.Priority, emitted[i].Properties.Priority)
+		}
+		if emitted[i].Properties.SourceAddressPrefix != rule.Source {
+			t.Errorf("expected emitted rule source %s, got %s", rule.Source, emitted[i].Properties.SourceAddressPrefix)
+		}
+	}
+
+	tooManyPorts := make([]int, MaxSecurityRulePriority)
+	if _, err := GetPlannedSecurityRules(tooManyPorts); err == nil {
+		t.Errorf("expected an error planning %d security rules", len(tooManyPorts))
+	}
+	if _, err := getSecurityRules(tooManyPorts); err == nil {
+		t.Errorf("expected an error getting %d security rules", len(tooManyPorts))
+	}
+}
+
+func TestGetLoadBalancerRulesWithHTTPProbe(t *testing.T) {
+	rules := []LoadBalancerRule{
+		{Port: 80, ProbeProtocol: "http", ProbePath: "/healthz"},
+		{Port: 443},
+	}
+	lbRules, err := getLoadBalancerRules("agentpool1", rules)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	probes, err := getLoadBalancerProbes(rules)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var emittedRules []struct {
+		Properties struct {
+			Probe struct {
+				ID string `json:"id"`
+			} `json:"probe"`
+			Protocol string `json:"protocol"`
+		} `json:"properties"`
+	}
+	if err = json.Unmarshal([]byte("["+lbRules+"]"), &emittedRules); err != nil {
+		t.Fatalf("couldn't unmarshal emitted LB rules: %v", err)
+	}
+	var emittedProbes []struct {
+		Name       string `json:"name"`
+		Properties struct {
+			Protocol    string `json:"protocol"`
+			RequestPath string `json:"requestPath"`
+		} `json:"properties"`
+	}
+	if err = json.Unmarshal([]byte("["+probes+"]"), &emittedProbes); err != nil {
+		t.Fatalf("couldn't unmarshal emitted probes: %v", err)
+	}
+
+	if emittedRules[0].Properties.Protocol != "tcp" {
+		t.Errorf("expected the rule protocol to remain tcp, got %s", emittedRules[0].Properties.Protocol)
+	}
+	if !strings.HasSuffix(emittedRules[0].Properties.Probe.ID, "/probes/http80Probe')]") {
+		t.Errorf("expected the rule to reference the http probe, got %s", emittedRules[0].Properties.Probe.ID)
+	}
+	if emittedProbes[0].Name != "http80Probe" || emittedProbes[0].Properties.Protocol != "http" || emittedProbes[0].Properties.RequestPath != "/healthz" {
+		t.Errorf("unexpected http probe: %+v", emittedProbes[0])
+	}
+	if !strings.HasSuffix(emittedRules[1].Properties.Probe.ID, "/probes/tcp443Probe')]") {
+		t.Errorf("expected the default rule to reference a tcp probe, got %s", emittedRules[1].Properties.Probe.ID)
+	}
+	if emittedProbes[1].Name != "tcp443Probe" || emittedProbes[1].Properties.RequestPath != "" {
+		t.Errorf("unexpected tcp probe: %+v", emittedProbes[1])
+	}
+
+	// the port-only helpers are unchanged
+	if getLBRule("agentpool1", 443) != getLoadBalancerRule("agentpool1", rules[1]) {
+		t.Errorf("expected getLBRule to match the default rule spec")
+	}
+	if getProbe(443) != getLoadBalancerProbe(rules[1]) {
+		t.Errorf("expected getProbe to match the default rule spec")
+	}
+
+	if _, err = getLoadBalancerRules("agentpool1", []LoadBalancerRule{{Port: 80, ProbeProtocol: "icmp"}}); err == nil {
+		t.Errorf("expected an error for an unsupported probe protocol")
+	}
+	if _, err = getLoadBalancerProbes([]LoadBalancerRule{{Port: 80, ProbePath: "/healthz"}}); err == nil {
+		t.Errorf("expected an error for a probe path on a tcp probe")
+	}
+}
+
+func TestGetKubernetesSubnets(t *testing.T) {
+	properties := &api.Properties{
+		MasterProfile: &api.MasterProfile{
+			Count: 1,
+		},
+		AgentPoolProfiles: []*api.AgentPoolProfile{
+			{
+				Name:   "linuxpool",
+				Count:  2,
+				OSType: api.Linux,
+			},
+			{
+				Name:   "windowspool",
+				Count:  2,
+				OSType: api.Windows,
+			},
+		},
+	}
+
+	getSubnetNames := func(subnets string) []string {
+		var emitted []struct {
+			Name       string `json:"name"`
+			Properties struct {
+				AddressPrefix string `json:"addressPrefix"`
+			} `json:"properties"`
+		}
+		if err := json.Unmarshal([]byte("["+strings.TrimPrefix(subnets, ",\n")+"]"), &emitted); err != nil {
+			t.Fatalf("couldn't unmarshal emitted subnets: %v", err)
+		}
+		var names []string
+		for _, subnet := range emitted {
+			names = append(names, fmt.Sprintf("%s=%s", subnet.Name, subnet.Properties.AddressPrefix))
+		}
+		return names
+	}
+
+	subnets, err := getKubernetesSubnets(properties, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	windowsOnly := getSubnetNames(subnets)
+	expectedWindowsOnly := []string{"podCIDR4=10.244.4.0/24", "podCIDR5=10.244.5.0/24"}
+	if strings.Join(windowsOnly, " ") != strings.Join(expectedWindowsOnly, " ") {
+		t.Errorf("expected Windows-only subnets %v, got %v", expectedWindowsOnly, windowsOnly)
+	}
+
+	subnets, err = getKubernetesSubnets(properties, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	allNodes := getSubnetNames(subnets)
+	expectedAllNodes := []string{"podCIDR2=10.244.2.0/24", "podCIDR3=10.244.3.0/24", "podCIDR4=10.244.4.0/24", "podCIDR5=10.244.5.0/24"}
+	if strings.Join(allNodes, " ") != strings.Join(expectedAllNodes, " ") {
+		t.Errorf("expected all-node subnets %v, got %v", expectedAllNodes, allNodes)
+	}
+}
+
+func TestGetKubernetesNodePodCIDRs(t *testing.T) {
+	properties := &api.Properties{
+		MasterProfile: &api.MasterProfile{
+			Count: 1,
+		},
+		AgentPoolProfiles: []*api.AgentPoolProfile{
+			{
+				Name:   "windowspool",
+				Count:  1,
+				OSType: api.Windows,
+			},
+			{
+				Name:   "linuxpool",
+				Count:  2,
+				OSType: api.Linux,
+			},
+		},
+	}
+
+	for _, includeLinuxNodes := range []bool{false, true} {
+		subnets, err := getKubernetesSubnets(properties, includeLinuxNodes)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var emitted []struct {
+			Properties struct {
+				AddressPrefix string `json:"addressPrefix"`
+			} `json:"properties"`
+		}
+		if err = json.Unmarshal([]byte("["+strings.TrimPrefix(subnets, ",\n")+"]"), &emitted); err != nil {
+			t.Fatalf("couldn't unmarshal emitted subnets: %v", err)
+		}
+		emittedPrefixes := map[string]bool{}
+		for _, subnet := range emitted {
+			emittedPrefixes[subnet.Properties.AddressPrefix] = true
+		}
+
+		podCIDRs := GetKubernetesNodePodCIDRs(properties, includeLinuxNodes)
+		if len(podCIDRs) != len(emitted) {
+			t.Errorf("includeLinuxNodes %t: expected %d node pod CIDRs, got %v", includeLinuxNodes, len(emitted), podCIDRs)
+		}
+		for node, podCIDR := range podCIDRs {
+			if !emittedPrefixes[podCIDR] {
+				t.Errorf("includeLinuxNodes %t: pod CIDR %s of node %s has no emitted subnet", includeLinuxNodes, podCIDR, node)
+			}
+		}
+	}
+
+	expected := map[string]string{
+		"linuxpool-0":   "10.244.2.0/24",
+		"linuxpool-1":   "10.244.3.0/24",
+		"windowspool-0": "10.244.4.0/24",
+	}
+	podCIDRs := GetKubernetesNodePodCIDRs(properties, true)
+	for node, podCIDR := range expected {
+		if podCIDRs[node] != podCIDR {
+			t.Errorf("expected node %s to get pod CIDR %s, got %s", node, podCIDR, podCIDRs[node])
+		}
+	}
+}
+
+func TestValidateFQDNPrefix(t *testing.T) {
+	validPrefixes := []string{"mycluster", "my-cluster-01", "abc"}
+	for _, prefix := range validPrefixes {
+		if err := ValidateFQDNPrefix(prefix, "westus2"); err != nil {
+			t.Errorf("expected DNS prefix %s to be valid, got error: %v", prefix, err)
+		}
+	}
+
+	invalidPrefixes := []string{
+		"",
+		"ab",
+		"-mycluster",
+		"mycluster-",
+		"1mycluster",
+		"my_cluster",
+		"my.cluster",
+		strings.Repeat("a", 46),
+	}
+	for _, prefix := range invalidPrefixes {
+		if err := ValidateFQDNPrefix(prefix, "westus2"); err == nil {
+			t.Errorf("expected DNS prefix %q to be invalid", prefix)
+		}
+	}
+
+	cs := api.CreateMockContainerService("testcluster", "1.11.6", 1, 2, true)
+	cs.Properties.MasterProfile.DNSPrefix = "-invalid"
+	if _, err := GenerateKubeConfig(cs.Properties, "westus2"); err == nil {
+		t.Errorf("expected GenerateKubeConfig to reject an invalid DNS prefix")
+	}
+}
+
+func TestGetDataDisksZonalPool(t *testing.T) {
+	regional := &api.AgentPoolProfile{
+		Name:                "agentpool1",
+		VMSize:              "Standard_DS2_v2",
+		AvailabilityProfile: api.VirtualMachineScaleSets,
+		StorageProfile:      api.ManagedDisks,
+		DiskSizesGB:         []int{128, 256},
+	}
+	zonal := *regional
+	zonal.AvailabilityZones = []string{"1", "2"}
+
+	regionalDisks, err := getDataDisks(regional)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	zonalDisks, err := getDataDisks(&zonal)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// the scale set places each instance's managed disks in the instance's zone
+	if zonalDisks != regionalDisks {
+		t.Fatalf("expected zonal managed data disks to match the regional output, expected:\n%s\ngot:\n%s", regionalDisks, zonalDisks)
+	}
+
+	zonal.StorageProfile = api.StorageAccount
+	if _, err = getDataDisks(&zonal); err == nil {
+		t.Fatalf("expected an error for unmanaged data disks in a zonal pool")
+	}
+}
+
+func TestGetLinkedTemplateForExtension(t *testing.T) {
+	server := httptest.NewServer(http.FileServer(http.Dir("../..")))
+	defer server.Close()
+
+	properties := &api.Properties{
+		OrchestratorProfile: &api.OrchestratorProfile{
+			OrchestratorType: api.Kubernetes,
+		},
+		MasterProfile: &api.MasterProfile{
+			Count: 1,
+		},
+		AgentPoolProfiles: []*api.AgentPoolProfile{
+			{
+				Name:                "agentpool1",
+				AvailabilityProfile: api.AvailabilitySet,
+				Extensions:          []api.Extension{{Name: "hello-world-k8s"}},
+			},
+			{
+				Name:                "agentpool2",
+				AvailabilityProfile: api.AvailabilitySet,
+			},
+			{
+				Name:                "agentpool3",
+				AvailabilityProfile: api.VirtualMachineScaleSets,
+				Extensions:          []api.Extension{{Name: "hello-world-k8s"}},
+			},
+		},
+		ExtensionProfiles: []*api.ExtensionProfile{
+			{
+				Name:    "hello-world-k8s",
+				Version: "v1",
+				RootURL: server.URL + "/",
+			},
+			{
+				Name:    "winrm",
+				Version: "v1",
+				RootURL: server.URL + "/",
+			},
+		},
+	}
+
+	dta, err := GetLinkedTemplateForExtension(context.Background(), properties, "hello-world-k8s")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(dta, "variables('agentpool1VMNamePrefix')") {
+		t.Fatalf("expected the linked template to target agentpool1, got:\n%s", dta)
+	}
+	if !strings.Contains(dta, `"count": "[variables('agentpool3Count')]"`) {
+		t.Fatalf("expected the linked template to loop over agentpool3, got:\n%s", dta)
+	}
+	if strings.Contains(dta, "agentpool2") || strings.Contains(dta, "masterVMNamePrefix") {
+		t.Fatalf("expected the linked template to target only agentpool1 and agentpool3, got:\n%s", dta)
+	}
+
+	if _, err = GetLinkedTemplateForExtension(context.Background(), properties, "winrm"); err == nil {
+		t.Fatalf("expected an error for an extension no profile opted in to")
+	}
+	if _, err = GetLinkedTemplateForExtension(context.Background(), properties, "absent"); err == nil {
+		t.Fatalf("expected an error for an undefined extension")
+	}
+}
+
+func TestMakeExtensionScriptCommandsRetries(t *testing.T) {
+	scriptFilePath := "/opt/azure/containers/extensions/hello-world-k8s/hello.sh"
+	chmod := "sudo /bin/chmod 744 " + scriptFilePath
+	execute := "sudo " + scriptFilePath + " ',parameters('hello-world-k8sParameters'),' > /var/log/hello-world-k8s-output.log"
+
+	cases := []struct {
+		name          string
+		scriptRetries int
+		expected      []string
+	}{
+		{
+			name:     "no retries",
+			expected: []string{"- " + chmod + " \n", "- " + execute},
+		},
+		{
+			name:          "retries",
+			scriptRetries: 3,
+			expected: []string{
+				"- (for i in $(seq 1 4); do " + chmod + " && exit 0; status=$?; [ $i -eq 4 ] && exit $status; sleep 10; done) \n",
+				"- (for i in $(seq 1 4); do " + execute + " && exit 0; status=$?; [ $i -eq 4 ] && exit $status; sleep 10; done)",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		extensionProfile := &api.ExtensionProfile{
+			Name:          "hello-world-k8s",
+			Version:       "v1",
+			RootURL:       "https://raw.githubusercontent.com/Azure/aks-engine/master/",
+			Script:        "hello.sh",
+			ScriptRetries: c.scriptRetries,
+		}
+		commands := makeExtensionScriptCommands(&api.Extension{Name: "hello-world-k8s"}, []*api.ExtensionProfile{extensionProfile}, "',copyIndex(),'")
+		inlineCommands := makeInlineExtensionScriptCommands(extensionProfile, []byte("#!/bin/bash\necho hello\n"))
+		for _, expected := range c.expected {
+			if !strings.Contains(commands, expected) {
+				t.Errorf("%s: expected the commands to contain %q, got:\n%s", c.name, expected, commands)
+			}
+			if !strings.Contains(inlineCommands, expected) {
+				t.Errorf("%s: expected the inline commands to contain %q, got:\n%s", c.name, expected, inlineCommands)
+			}
+		}
+		// the download already retries through curl
+		if !strings.HasPrefix(commands, "- sudo /usr/bin/curl --retry 5 ") {
+			t.Errorf("%s: expected the commands to start with the download, got:\n%s", c.name, commands)
+		}
+		if c.scriptRetries == 0 && strings.Contains(commands+inlineCommands, "for i in") {
+			t.Errorf("%s: expected no retry loop", c.name)
+		}
+	}
+}
+
+func TestRetryExtensionScriptCommandExitStatus(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not available")
+	}
+
+	cases := []struct {
+		name             string
+		succeedOnAttempt int
+		retries          int
+		expectedAttempts int
+		expectedStatus   int
+	}{
+		{
+			name:             "succeeds on the first attempt",
+			succeedOnAttempt: 1,
+			retries:          2,
+			expectedAttempts: 1,
+		},
+		{
+			name:             "succeeds on a retry",
+			succeedOnAttempt: 2,
+			retries:          2,
+			expectedAttempts: 2,
+		},
+		{
+			name:             "never succeeds",
+			retries:          2,
+			expectedAttempts: 3,
+			expectedStatus:   3,
+		},
+		{
+			name:             "never succeeds without retries",
+			expectedAttempts: 1,
+			expectedStatus:   3,
+		},
+	}
+
+	for _, c := range cases {
+		dir, err := ioutil.TempDir("", "retry")
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.name, err)
+		}
+		attempts := filepath.Join(dir, "attempts")
+		succeed := fmt.Sprintf("[ $(wc -l < %s) -eq %d ]", attempts, c.succeedOnAttempt)
+		if c.succeedOnAttempt == 0 {
+			succeed = "false"
+		}
+		// the attempt fails with status 3 until the expected attempt
+		command := fmt.Sprintf("{ echo attempt >> %s; %s || (exit 3); }", attempts, succeed)
+		script := retryExtensionScriptCommandWithDelay(command, c.retries, 0)
+		err = exec.Command("sh", "-c", script).Run()
+		status := 0
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			status = exitErr.ExitCode()
+		} else if err != nil {
+			t.Fatalf("%s: unexpected error running %q: %v", c.name, script, err)
+		}
+		if status != c.expectedStatus {
+			t.Errorf("%s: expected exit status %d, got %d running %q", c.name, c.expectedStatus, status, script)
+		}
+		b, _ := ioutil.ReadFile(attempts)
+		if n := strings.Count(string(b), "attempt"); n != c.expectedAttempts {
+			t.Errorf("%s: expected %d attempts, got %d", c.name, c.expectedAttempts, n)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestGetExtensionURL(t *testing.T) {
+	cases := []struct {
+		name          string
+		extensionsDir string
+		extensionName string
+		version       string
+		query         string
+		expected      string
+	}{
+		{
+			name:     "default directory",
+			expected: "https://example.com/extensions/hello-world-k8s/v1/template-link.json",
+		},
+		{
+			name:          "custom directory",
+			extensionsDir: "mirror/ext",
+			query:         "sv=1",
+			expected:      "https://example.com/mirror/ext/hello-world-k8s/v1/template-link.json?sv=1",
+		},
+		{
+			name:          "segments requiring encoding",
+			extensionName: "hello world#1",
+			version:       "v1?beta",
+			expected:      "https://example.com/extensions/hello%20world%231/v1%3Fbeta/template-link.json",
+		},
+		{
+			name:     "query requiring encoding",
+			query:    "sp=r&se=2019-01-01T00:00:00Z&sig=a%2Bb/c d",
+			expected: "https://example.com/extensions/hello-world-k8s/v1/template-link.json?sp=r&se=2019-01-01T00%3A00%3A00Z&sig=a%2Bb%2Fc+d",
+		},
+		{
+			name:     "query with a leading question mark",
+			query:    "?sv=1&sp=r",
+			expected: "https://example.com/extensions/hello-world-k8s/v1/template-link.json?sv=1&sp=r",
+		},
+		{
+			name:     "query with empty parameters",
+			query:    "sv=1&&sp=r&",
+			expected: "https://example.com/extensions/hello-world-k8s/v1/template-link.json?sv=1&sp=r",
+		},
+		{
+			name:     "query of only a question mark",
+			query:    "?",
+			expected: "https://example.com/extensions/hello-world-k8s/v1/template-link.json",
+		},
+	}
+
+	for _, c := range cases {
+		if c.extensionName == "" {
+			c.extensionName = "hello-world-k8s"
+		}
+		if c.version == "" {
+			c.version = "v1"
+		}
+		url := getExtensionURL("https://example.com/", c.extensionsDir, c.extensionName, c.version, "template-link.json", c.query)
+		if url != c.expected {
+			t.Errorf("%s: expected %s, got %s", c.name, c.expected, url)
+		}
+	}
+}
+
+func TestGetLinkedTemplateTextForURLCustomExtensionsDir(t *testing.T) {
+	// serve the repository root so "extensions" is only reachable as "mirror/extensions"
+	mux := http.NewServeMux()
+	mux.Handle("/mirror/", http.StripPrefix("/mirror/", http.FileServer(http.Dir("../.."))))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	if _, err := getLinkedTemplateTextForURL(context.Background(), server.URL+"/", "", api.Kubernetes, "hello-world-k8s", "v1", ""); err == nil {
+		t.Fatalf("expected an error fetching from the default extensions directory")
+	}
+	dta, err := getLinkedTemplateTextForURL(context.Background(), server.URL+"/", "mirror/extensions", api.Kubernetes, "hello-world-k8s", "v1", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(dta, "EXTENSION_TARGET_VM_NAME_PREFIX") {
+		t.Fatalf("expected the template-link.json contents, got:\n%s", dta)
+	}
+}
+
+func TestOrchestratorSupportsExtensionRetries(t *testing.T) {
+	cases := []struct {
+		name             string
+		failures         int
+		failureStatus    int
+		slowAttempts     int
+		policy           ExtensionFetchPolicy
+		expectSupported  bool
+		expectedRequests int
+	}{
+		{
+			name:             "no retries by default",
+			failures:         1,
+			failureStatus:    http.StatusServiceUnavailable,
+			expectedRequests: 1,
+		},
+		{
+			name:             "transient failures retried",
+			failures:         2,
+			failureStatus:    http.StatusServiceUnavailable,
+			policy:           ExtensionFetchPolicy{Retries: 2, Backoff: time.Millisecond},
+			expectSupported:  true,
+			expectedRequests: 3,
+		},
+		{
+			name:             "throttling retried",
+			failures:         1,
+			failureStatus:    http.StatusTooManyRequests,
+			policy:           ExtensionFetchPolicy{Retries: 1, Backoff: time.Millisecond},
+			expectSupported:  true,
+			expectedRequests: 2,
+		},
+		{
+			name:             "retries exhausted",
+			failures:         3,
+			failureStatus:    http.StatusInternalServerError,
+			policy:           ExtensionFetchPolicy{Retries: 2, Backoff: time.Millisecond},
+			expectedRequests: 3,
+		},
+		{
+			name:             "not found is not retried",
+			failures:         1,
+			failureStatus:    http.StatusNotFound,
+			policy:           ExtensionFetchPolicy{Retries: 2, Backoff: time.Millisecond},
+			expectedRequests: 1,
+		},
+		{
+			name:             "slow attempt timed out and retried",
+			slowAttempts:     1,
+			policy:           ExtensionFetchPolicy{Retries: 1, Backoff: time.Millisecond, Timeout: 50 * time.Millisecond},
+			expectSupported:  true,
+			expectedRequests: 2,
+		},
+	}
+
+	for _, c := range cases {
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			if requests <= c.slowAttempts {
+				select {
+				case <-r.Context().Done():
+				case <-time.After(5 * time.Second):
+				}
+				return
+			}
+			if requests <= c.failures {
+				w.WriteHeader(c.failureStatus)
+				return
+			}
+			w.Write([]byte(`["Kubernetes"]`))
+		}))
+
+		ctx := withExtensionFetchPolicy(context.Background(), c.policy)
+		supported, err := orchestratorSupportsExtension(ctx, server.URL+"/", "", api.Kubernetes, "hello-world-k8s", "v1", "")
+		server.Close()
+		if supported != c.expectSupported {
+			t.Errorf("%s: expected supported to be %t, got %t with error %v", c.name, c.expectSupported, supported, err)
+		}
+		if requests != c.expectedRequests {
+			t.Errorf("%s: expected %d requests, got %d", c.name, c.expectedRequests, requests)
+		}
+	}
+}
+
+func TestGenerateTemplateWithContextCancelled(t *testing.T) {
+	// the extension server never answers, only the context can end the request
+	unblock := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-unblock:
+		}
+	}))
+	defer server.Close()
+	defer close(unblock)
+
+	apiloader := &api.Apiloader{
+		Translator: &i18n.Translator{},
+	}
+	containerService, _, err := apiloader.LoadContainerServiceFromFile("./testdata/extensions/kubernetes.json", true, false, nil)
+	if err != nil {
+		t.Fatalf("Failed to load container service from file: %v", err)
+	}
+	containerService.SetPropertiesDefaults(false, false)
+	for _, extensionProfile := range containerService.Properties.ExtensionProfiles {
+		extensionProfile.RootURL = server.URL + "/"
+	}
+
+	templateGenerator, err := InitializeTemplateGenerator(Context{Translator: &i18n.Translator{}})
+	if err != nil {
+		t.Fatalf("Failed to initialize template generator: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, _, err = templateGenerator.GenerateTemplateWithContext(ctx, containerService, DefaultGeneratorCode, TestAKSEngineVersion)
+	if err == nil {
+		t.Fatalf("expected an error from a cancelled generation")
+	}
+	if !strings.Contains(err.Error(), context.DeadlineExceeded.Error()) {
+		t.Fatalf("expected a context deadline error, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("expected the generation to return promptly after cancellation, took %s", elapsed)
+	}
+}
+
+func TestValidateExtensionVersions(t *testing.T) {
+	server := httptest.NewServer(http.FileServer(http.Dir("../..")))
+	defer server.Close()
+
+	properties := &api.Properties{
+		ExtensionProfiles: []*api.ExtensionProfile{
+			{
+				Name:    "hello-world-k8s",
+				Version: "v1",
+				RootURL: server.URL + "/",
+			},
+		},
+	}
+	if err := ValidateExtensionVersions(context.Background(), properties); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	properties.ExtensionProfiles[0].Version = "v9"
+	err := ValidateExtensionVersions(context.Background(), properties)
+	if err == nil {
+		t.Fatalf("expected an error for a nonexistent version")
+	}
+	expected := fmt.Sprintf("extension hello-world-k8s version v9 not found at root %s/, available versions are v1", server.URL)
+	if err.Error() != expected {
+		t.Errorf("expected error %q, got %q", expected, err.Error())
+	}
+
+	properties.ExtensionProfiles[0].Name = "absent"
+	err = ValidateExtensionVersions(context.Background(), properties)
+	if err == nil {
+		t.Fatalf("expected an error for a nonexistent extension")
+	}
+	if strings.Contains(err.Error(), "available versions") {
+		t.Errorf("expected no available versions for a nonexistent extension, got %q", err.Error())
+	}
+}
+
+func TestGetPreprovisionScriptCommandsInline(t *testing.T) {
+	server := httptest.NewServer(http.FileServer(http.Dir("../..")))
+	defer server.Close()
+
+	script, err := ioutil.ReadFile("../../extensions/hello-world-k8s/v1/hello-world-k8s.sh")
+	if err != nil {
+		t.Fatalf("couldn't read the extension script: %v", err)
+	}
+	encodedScript := base64.StdEncoding.EncodeToString(script)
+
+	cs := api.CreateMockContainerService("testcluster", "1.11.6", 1, 2, false)
+	cs.Properties.MasterProfile.PreprovisionExtension = &api.Extension{Name: "hello-world-k8s"}
+	cs.Properties.AgentPoolProfiles[0].PreprovisionExtension = &api.Extension{Name: "hello-world-k8s"}
+	cs.Properties.ExtensionProfiles = []*api.ExtensionProfile{
+		{
+			Name:    "hello-world-k8s",
+			Version: "v1",
+			RootURL: server.URL + "/",
+			Script:  "hello-world-k8s.sh",
+		},
+	}
+
+	cases := []struct {
+		name           string
+		maxBytes       int
+		windows        bool
+		expectInlined  bool
+		expectedSubstr string
+	}{
+		{
+			name:           "download at boot by default",
+			expectedSubstr: "/usr/bin/curl",
+		},
+		{
+			name:           "inlined",
+			maxBytes:       len(script),
+			expectInlined:  true,
+			expectedSubstr: "- echo " + encodedScript + " | /usr/bin/base64 -d | sudo /usr/bin/tee /opt/azure/containers/extensions/hello-world-k8s/hello-world-k8s.sh > /dev/null",
+		},
+		{
+			name:           "inlined on windows",
+			maxBytes:       len(script),
+			windows:        true,
+			expectInlined:  true,
+			expectedSubstr: `[IO.File]::WriteAllBytes("$env:SystemDrive:/AzureData/extensions/hello-world-k8s/hello-world-k8s.sh", [Convert]::FromBase64String("` + encodedScript + `"))`,
+		},
+		{
+			name:           "larger than the inline limit",
+			maxBytes:       len(script) - 1,
+			expectedSubstr: "/usr/bin/curl",
+		},
+	}
+
+	for _, c := range cases {
+		profile := cs.Properties.AgentPoolProfiles[0]
+		profile.OSType = api.Linux
+		if c.windows {
+			profile.OSType = api.Windows
+		}
+		g := &TemplateGenerator{InlineExtensionScriptMaxBytes: c.maxBytes}
+		for _, p := range []*api.AgentPoolProfile{nil, profile} {
+			if p == nil && c.windows {
+				continue
+			}
+			cmd, err := g.getPreprovisionScriptCommands(cs, p)
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %v", c.name, err)
+			}
+			if !strings.Contains(cmd, c.expectedSubstr) {
+				t.Errorf("%s: expected the commands to contain %s, got:\n%s", c.name, c.expectedSubstr, cmd)
+			}
+			if c.expectInlined && (strings.Contains(cmd, "curl") || strings.Contains(cmd, "Invoke-WebRequest")) {
+				t.Errorf("%s: expected the inlined commands not to download the script, got:\n%s", c.name, cmd)
+			}
+		}
+	}
+
+	cs.Properties.ExtensionProfiles[0].Script = "absent.sh"
+	g := &TemplateGenerator{InlineExtensionScriptMaxBytes: 4096}
+	if _, err = g.getPreprovisionScriptCommands(cs, nil); err == nil {
+		t.Errorf("expected an error for a script that can't be fetched")
+	}
+}
+
+func TestValidateExtensionParameters(t *testing.T) {
+	cs := api.CreateMockContainerService("testcluster", "1.11.6", 1, 2, false)
+	cs.Properties.MasterProfile.Extensions = []api.Extension{{Name: "hello-world-k8s"}}
+	cs.Properties.AgentPoolProfiles[0].PreprovisionExtension = &api.Extension{Name: "Hello-World-K8s"}
+	cs.Properties.ExtensionProfiles = []*api.ExtensionProfile{
+		{
+			Name:                "hello-world-k8s",
+			Version:             "v1",
+			ExtensionParameters: "parameters",
+		},
+	}
+
+	parametersMap, err := getParameters(cs, DefaultGeneratorCode, TestAKSEngineVersion)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err = validateExtensionParameters(cs.Properties, parametersMap); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cs.Properties.AgentPoolProfiles[0].Extensions = []api.Extension{{Name: "winrm"}}
+	err = validateExtensionParameters(cs.Properties, parametersMap)
+	if err == nil {
+		t.Fatalf("expected an error for an extension without a parameter")
+	}
+	expected := "extension winrm referenced by the agent pool " + cs.Properties.AgentPoolProfiles[0].Name + " has no parameter winrmParameters, it must have an extension profile"
+	if err.Error() != expected {
+		t.Errorf("expected error %q, got %q", expected, err.Error())
+	}
+}
+
+func TestGetExtensionURLs(t *testing.T) {
+	properties := &api.Properties{
+		MasterProfile: &api.MasterProfile{
+			Extensions: []api.Extension{{Name: "hello-world-k8s"}},
+		},
+		AgentPoolProfiles: []*api.AgentPoolProfile{
+			{
+				Name:       "agentpool1",
+				Extensions: []api.Extension{{Name: "hello-world-k8s"}, {Name: "prometheus-grafana-k8s"}},
+			},
+		},
+		ExtensionProfiles: []*api.ExtensionProfile{
+			{
+				Name:    "hello-world-k8s",
+				Version: "v1",
+				RootURL: "https://example.com/",
+			},
+			{
+				Name:     "prometheus-grafana-k8s",
+				Version:  "v1",
+				RootURL:  "https://mirror.example.com/",
+				URLQuery: "sv=1",
+			},
+			{
+				Name:    "winrm",
+				Version: "v1",
+				RootURL: "https://example.com/",
+			},
+		},
+	}
+
+	expected := []string{
+		"https://example.com/extensions/hello-world-k8s/v1/supported-orchestrators.json",
+		"https://example.com/extensions/hello-world-k8s/v1/template-link.json",
+		"https://mirror.example.com/extensions/prometheus-grafana-k8s/v1/supported-orchestrators.json?sv=1",
+		"https://mirror.example.com/extensions/prometheus-grafana-k8s/v1/template-link.json?sv=1",
+	}
+	urls := GetExtensionURLs(properties)
+	if len(urls) != len(expected) {
+		t.Fatalf("expected %d urls, got %d: %v", len(expected), len(urls), urls)
+	}
+	for i := range expected {
+		if urls[i] != expected[i] {
+			t.Errorf("expected url %d to be %s, got %s", i, expected[i], urls[i])
+		}
+	}
+}
+
+func TestValidateExtensionSingleOrAll(t *testing.T) {
+	cases := []struct {
+		name             string
+		masterExtensions []api.Extension
+		masterVMSS       bool
+		poolExtensions   []api.Extension
+		poolAvailability string
+		expectedErr      string
+	}{
+		{
+			name:             "single and all on availability sets",
+			masterExtensions: []api.Extension{{Name: "hello-world-k8s", SingleOrAll: "single"}},
+			poolExtensions:   []api.Extension{{Name: "hello-world-k8s", SingleOrAll: "Single"}, {Name: "winrm"}},
+			poolAvailability: api.AvailabilitySet,
+		},
+		{
+			name:             "all on a scale set",
+			poolExtensions:   []api.Extension{{Name: "hello-world-k8s", SingleOrAll: "All"}},
+			poolAvailability: api.VirtualMachineScaleSets,
+		},
+		{
+			name:             "single on a scale set pool",
+			poolExtensions:   []api.Extension{{Name: "hello-world-k8s", SingleOrAll: "single"}},
+			poolAvailability: api.VirtualMachineScaleSets,
+			expectedErr:      "extension hello-world-k8s of the agent pool agentpool1 selects a single VM, which is only supported on availability sets",
+		},
+		{
+			name:             "single on scale set masters",
+			masterExtensions: []api.Extension{{Name: "hello-world-k8s", SingleOrAll: "single"}},
+			masterVMSS:       true,
+			poolAvailability: api.AvailabilitySet,
+			expectedErr:      "extension hello-world-k8s of the master profile selects a single VM, which is only supported on availability sets",
+		},
+		{
+			name:             "unknown selection",
+			poolExtensions:   []api.Extension{{Name: "hello-world-k8s", SingleOrAll: "first"}},
+			poolAvailability: api.AvailabilitySet,
+			expectedErr:      "extension hello-world-k8s of the agent pool agentpool1 has singleOrAll first, must be single or all",
+		},
+	}
+
+	for _, c := range cases {
+		properties := &api.Properties{
+			MasterProfile: &api.MasterProfile{Extensions: c.masterExtensions},
+			AgentPoolProfiles: []*api.AgentPoolProfile{
+				{
+					Name:                "agentpool1",
+					AvailabilityProfile: c.poolAvailability,
+					Extensions:          c.poolExtensions,
+				},
+			},
+		}
+		if c.masterVMSS {
+			properties.MasterProfile.AvailabilityProfile = api.VirtualMachineScaleSets
+		}
+		err := ValidateExtensionSingleOrAll(properties)
+		if c.expectedErr == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", c.name, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != c.expectedErr {
+			t.Errorf("%s: expected error %q, got %v", c.name, c.expectedErr, err)
+		}
+	}
+}
+
+func TestGetUnusedExtensionProfiles(t *testing.T) {
+	cases := []struct {
+		name       string
+		properties *api.Properties
+		expected   []string
+	}{
+		{
+			name:       "no extension profiles",
+			properties: &api.Properties{MasterProfile: &api.MasterProfile{}},
+		},
+		{
+			name: "used and unused profiles",
+			properties: &api.Properties{
+				MasterProfile: &api.MasterProfile{
+					Extensions: []api.Extension{{Name: "hello-world-k8s"}},
+				},
+				AgentPoolProfiles: []*api.AgentPoolProfile{
+					{
+						Name:                  "agentpool1",
+						Extensions:            []api.Extension{{Name: "prometheus-grafana-k8s"}},
+						PreprovisionExtension: &api.Extension{Name: "Preprovision-Script"},
+					},
+				},
+				ExtensionProfiles: []*api.ExtensionProfile{
+					{Name: "hello-world-k8s"},
+					{Name: "winrm"},
+					{Name: "prometheus-grafana-k8s"},
+					{Name: "preprovision-script"},
+					{Name: "hello-world-dcos"},
+				},
+			},
+			expected: []string{"winrm", "hello-world-dcos"},
+		},
+		{
+			name: "no profile opted in",
+			properties: &api.Properties{
+				AgentPoolProfiles: []*api.AgentPoolProfile{{Name: "agentpool1"}},
+				ExtensionProfiles: []*api.ExtensionProfile{{Name: "hello-world-k8s"}},
+			},
+			expected: []string{"hello-world-k8s"},
+		},
+	}
+
+	for _, c := range cases {
+		if unused := GetUnusedExtensionProfiles(c.properties); !reflect.DeepEqual(unused, c.expected) {
+			t.Errorf("%s: expected unused extension profiles %v, got %v", c.name, c.expected, unused)
+		}
+	}
+}
+
+func TestGenerateKubeConfigProxyURL(t *testing.T) {
+	cs := api.CreateMockContainerService("testcluster", "1.11.6", 1, 2, true)
+
+	cases := []struct {
+		name        string
+		proxyURL    string
+		expectError bool
+	}{
+		{
+			name: "no proxy",
+		},
+		{
+			name:     "https proxy",
+			proxyURL: "https://proxy.contoso.com:3128",
+		},
+		{
+			name:        "invalid proxy",
+			proxyURL:    "proxy.contoso.com:3128",
+			expectError: true,
+		},
+	}
+
+	for _, c := range cases {
+		kubeConfig, err := GenerateKubeConfigWithOptions(cs.Properties, "westus2", KubeConfigOptions{ProxyURL: c.proxyURL})
+		if c.expectError {
+			if err == nil {
+				t.Errorf("%s: expected an error", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.name, err)
+		}
+
+		var config struct {
+			Clusters []struct {
+				Cluster map[string]string `json:"cluster"`
+			} `json:"clusters"`
+		}
+		if err = json.Unmarshal([]byte(kubeConfig), &config); err != nil {
+			t.Fatalf("%s: expected valid JSON, got %v:\n%s", c.name, err, kubeConfig)
+		}
+		proxyURL, ok := config.Clusters[0].Cluster["proxy-url"]
+		if c.proxyURL == "" && ok {
+			t.Errorf("%s: expected no proxy-url, got %s", c.name, proxyURL)
+		}
+		if c.proxyURL != "" && proxyURL != c.proxyURL {
+			t.Errorf("%s: expected proxy-url %s, got %s", c.name, c.proxyURL, proxyURL)
+		}
+	}
+}
+
+func TestGetDataDisksPoolStorageAccountType(t *testing.T) {
+	profile := &api.AgentPoolProfile{
+		Name:           "agentpool1",
+		StorageProfile: api.ManagedDisks,
+		DiskSizesGB:    []int{128, 256},
+	}
+	cases := []struct {
+		name                       string
+		vmSize                     string
+		dataDiskStorageAccountType string
+		diskStorageAccountTypes    []string
+		expected                   []string
+	}{
+		{
+			name:     "derived from a standard VM size",
+			vmSize:   "Standard_D2_v2",
+			expected: []string{"Standard_LRS", "Standard_LRS"},
+		},
+		{
+			name:     "derived from a premium VM size",
+			vmSize:   "Standard_DS2_v2",
+			expected: []string{"Premium_LRS", "Premium_LRS"},
+		},
+		{
+			name:                       "standard override on a premium VM size",
+			vmSize:                     "Standard_DS2_v2",
+			dataDiskStorageAccountType: "StandardSSD_LRS",
+			expected:                   []string{"StandardSSD_LRS", "StandardSSD_LRS"},
+		},
+		{
+			name:                       "per disk type takes precedence over the pool",
+			vmSize:                     "Standard_DS2_v2",
+			dataDiskStorageAccountType: "Premium_LRS",
+			diskStorageAccountTypes:    []string{"StandardSSD_LRS"},
+			expected:                   []string{"StandardSSD_LRS", "Premium_LRS"},
+		},
+	}
+
+	for _, c := range cases {
+		profile.VMSize = c.vmSize
+		profile.DataDiskStorageAccountType = c.dataDiskStorageAccountType
+		profile.DiskStorageAccountTypes = c.diskStorageAccountTypes
+		dataDisks, err := getDataDisks(profile)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.name, err)
+		}
+		for lun, storageAccountType := range c.expected {
+			expected := fmt.Sprintf(`"lun": %d,
+              "createOption": "Empty",
+              "managedDisk": {
+                "storageAccountType": "%s"
+              }`, lun, storageAccountType)
+			if !strings.Contains(dataDisks, expected) {
+				t.Errorf("%s: expected data disk %d to use %s, got:\n%s", c.name, lun, storageAccountType, dataDisks)
+			}
+		}
+	}
+
+	profile.DataDiskStorageAccountType = "Fast_LRS"
+	profile.DiskStorageAccountTypes = nil
+	if _, err := getDataDisks(profile); err == nil {
+		t.Fatalf("expected an error for an unsupported pool storage account type")
+	}
+
+	for _, storageAccountType := range []string{"PremiumV2_LRS", "UltraSSD_LRS"} {
+		profile.DataDiskStorageAccountType = "Premium_LRS"
+		profile.DiskStorageAccountTypes = []string{"", storageAccountType}
+		_, err := getDataDisks(profile)
+		if err == nil {
+			t.Fatalf("expected an error for a %s data disk", storageAccountType)
+		}
+		expectedMsg := fmt.Sprintf("agent pool agentpool1 data disk 1 has storage account type %s, which the compute API version of the templates can't create, use Premium_LRS instead", storageAccountType)
+		if err.Error() != expectedMsg {
+			t.Errorf("expected error with message : %s, but got %s", expectedMsg, err)
+		}
+	}
+}
+
+func TestGetDataDisksVMSizeCompatibility(t *testing.T) {
+	cases := []struct {
+		name                       string
+		vmSize                     string
+		storageProfile             string
+		dataDiskStorageAccountType string
+		diskStorageAccountTypes    []string
+		expectedErr                bool
+	}{
+		{
+			name:           "derived tier on a standard VM size",
+			vmSize:         "Standard_D2_v2",
+			storageProfile: api.ManagedDisks,
+		},
+		{
+			name:                       "standard SSD on a standard VM size",
+			vmSize:                     "Standard_D2_v3",
+			storageProfile:             api.ManagedDisks,
+			dataDiskStorageAccountType: "StandardSSD_LRS",
+		},
+		{
+			name:                       "premium on a premium VM size",
+			vmSize:                     "Standard_D2s_v3",
+			storageProfile:             api.ManagedDisks,
+			dataDiskStorageAccountType: "Premium_LRS",
+		},
+		{
+			name:                       "premium on a standard VM size",
+			vmSize:                     "Standard_D2_v2",
+			storageProfile:             api.ManagedDisks,
+			dataDiskStorageAccountType: "Premium_LRS",
+			expectedErr:                true,
+		},
+		{
+			name:                    "premium disk among standard ones on a standard VM size",
+			vmSize:                  "Standard_D2_v3",
+			storageProfile:          api.ManagedDisks,
+			diskStorageAccountTypes: []string{"StandardSSD_LRS", "Premium_LRS"},
+			expectedErr:             true,
+		},
+		{
+			name:           "unmanaged disks on a standard VM size",
+			vmSize:         "Standard_D2_v2",
+			storageProfile: api.StorageAccount,
+		},
+	}
+
+	for _, c := range cases {
+		profile := &api.AgentPoolProfile{
+			Name:                       "agentpool1",
+			VMSize:                     c.vmSize,
+			StorageProfile:             c.storageProfile,
+			DiskSizesGB:                []int{128, 256},
+			DataDiskStorageAccountType: c.dataDiskStorageAccountType,
+			DiskStorageAccountTypes:    c.diskStorageAccountTypes,
+		}
+		_, err := getDataDisks(profile)
+		if c.expectedErr && err == nil {
+			t.Errorf("%s: expected an error", c.name)
+		}
+		if !c.expectedErr && err != nil {
+			t.Errorf("%s: unexpected error: %s", c.name, err)
+		}
+	}
+}
+
+func TestGetDataDisksExplicitStorageAccount(t *testing.T) {
+	cases := []struct {
+		name               string
+		storageProfile     string
+		storageAccountName string
+		expectedURI        string
+		expectError        bool
+	}{
+		{
+			name:               "explicit storage account",
+			storageProfile:     api.StorageAccount,
+			storageAccountName: "existingdata01",
+			expectedURI:        `"uri": "[concat('http://','existingdata01','.blob.core.windows.net/vhds/',variables('agentpool1VMNamePrefix'),copyIndex(), '--datadisk1.vhd')]"`,
+		},
+		{
+			name:           "computed storage account",
+			storageProfile: api.StorageAccount,
+			expectedURI:    `variables('agentpool1DataAccountName'),'.blob.core.windows.net/vhds/'`,
+		},
+		{
+			name:               "invalid storage account name",
+			storageProfile:     api.StorageAccount,
+			storageAccountName: "Existing_Data",
+			expectError:        true,
+		},
+		{
+			name:               "managed disks",
+			storageProfile:     api.ManagedDisks,
+			storageAccountName: "existingdata01",
+			expectError:        true,
+		},
+	}
+
+	for _, c := range cases {
+		profile := &api.AgentPoolProfile{
+			Name:                       "agentpool1",
+			VMSize:                     "Standard_D2_v2",
+			StorageProfile:             c.storageProfile,
+			DiskSizesGB:                []int{128, 256},
+			DataDiskStorageAccountName: c.storageAccountName,
+		}
+		dataDisks, err := getDataDisks(profile)
+		if c.expectError {
+			if err == nil {
+				t.Errorf("%s: expected an error", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.name, err)
+		}
+		if !strings.Contains(dataDisks, c.expectedURI) {
+			t.Errorf("%s: expected data disks to contain %s, got:\n%s", c.name, c.expectedURI, dataDisks)
+		}
+	}
+}
+
+func TestInternalLoadBalancerIP(t *testing.T) {
+	cases := []struct {
+		name        string
+		firstIP     string
+		expected    string
+		expectError bool
+	}{
+		{
+			name:     "valid",
+			firstIP:  "10.255.255.5",
+			expected: "10.255.255.15",
+		},
+		{
+			name:     "last address",
+			firstIP:  "10.240.0.245",
+			expected: "10.240.0.255",
+		},
+		{
+			name:        "overflow",
+			firstIP:     "10.240.0.250",
+			expectError: true,
+		},
+		{
+			name:        "unparseable",
+			firstIP:     "10.240.0",
+			expectError: true,
+		},
+		{
+			name:        "ipv6",
+			firstIP:     "fd00::5",
+			expectError: true,
+		},
+	}
+
+	for _, c := range cases {
+		ip, err := InternalLoadBalancerIP(c.firstIP)
+		if c.expectError {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %s", c.name, ip)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+			continue
+		}
+		if ip != c.expected {
+			t.Errorf("%s: expected %s, got %s", c.name, c.expected, ip)
+		}
+	}
+}
+
+func TestGetSingleLineCloudInitUser(t *testing.T) {
+	cases := []struct {
+		name          string
+		distro        api.Distro
+		cloudInitUser string
+		expected      []string
+		unexpected    []string
+		expectError   bool
+	}{
+		{
+			name:       "default user",
+			distro:     api.Ubuntu,
+			unexpected: []string{"\nusers:"},
+		},
+		{
+			name:          "custom user",
+			distro:        api.Ubuntu,
+			cloudInitUser: "azureops",
+			expected: []string{
+				"\nusers:\n- default\n- name: azureops\n",
+				"sudo: [\"ALL=(ALL) NOPASSWD:ALL\"]\n",
+				"ssh_authorized_keys:\n  - ',parameters('sshRSAPublicKey'),'\n",
+			},
+		},
+		{
+			name:       "default user on CoreOS",
+			distro:     api.CoreOS,
+			expected:   []string{"usermod -aG docker ',parameters('linuxAdminUsername'),'"},
+			unexpected: []string{"\nusers:"},
+		},
+		{
+			name:          "custom user on CoreOS",
+			distro:        api.CoreOS,
+			cloudInitUser: "azureops",
+			expected: []string{
+				"\nusers:\n- name: azureops\n",
+				"ssh-authorized-keys:\n  - ',parameters('sshRSAPublicKey'),'\n",
+				"usermod -aG docker ',parameters('linuxAdminUsername'),'",
+			},
+		},
+		{
+			name:          "invalid user",
+			distro:        api.Ubuntu,
+			cloudInitUser: "Azure Ops",
+			expectError:   true,
+		},
+	}
+
+	for _, c := range cases {
+		cs := api.CreateMockContainerService("testcluster", "1.11.6", 1, 2, true)
+		cs.Properties.MasterProfile.Distro = c.distro
+		cs.Properties.AgentPoolProfiles[0].Distro = c.distro
+		cs.SetPropertiesDefaults(false, false)
+
+		templateGenerator, err := InitializeTemplateGenerator(Context{
+			Translator:    &i18n.Translator{},
+			CloudInitUser: c.cloudInitUser,
+		})
+		if err != nil {
+			t.Fatalf("Failed to initialize template generator: %v", err)
+		}
+		masterCustomData, err := templateGenerator.getSingleLine(kubernetesMasterCustomDataYaml, cs, cs.Properties)
+		if c.expectError {
+			if err == nil {
+				t.Errorf("%s: expected an error", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.name, err)
+		}
+		agentCustomData, err := templateGenerator.getSingleLine(kubernetesAgentCustomDataYaml, cs, cs.Properties.AgentPoolProfiles[0])
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.name, err)
+		}
+		for _, customData := range []string{masterCustomData, agentCustomData} {
+			for _, expected := range c.expected {
+				if !strings.Contains(customData, expected) {
+					t.Errorf("%s: expected custom data to contain %q", c.name, expected)
+				}
+			}
+			for _, unexpected := range c.unexpected {
+				if strings.Contains(customData, unexpected) {
+					t.Errorf("%s: expected custom data not to contain %q", c.name, unexpected)
+				}
+			}
+		}
+	}
+}
+
+func TestGetSingleLineProxyConfig(t *testing.T) {
+	cs := api.CreateMockContainerService("testcluster", "1.11.6", 1, 2, false)
+	cs.SetPropertiesDefaults(false, false)
+
+	cases := []struct {
+		name          string
+		proxy         ProxyConfig
+		expected      []string
+		notExpected   []string
+		expectedError bool
+	}{
+		{
+			name:        "no proxy",
+			notExpected: []string{"_PROXY=", "http_proxy.conf"},
+		},
+		{
+			name: "proxy",
+			proxy: ProxyConfig{
+				HTTPProxy:  "http://proxy.contoso.com:3128",
+				HTTPSProxy: "http://proxy.contoso.com:3129",
+				NoProxy:    []string{"localhost", "168.63.129.16", ".contoso.com"},
+			},
+			expected: []string{
+				"- path: /etc/environment\n  permissions: \"0644\"\n  owner: root\n  append: true\n  content: |\n    HTTP_PROXY=http://proxy.contoso.com:3128\n    http_proxy=http://proxy.contoso.com:3128\n    HTTPS_PROXY=http://proxy.contoso.com:3129\n    https_proxy=http://proxy.contoso.com:3129\n    NO_PROXY=localhost,168.63.129.16,.contoso.com\n    no_proxy=localhost,168.63.129.16,.contoso.com\n",
+				"- path: /etc/systemd/system/docker.service.d/http_proxy.conf",
+				"    Environment=\"HTTPS_PROXY=http://proxy.contoso.com:3129\"\n",
+			},
+		},
+		{
+			name:          "invalid proxy URL",
+			proxy:         ProxyConfig{HTTPSProxy: "proxy.contoso.com:3128"},
+			expectedError: true,
+		},
+		{
+			name:          "invalid no_proxy entry",
+			proxy:         ProxyConfig{NoProxy: []string{"localhost,127.0.0.1"}},
+			expectedError: true,
+		},
+	}
+
+	for _, c := range cases {
+		templateGenerator, err := InitializeTemplateGenerator(Context{
+			Translator: &i18n.Translator{},
+			Proxy:      c.proxy,
+		})
+		if err != nil {
+			t.Fatalf("Failed to initialize template generator: %v", err)
+		}
+		for _, customDataFile := range []struct {
+			name    string
+			profile interface{}
+		}{
+			{kubernetesMasterCustomDataYaml, cs.Properties},
+			{kubernetesAgentCustomDataYaml, cs.Properties.AgentPoolProfiles[0]},
+		} {
+			customData, err := templateGenerator.getSingleLine(customDataFile.name, cs, customDataFile.profile)
+			if c.expectedError {
+				if err == nil {
+					t.Errorf("%s: expected an error rendering %s", c.name, customDataFile.name)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("%s: unexpected error rendering %s: %v", c.name, customDataFile.name, err)
+			}
+			for _, expected := range c.expected {
+				if !strings.Contains(customData, expected) {
+					t.Errorf("%s: expected %s to contain %q", c.name, customDataFile.name, expected)
+				}
+			}
+			for _, notExpected := range c.notExpected {
+				if strings.Contains(customData, notExpected) {
+					t.Errorf("%s: expected %s not to contain %q", c.name, customDataFile.name, notExpected)
+				}
+			}
+		}
+	}
+}
+
+func TestGetSingleLineContainerRuntime(t *testing.T) {
+	cases := []struct {
+		name             string
+		containerRuntime string
+		expectedRuntime  string
+		expectDocker     bool
+	}{
+		{
+			name:            "default runtime",
+			expectedRuntime: api.DefaultContainerRuntime,
+			expectDocker:    true,
+		},
+		{
+			name:             "docker",
+			containerRuntime: "docker",
+			expectedRuntime:  "docker",
+			expectDocker:     true,
+		},
+		{
+			name:             "containerd",
+			containerRuntime: "containerd",
+			expectedRuntime:  "containerd",
+		},
+		{
+			name:             "kata-containers",
+			containerRuntime: "Kata-Containers",
+			expectedRuntime:  "kata-containers",
+		},
+	}
+
+	templateGenerator, err := InitializeTemplateGenerator(Context{Translator: &i18n.Translator{}})
+	if err != nil {
+		t.Fatalf("Failed to initialize template generator: %v", err)
+	}
+	for _, c := range cases {
+		cs := api.CreateMockContainerService("testcluster", "1.11.6", 1, 2, false)
+		cs.SetPropertiesDefaults(false, false)
+		cs.Properties.OrchestratorProfile.KubernetesConfig.ContainerRuntime = c.containerRuntime
+
+		if runtime := getContainerRuntime(cs); runtime != c.expectedRuntime {
+			t.Errorf("%s: expected runtime %s, got %s", c.name, c.expectedRuntime, runtime)
+		}
+		for _, customDataFile := range []struct {
+			name    string
+			profile interface{}
+		}{
+			{kubernetesMasterCustomDataYaml, cs.Properties},
+			{kubernetesAgentCustomDataYaml, cs.Properties.AgentPoolProfiles[0]},
+		} {
+			customData, err := templateGenerator.getSingleLine(customDataFile.name, cs, customDataFile.profile)
+			if err != nil {
+				t.Fatalf("%s: unexpected error rendering %s: %v", c.name, customDataFile.name, err)
+			}
+			hasDocker := strings.Contains(customData, "/etc/systemd/system/docker.service.d/clear_mount_propagation_flags.conf")
+			if c.expectDocker && !hasDocker {
+				t.Errorf("%s: expected %s to configure docker", c.name, customDataFile.name)
+			}
+			if !c.expectDocker && hasDocker {
+				t.Errorf("%s: expected %s not to configure docker", c.name, customDataFile.name)
+			}
+		}
+	}
+}
+
+func TestGetAgentPoolContainerRuntime(t *testing.T) {
+	cases := []struct {
+		name                 string
+		containerRuntime     string
+		poolContainerRuntime string
+		expectedPoolRuntime  string
+		expectMasterDocker   bool
+		expectAgentDocker    bool
+	}{
+		{
+			name:                "inherits the cluster runtime",
+			containerRuntime:    "containerd",
+			expectedPoolRuntime: "containerd",
+		},
+		{
+			name:                 "containerd pool in a docker cluster",
+			containerRuntime:     "docker",
+			poolContainerRuntime: "containerd",
+			expectedPoolRuntime:  "containerd",
+			expectMasterDocker:   true,
+		},
+		{
+			name:                 "docker pool in a containerd cluster",
+			containerRuntime:     "containerd",
+			poolContainerRuntime: "Docker",
+			expectedPoolRuntime:  "docker",
+			expectAgentDocker:    true,
+		},
+	}
+
+	templateGenerator, err := InitializeTemplateGenerator(Context{Translator: &i18n.Translator{}})
+	if err != nil {
+		t.Fatalf("Failed to initialize template generator: %v", err)
+	}
+	for _, c := range cases {
+		cs := api.CreateMockContainerService("testcluster", "1.11.6", 1, 2, false)
+		cs.SetPropertiesDefaults(false, false)
+		cs.Properties.OrchestratorProfile.KubernetesConfig.ContainerRuntime = c.containerRuntime
+		profile := cs.Properties.AgentPoolProfiles[0]
+		if profile.KubernetesConfig == nil {
+			profile.KubernetesConfig = &api.KubernetesConfig{}
+		}
+		profile.KubernetesConfig.ContainerRuntime = c.poolContainerRuntime
+
+		if runtime := getAgentPoolContainerRuntime(cs, profile); runtime != c.expectedPoolRuntime {
+			t.Errorf("%s: expected pool runtime %s, got %s", c.name, c.expectedPoolRuntime, runtime)
+		}
+		for _, customDataFile := range []struct {
+			name         string
+			profile      interface{}
+			expectDocker bool
+		}{
+			{kubernetesMasterCustomDataYaml, cs.Properties, c.expectMasterDocker},
+			{kubernetesAgentCustomDataYaml, profile, c.expectAgentDocker},
+		} {
+			customData, err := templateGenerator.getSingleLine(customDataFile.name, cs, customDataFile.profile)
+			if err != nil {
+				t.Fatalf("%s: unexpected error rendering %s: %v", c.name, customDataFile.name, err)
+			}
+			hasDocker := strings.Contains(customData, "/etc/systemd/system/docker.service.d/clear_mount_propagation_flags.conf")
+			if customDataFile.expectDocker && !hasDocker {
+				t.Errorf("%s: expected %s to configure docker", c.name, customDataFile.name)
+			}
+			if !customDataFile.expectDocker && hasDocker {
+				t.Errorf("%s: expected %s not to configure docker", c.name, customDataFile.name)
+			}
+		}
+
+		armTemplate, _, err := templateGenerator.GenerateTemplate(cs, DefaultGeneratorCode, TestAKSEngineVersion)
+		if err != nil {
+			t.Fatalf("%s: unexpected error generating the template: %v", c.name, err)
+		}
+		expectedCSE := fmt.Sprintf(" CONTAINER_RUNTIME=%s /usr/bin/nohup", c.expectedPoolRuntime)
+		if !strings.Contains(armTemplate, expectedCSE) {
+			t.Errorf("%s: expected the agent pool custom script to provision the %s runtime", c.name, c.expectedPoolRuntime)
+		}
+	}
+}
+
+func TestValidateTemplateReferences(t *testing.T) {
+	defined := TemplateReferences{
+		Variables:  []string{"provisionScript", "kubernetesAPIServerIP"},
+		Parameters: []string{"caCertificate"},
+	}
+	cases := []struct {
+		name          string
+		text          string
+		expectedError string
+	}{
+		{
+			name: "defined references",
+			text: "',variables('provisionScript'),' ',parameters('caCertificate'),' ',variables('provisionScript'),'",
+		},
+		{
+			name: "references differing in case",
+			text: "',variables('provisionscript'),' ',parameters('CACertificate'),'",
+		},
+		{
+			name: "computed reference",
+			text: "',variables(concat(parameters('caCertificate'), 'Suffix')),'",
+		},
+		{
+			name:          "undefined references",
+			text:          "',variables('provisionScript'),' ',variables('missingScript'),' ',parameters('missingParam'),' ',variables('missingScript'),'",
+			expectedError: "template references undefined parameters('missingParam'), variables('missingScript')",
+		},
+		{
+			name:          "variable defined only as a parameter",
+			text:          "',variables('caCertificate'),'",
+			expectedError: "template references undefined variables('caCertificate')",
+		},
+	}
+
+	for _, c := range cases {
+		err := validateTemplateReferences(c.text, defined)
+		if c.expectedError == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", c.name, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != c.expectedError {
+			t.Errorf("%s: expected error %q, got %v", c.name, c.expectedError, err)
+		}
+	}
+}
+
+func TestGenerateTemplateValidateTemplateReferences(t *testing.T) {
+	cs := api.CreateMockContainerService("testcluster", "1.11.6", 3, 2, false)
+	cs.SetPropertiesDefaults(false, false)
+	templateGenerator, err := InitializeTemplateGenerator(Context{
+		Translator:                 &i18n.Translator{},
+		ValidateTemplateReferences: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to initialize template generator: %v", err)
+	}
+
+	armTemplate, _, err := templateGenerator.GenerateTemplate(cs, DefaultGeneratorCode, TestAKSEngineVersion)
+	if err != nil {
+		t.Fatalf("unexpected error generating the template: %v", err)
+	}
+	defined, err := getDefinedTemplateReferences(armTemplate)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(defined.Variables) == 0 || len(defined.Parameters) == 0 {
+		t.Fatalf("expected the template to declare variables and parameters")
+	}
+	if err = validateTemplateReferences(armTemplate+"variables('missingScript')", defined); err == nil {
+		t.Errorf("expected an error for a template referencing an undefined variable")
+	}
+}
+
+func TestValidateBalancedExpression(t *testing.T) {
+	cases := []struct {
+		expression  string
+		expectError bool
+	}{
+		{expression: ""},
+		{expression: "1"},
+		{expression: "variables('masterOffset')"},
+		{expression: "[sub(variables('masterCount'), variables('masterOffset'))]"},
+		{expression: "[concat('a)(', variables('b'))]"},
+		{expression: "[variables('agentpool1Count'))]", expectError: true},
+		{expression: "[sub(variables('agentpool1Count'), variables('agentpool1Offset')]", expectError: true},
+		{expression: "[variables('agentpool1Count')", expectError: true},
+		{expression: "[variables('agentpool1Count)]", expectError: true},
+	}
+
+	for _, c := range cases {
+		err := validateBalancedExpression(c.expression)
+		if c.expectError && err == nil {
+			t.Errorf("expected an error for %s", c.expression)
+		}
+		if !c.expectError && err != nil {
+			t.Errorf("unexpected error for %s: %v", c.expression, err)
+		}
+	}
+}
+
+func TestInternalGetPoolLinkedTemplateTextMalformedLoop(t *testing.T) {
+	extensionProfile := &api.ExtensionProfile{
+		Name:    "hello-world-k8s",
+		Version: "v1",
+		RootURL: "https://example.com/",
+	}
+	cases := []struct {
+		name       string
+		loopCount  string
+		loopOffset string
+	}{
+		{name: "unbalanced count", loopCount: "[variables('agentpool1Count'))]"},
+		{name: "empty count", loopCount: ""},
+		{name: "unbalanced offset", loopCount: "1", loopOffset: "variables('agentpool1Offset'"},
+	}
+	for _, c := range cases {
+		_, err := internalGetPoolLinkedTemplateText(context.Background(), "variables('agentpool1VMNamePrefix')", api.Kubernetes, c.loopCount, c.loopOffset, extensionProfile)
+		if err == nil {
+			t.Errorf("%s: expected an error", c.name)
+		}
+	}
+}
+
+func TestGenerateKubeConfigAlternateEndpoints(t *testing.T) {
+	cs := api.CreateMockContainerService("testcluster", "1.11.6", 1, 2, true)
+
+	kubeConfig, err := GenerateKubeConfigWithOptions(cs.Properties, "westus2", KubeConfigOptions{
+		AlternateEndpoints: []KubeConfigEndpoint{
+			{Name: "eastus2-failover", Server: "failover.eastus2.cloudapp.azure.com"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var config struct {
+		Clusters []struct {
+			Cluster map[string]string `json:"cluster"`
+			Name    string            `json:"name"`
+		} `json:"clusters"`
+		Contexts []struct {
+			Context map[string]string `json:"context"`
+			Name    string            `json:"name"`
+		} `json:"contexts"`
+		CurrentContext string `json:"current-context"`
+	}
+	if err = json.Unmarshal([]byte(kubeConfig), &config); err != nil {
+		t.Fatalf("expected valid JSON, got %v:\n%s", err, kubeConfig)
+	}
+	if len(config.Clusters) != 2 || len(config.Contexts) != 2 {
+		t.Fatalf("expected 2 clusters and 2 contexts, got %d and %d", len(config.Clusters), len(config.Contexts))
+	}
+	dnsPrefix := cs.Properties.MasterProfile.DNSPrefix
+	if config.CurrentContext != dnsPrefix {
+		t.Errorf("expected the current context to remain %s, got %s", dnsPrefix, config.CurrentContext)
+	}
+	primary, alternate := config.Clusters[0], config.Clusters[1]
+	if alternate.Name != "eastus2-failover" || alternate.Cluster["server"] != "https://failover.eastus2.cloudapp.azure.com" {
+		t.Errorf("unexpected alternate cluster %+v", alternate)
+	}
+	if alternate.Cluster["certificate-authority-data"] != primary.Cluster["certificate-authority-data"] {
+		t.Errorf("expected the alternate cluster to reuse the certificate authority data")
+	}
+	alternateContext := config.Contexts[1]
+	if alternateContext.Name != "eastus2-failover" || alternateContext.Context["cluster"] != "eastus2-failover" || alternateContext.Context["user"] != dnsPrefix+"-admin" {
+		t.Errorf("unexpected alternate context %+v", alternateContext)
+	}
+
+	for _, endpoints := range [][]KubeConfigEndpoint{
+		{{Name: dnsPrefix, Server: "failover.eastus2.cloudapp.azure.com"}},
+		{{Name: "eastus2-failover"}},
+	} {
+		if _, err = GenerateKubeConfigWithOptions(cs.Properties, "westus2", KubeConfigOptions{AlternateEndpoints: endpoints}); err == nil {
+			t.Errorf("expected an error for alternate endpoints %+v", endpoints)
+		}
+	}
+}
+
+func TestGetPlannedSecurityRulesReservedPriorities(t *testing.T) {
+	cases := []struct {
+		name        string
+		ports       []int
+		options     SecurityRuleOptions
+		expected    []int
+		expectError bool
+	}{
+		{
+			name:     "default base priority",
+			ports:    []int{80, 443},
+			expected: []int{200, 201},
+		},
+		{
+			name:     "custom base priority",
+			ports:    []int{80, 443},
+			options:  SecurityRuleOptions{BasePriority: 1000},
+			expected: []int{1000, 1001},
+		},
+		{
+			name:  "reserved ranges are skipped",
+			ports: []int{80, 443, 8080, 8443},
+			options: SecurityRuleOptions{
+				BasePriority:       3998,
+				ReservedPriorities: []PriorityRange{{Min: 4000, Max: 4090}, {Min: 3999, Max: 3999}},
+			},
+			expected: []int{3998, 4091, 4092, 4093},
+		},
+		{
+			name:  "rules do not fit",
+			ports: []int{80, 443, 8080},
+			options: SecurityRuleOptions{
+				BasePriority:       4000,
+				ReservedPriorities: []PriorityRange{{Min: 4001, Max: 4095}},
+			},
+			expectError: true,
+		},
+		{
+			name:        "base priority out of range",
+			ports:       []int{80},
+			options:     SecurityRuleOptions{BasePriority: 50},
+			expectError: true,
+		},
+		{
+			name:  "empty reserved range",
+			ports: []int{80},
+			options: SecurityRuleOptions{
+				ReservedPriorities: []PriorityRange{{Min: 300, Max: 250}},
+			},
+			expectError: true,
+		},
+	}
+
+	for _, c := range cases {
+		rules, err := GetPlannedSecurityRulesWithOptions(c.ports, c.options)
+		if c.expectError {
+			if err == nil {
+				t.Errorf("%s: expected an error", c.name)
+			}
+			if _, err = getSecurityRulesWithOptions(c.ports, c.options); err == nil {
+				t.Errorf("%s: expected an error from getSecurityRulesWithOptions", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.name, err)
+		}
+		for i, rule := range rules {
+			if rule.Priority != c.expected[i] {
+				t.Errorf("%s: expected rule %d to have priority %d, got %d", c.name, i, c.expected[i], rule.Priority)
+			}
+		}
+		emitted, err := getSecurityRulesWithOptions(c.ports, c.options)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.name, err)
+		}
+		for _, priority := range c.expected {
+			if !strings.Contains(emitted, fmt.Sprintf(`"priority": %d,`, priority)) {
+				t.Errorf("%s: expected an emitted rule with priority %d", c.name, priority)
+			}
+		}
+	}
+}
+
+func TestGetDataDisksNameTemplate(t *testing.T) {
+	cases := []struct {
+		name                string
+		availabilityProfile string
+		zones               []string
+		template            string
+		expected            []string
+		expectError         bool
+	}{
+		{
+			name:                "single zone scale set",
+			availabilityProfile: api.VirtualMachineScaleSets,
+			zones:               []string{"2"},
+			template:            "{pool}-{zones}-data{lun}",
+			expected: []string{
+				`"name": "[concat(variables('agentpool1VMNamePrefix'), '-agentpool1-z2-data0')]"`,
+				`"name": "[concat(variables('agentpool1VMNamePrefix'), '-agentpool1-z2-data1')]"`,
+			},
+		},
+		{
+			name:                "multi zone scale set without the zone",
+			availabilityProfile: api.VirtualMachineScaleSets,
+			zones:               []string{"1", "2"},
+			template:            "{pool}-data{lun}",
+			expected: []string{
+				`"name": "[concat(variables('agentpool1VMNamePrefix'), '-agentpool1-data0')]"`,
+				`"name": "[concat(variables('agentpool1VMNamePrefix'), '-agentpool1-data1')]"`,
+			},
+		},
+		{
+			name:                "regional availability set",
+			availabilityProfile: api.AvailabilitySet,
+			template:            "{zones}-data{lun}",
+			expected: []string{
+				`"name": "[concat(variables('agentpool1VMNamePrefix'), copyIndex(), '-regional-data0')]"`,
+				`"name": "[concat(variables('agentpool1VMNamePrefix'), copyIndex(), '-regional-data1')]"`,
+			},
+		},
+		{
+			name:                "multi zone scale set with the zone",
+			availabilityProfile: api.VirtualMachineScaleSets,
+			zones:               []string{"1", "2"},
+			template:            "{zones}-data{lun}",
+			expectError:         true,
+		},
+		{
+			name:                "template without the lun",
+			availabilityProfile: api.VirtualMachineScaleSets,
+			template:            "data",
+			expectError:         true,
+		},
+		{
+			name:                "invalid characters",
+			availabilityProfile: api.VirtualMachineScaleSets,
+			template:            "data {lun}",
+			expectError:         true,
+		},
+	}
+
+	for _, c := range cases {
+		profile := &api.AgentPoolProfile{
+			Name:                 "agentpool1",
+			VMSize:               "Standard_DS2_v2",
+			AvailabilityProfile:  c.availabilityProfile,
+			AvailabilityZones:    c.zones,
+			StorageProfile:       api.ManagedDisks,
+			DiskSizesGB:          []int{128, 256},
+			DataDiskNameTemplate: c.template,
+		}
+		dataDisks, err := getDataDisks(profile)
+		if c.expectError {
+			if err == nil {
+				t.Errorf("%s: expected an error", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.name, err)
+		}
+		for _, expected := range c.expected {
+			if !strings.Contains(dataDisks, expected) {
+				t.Errorf("%s: expected the data disks to contain %s, got:\n%s", c.name, expected, dataDisks)
+			}
+		}
+	}
+}
+
+func TestGenerateKubeConfigCAFilePath(t *testing.T) {
+	cs := api.CreateMockContainerService("testcluster", "1.11.6", 1, 2, true)
+	caPair, err := helpers.CreatePkiKeyCertPair("ca")
+	if err != nil {
+		t.Fatalf("Failed to create a CA certificate: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "kubeconfig-ca")
+	if err != nil {
+		t.Fatalf("Failed to create a temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.crt")
+	invalidCAFile := filepath.Join(dir, "invalid.crt")
+	if err = ioutil.WriteFile(caFile, []byte(caPair.CertificatePem), 0600); err != nil {
+		t.Fatalf("Failed to write the CA file: %v", err)
+	}
+	if err = ioutil.WriteFile(invalidCAFile, []byte(caPair.PrivateKeyPem), 0600); err != nil {
+		t.Fatalf("Failed to write the invalid CA file: %v", err)
+	}
+
+	cases := []struct {
+		name        string
+		caFilePath  string
+		expectedCA  string
+		expectError bool
+	}{
+		{
+			name:       "inline CA",
+			expectedCA: cs.Properties.CertificateProfile.CaCertificate,
+		},
+		{
+			name:       "CA file",
+			caFilePath: caFile,
+			expectedCA: caPair.CertificatePem,
+		},
+		{
+			name:        "CA file without a certificate",
+			caFilePath:  invalidCAFile,
+			expectError: true,
+		},
+		{
+			name:        "missing CA file",
+			caFilePath:  filepath.Join(dir, "missing.crt"),
+			expectError: true,
+		},
+	}
+
+	for _, c := range cases {
+		kubeConfig, err := GenerateKubeConfigWithOptions(cs.Properties, "westus2", KubeConfigOptions{CAFilePath: c.caFilePath})
+		if c.expectError {
+			if err == nil {
+				t.Errorf("%s: expected an error", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.name, err)
+		}
+		expected := base64.StdEncoding.EncodeToString([]byte(c.expectedCA))
+		if !strings.Contains(kubeConfig, fmt.Sprintf(`"certificate-authority-data": "%s"`, expected)) {
+			t.Errorf("%s: expected the kubeconfig to embed the CA data %s", c.name, expected)
+		}
+	}
+}
+
+func TestGetSecurityRulesDescription(t *testing.T) {
+	rules, err := getSecurityRulesWithOptions([]int{80, 443}, SecurityRuleOptions{
+		Descriptions: map[int]string{443: `Allow "HTTPS" from the ingress controller`},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var emitted []struct {
+		Properties struct {
+			Description string `json:"description"`
+		} `json:"properties"`
+	}
+	if err = json.Unmarshal([]byte("["+rules+"]"), &emitted); err != nil {
+		t.Fatalf("expected valid JSON, got %v:\n%s", err, rules)
+	}
+	expected := []string{
+		"Allow traffic from the Internet to port 80",
+		`Allow "HTTPS" from the ingress controller`,
+	}
+	for i, description := range expected {
+		if emitted[i].Properties.Description != description {
+			t.Errorf("expected rule %d description %q, got %q", i, description, emitted[i].Properties.Description)
+		}
+	}
+}
+
+func TestGetLoadBalancerRulesInternalFrontend(t *testing.T) {
+	cases := []struct {
+		name                  string
+		rules                 []LoadBalancerRule
+		expectedFrontendID    string
+		expectedBackendPoolID string
+		expectedProbeIDPrefix string
+		expectError           bool
+	}{
+		{
+			name:                  "public frontend",
+			rules:                 []LoadBalancerRule{{Port: 443}},
+			expectedFrontendID:    "[variables('masterLbIPConfigID')]",
+			expectedBackendPoolID: "[concat(variables('masterLbID'), '/backendAddressPools/', variables('masterLbBackendPoolName'))]",
+			expectedProbeIDPrefix: "[concat(variables('masterLbID'),'/probes/",
+		},
+		{
+			name:                  "internal frontend",
+			rules:                 []LoadBalancerRule{{Port: 443, InternalFrontend: true}, {Port: 8443, InternalFrontend: true}},
+			expectedFrontendID:    "[variables('masterInternalLbIPConfigID')]",
+			expectedBackendPoolID: "[concat(variables('masterInternalLbID'), '/backendAddressPools/', variables('masterLbBackendPoolName'))]",
+			expectedProbeIDPrefix: "[concat(variables('masterInternalLbID'),'/probes/",
+		},
+		{
+			name:        "mixed frontends",
+			rules:       []LoadBalancerRule{{Port: 443, InternalFrontend: true}, {Port: 80}},
+			expectError: true,
+		},
+	}
+
+	for _, c := range cases {
+		lbRules, err := getLoadBalancerRules("master", c.rules)
+		if c.expectError {
+			if err == nil {
+				t.Errorf("%s: expected an error", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.name, err)
+		}
+		var emittedRules []struct {
+			Properties struct {
+				BackendAddressPool struct {
+					ID string `json:"id"`
+				} `json:"backendAddressPool"`
+				FrontendIPConfiguration struct {
+					ID string `json:"id"`
+				} `json:"frontendIPConfiguration"`
+				Probe struct {
+					ID string `json:"id"`
+				} `json:"probe"`
+			} `json:"properties"`
+		}
+		if err = json.Unmarshal([]byte("["+lbRules+"]"), &emittedRules); err != nil {
+			t.Fatalf("%s: expected valid JSON, got %v:\n%s", c.name, err, lbRules)
+		}
+		if len(emittedRules) != len(c.rules) {
+			t.Fatalf("%s: expected %d rules, got %d", c.name, len(c.rules), len(emittedRules))
+		}
+		for i, rule := range emittedRules {
+			if rule.Properties.FrontendIPConfiguration.ID != c.expectedFrontendID {
+				t.Errorf("%s: expected rule %d frontend %s, got %s", c.name, i, c.expectedFrontendID, rule.Properties.FrontendIPConfiguration.ID)
+			}
+			if rule.Properties.BackendAddressPool.ID != c.expectedBackendPoolID {
+				t.Errorf("%s: expected rule %d backend pool %s, got %s", c.name, i, c.expectedBackendPoolID, rule.Properties.BackendAddressPool.ID)
+			}
+			if !strings.HasPrefix(rule.Properties.Probe.ID, c.expectedProbeIDPrefix) {
+				t.Errorf("%s: expected rule %d probe to start with %s, got %s", c.name, i, c.expectedProbeIDPrefix, rule.Properties.Probe.ID)
+			}
+		}
+	}
+}
+
+func TestGetLoadBalancerRulesProbeNames(t *testing.T) {
+	rules := []LoadBalancerRule{
+		{Port: 80},
+		{Port: 53, Protocol: "udp"},
+		{Port: 8080, ProbeProtocol: "http", ProbePath: "/healthz"},
+		{Port: 8443, ProbeProtocol: "https"},
+		{Port: 443, ProbeNamePrefix: "ingress"},
+	}
+	expected := []string{"tcp80Probe", "tcp53Probe", "http8080Probe", "https8443Probe", "ingress443Probe"}
+
+	lbRules, err := getLoadBalancerRules("agent", rules)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	probes, err := getLoadBalancerProbes(rules)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var emittedRules []struct {
+		Properties struct {
+			Probe struct {
+				ID string `json:"id"`
+			} `json:"probe"`
+		} `json:"properties"`
+	}
+	if err = json.Unmarshal([]byte("["+lbRules+"]"), &emittedRules); err != nil {
+		t.Fatalf("expected valid JSON, got %v:\n%s", err, lbRules)
+	}
+	var emittedProbes []struct {
+		Name string `json:"name"`
+	}
+	if err = json.Unmarshal([]byte("["+probes+"]"), &emittedProbes); err != nil {
+		t.Fatalf("expected valid JSON, got %v:\n%s", err, probes)
+	}
+
+	for i, name := range expected {
+		if emittedProbes[i].Name != name {
+			t.Errorf("expected probe %d to be named %s, got %s", i, name, emittedProbes[i].Name)
+		}
+		reference := fmt.Sprintf("[concat(variables('agentLbID'),'/probes/%s')]", emittedProbes[i].Name)
+		if emittedRules[i].Properties.Probe.ID != reference {
+			t.Errorf("expected rule %d to reference %s, got %s", i, reference, emittedRules[i].Properties.Probe.ID)
+		}
+	}
+
+	if _, err = getLoadBalancerRules("agent", []LoadBalancerRule{{Port: 443, ProbeNamePrefix: "bad/prefix"}}); err == nil {
+		t.Fatalf("expected an error for an invalid probe name prefix")
+	}
+}
+
+func TestValidateAgentPoolSubnets(t *testing.T) {
+	cases := []struct {
+		name        string
+		vnetCidr    string
+		subnets     []string
+		expectError bool
+	}{
+		{
+			name:    "no declared VNET",
+			subnets: []string{"192.168.0.0/24"},
+		},
+		{
+			name:     "contained subnets",
+			vnetCidr: "10.0.0.0/8",
+			subnets:  []string{"10.240.0.0/16", "10.241.0.0/16", ""},
+		},
+		{
+			name:        "subnet outside of the VNET",
+			vnetCidr:    "10.0.0.0/8",
+			subnets:     []string{"10.240.0.0/16", "172.16.0.0/16"},
+			expectError: true,
+		},
+		{
+			name:        "subnet larger than the VNET",
+			vnetCidr:    "10.240.0.0/16",
+			subnets:     []string{"10.0.0.0/8"},
+			expectError: true,
+		},
+		{
+			name:        "invalid subnet",
+			vnetCidr:    "10.0.0.0/8",
+			subnets:     []string{"10.240.0.0"},
+			expectError: true,
+		},
+	}
+
+	for _, c := range cases {
+		properties := &api.Properties{
+			MasterProfile: &api.MasterProfile{
+				VnetCidr: c.vnetCidr,
+				Subnet:   "10.255.255.0/24",
+			},
+		}
+		for i, subnet := range c.subnets {
+			properties.AgentPoolProfiles = append(properties.AgentPoolProfiles, &api.AgentPoolProfile{
+				Name:   fmt.Sprintf("agentpool%d", i),
+				Subnet: subnet,
+			})
+		}
+		err := ValidateAgentPoolSubnets(properties)
+		if c.expectError && err == nil {
+			t.Errorf("%s: expected an error", c.name)
+		}
+		if !c.expectError && err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+		}
+	}
+
+	cs := api.CreateMockContainerService("testcluster", "1.11.6", 1, 2, false)
+	cs.SetPropertiesDefaults(false, false)
+	cs.Properties.MasterProfile.VnetCidr = "10.0.0.0/8"
+	cs.Properties.AgentPoolProfiles[0].Subnet = "172.16.0.0/16"
+	templateGenerator, err := InitializeTemplateGenerator(Context{Translator: &i18n.Translator{}})
+	if err != nil {
+		t.Fatalf("Failed to initialize template generator: %v", err)
+	}
+	_, _, err = templateGenerator.GenerateTemplate(cs, DefaultGeneratorCode, TestAKSEngineVersion)
+	if err == nil || !strings.Contains(err.Error(), "outside of the VNET address space") {
+		t.Errorf("expected an error generating a template with an agent subnet outside of the VNET, got %v", err)
+	}
+}
+
+func TestGetSecurityRuleCount(t *testing.T) {
+	cases := []struct {
+		name                  string
+		hasWindows            bool
+		blockOutboundInternet bool
+		hostedMaster          bool
+		expectedCount         int
+	}{
+		{
+			name:          "linux cluster",
+			expectedCount: 2,
+		},
+		{
+			name:          "windows cluster",
+			hasWindows:    true,
+			expectedCount: 3,
+		},
+		{
+			name:                  "windows cluster blocking outbound internet",
+			hasWindows:            true,
+			blockOutboundInternet: true,
+			expectedCount:         5,
+		},
+		{
+			name:          "hosted master",
+			hostedMaster:  true,
+			expectedCount: 0,
+		},
+	}
+
+	for _, c := range cases {
+		cs := api.CreateMockContainerService("testcluster", "1.11.6", 3, 2, false)
+		if c.hasWindows {
+			cs.Properties.AgentPoolProfiles[0].OSType = api.Windows
+		}
+		if c.blockOutboundInternet {
+			cs.Properties.FeatureFlags = &api.FeatureFlags{BlockOutboundInternet: true}
+		}
+		if c.hostedMaster {
+			cs.Properties.MasterProfile = nil
+			cs.Properties.HostedMasterProfile = &api.HostedMasterProfile{DNSPrefix: "testcluster"}
+		}
+		if count := GetSecurityRuleCount(cs.Properties); count != c.expectedCount {
+			t.Errorf("%s: expected %d security rules, got %d", c.name, c.expectedCount, count)
+		}
+	}
+
+	if err := validateSecurityRuleCount(MaxSecurityRulesPerNSG); err != nil {
+		t.Errorf("unexpected error for an NSG at the rule limit: %v", err)
+	}
+	if err := validateSecurityRuleCount(MaxSecurityRulesPerNSG + 1); err == nil {
+		t.Errorf("expected an error for an NSG past the rule limit")
+	}
+}
+
+func TestGetPublicIPCount(t *testing.T) {
+	cases := []struct {
+		name                string
+		masterCount         int
+		agentCount          int
+		masterAvailability  string
+		privateCluster      bool
+		jumpbox             bool
+		expectedPublicIPCnt int
+	}{
+		{
+			name:                "single master",
+			masterCount:         1,
+			agentCount:          1,
+			expectedPublicIPCnt: 1,
+		},
+		{
+			name:                "multi master",
+			masterCount:         3,
+			agentCount:          1,
+			expectedPublicIPCnt: 1,
+		},
+		{
+			name:                "multi pool",
+			masterCount:         3,
+			agentCount:          3,
+			expectedPublicIPCnt: 1,
+		},
+		{
+			name:                "private cluster",
+			masterCount:         3,
+			agentCount:          2,
+			privateCluster:      true,
+			expectedPublicIPCnt: 0,
+		},
+		{
+			name:                "private cluster with a jumpbox",
+			masterCount:         3,
+			agentCount:          2,
+			privateCluster:      true,
+			jumpbox:             true,
+			expectedPublicIPCnt: 1,
+		},
+		{
+			name:                "private cluster with scale set masters",
+			masterCount:         3,
+			agentCount:          2,
+			masterAvailability:  api.VirtualMachineScaleSets,
+			privateCluster:      true,
+			expectedPublicIPCnt: 1,
+		},
+		{
+			name:                "private cluster with scale set masters and a jumpbox",
+			masterCount:         3,
+			agentCount:          2,
+			masterAvailability:  api.VirtualMachineScaleSets,
+			privateCluster:      true,
+			jumpbox:             true,
+			expectedPublicIPCnt: 1,
+		},
+	}
+
+	for _, c := range cases {
+		cs := api.CreateMockContainerService("testcluster", "1.11.6", c.masterCount, c.agentCount, false)
+		cs.Properties.MasterProfile.AvailabilityProfile = c.masterAvailability
+		if c.privateCluster {
+			cs.Properties.OrchestratorProfile.KubernetesConfig.PrivateCluster = &api.PrivateCluster{
+				Enabled: helpers.PointerToBool(true),
+			}
+			if c.jumpbox {
+				cs.Properties.OrchestratorProfile.KubernetesConfig.PrivateCluster.JumpboxProfile = &api.PrivateJumpboxProfile{
+					Name: "jumpbox",
+				}
+			}
+		}
+		if count := GetPublicIPCount(cs.Properties); count != c.expectedPublicIPCnt {
+			t.Errorf("%s: expected %d public IPs, got %d", c.name, c.expectedPublicIPCnt, count)
+		}
+	}
+}
+
+func TestGetPublicPorts(t *testing.T) {
+	scaleSetPorts := []int{443}
+	for port := 50001; port <= 50119; port++ {
+		scaleSetPorts = append(scaleSetPorts, port)
+	}
+
+	cases := []struct {
+		name               string
+		masterCount        int
+		masterAvailability string
+		privateCluster     bool
+		expected           []int
+	}{
+		{
+			name:        "single master",
+			masterCount: 1,
+			expected:    []int{22, 443},
+		},
+		{
+			name:        "availability set masters",
+			masterCount: 3,
+			expected:    []int{22, 443, 2201, 2202},
+		},
+		{
+			name:               "scale set masters",
+			masterCount:        3,
+			masterAvailability: api.VirtualMachineScaleSets,
+			expected:           scaleSetPorts,
+		},
+		{
+			name:           "private cluster",
+			masterCount:    3,
+			privateCluster: true,
+			expected:       []int{},
+		},
+		{
+			name:               "private cluster with scale set masters",
+			masterCount:        1,
+			masterAvailability: api.VirtualMachineScaleSets,
+			privateCluster:     true,
+			expected:           scaleSetPorts,
+		},
+	}
+
+	for _, c := range cases {
+		cs := api.CreateMockContainerService("testcluster", "1.11.6", c.masterCount, 1, false)
+		cs.Properties.MasterProfile.AvailabilityProfile = c.masterAvailability
+		if c.privateCluster {
+			cs.Properties.OrchestratorProfile.KubernetesConfig.PrivateCluster = &api.PrivateCluster{
+				Enabled: helpers.PointerToBool(true),
+			}
+		}
+		cs.Properties.AgentPoolProfiles[0].Ports = []int{80, 8080}
+		if ports := GetPublicPorts(cs.Properties); !reflect.DeepEqual(ports, c.expected) {
+			t.Errorf("%s: expected public ports %v, got %v", c.name, c.expected, ports)
+		}
+	}
+}
+
+func TestGetAddonFuncMapOverride(t *testing.T) {
+	cases := []struct {
+		name       string
+		overrides  map[string]string
+		expected   string
+		unexpected string
+	}{
+		{
+			name:       "no override",
+			expected:   "imagePullPolicy: IfNotPresent",
+			unexpected: "imagePullPolicy: Always",
+		},
+		{
+			name:       "override",
+			overrides:  map[string]string{"imagePullPolicy": "Always"},
+			expected:   "imagePullPolicy: Always",
+			unexpected: "imagePullPolicy: IfNotPresent",
+		},
+	}
+
+	for _, c := range cases {
+		cs := api.CreateMockContainerService("testcluster", "1.11.6", 1, 2, false)
+		cs.Properties.OrchestratorProfile.KubernetesConfig.Addons = []api.KubernetesAddon{
+			{
+				Name:      DefaultTillerAddonName,
+				Enabled:   helpers.PointerToBool(true),
+				Overrides: c.overrides,
+			},
+		}
+		cs.SetPropertiesDefaults(false, false)
+		addon := cs.Properties.OrchestratorProfile.KubernetesConfig.GetAddonByName(DefaultTillerAddonName)
+
+		addonFileBytes, err := Asset("k8s/containeraddons/kubernetesmasteraddons-tiller-deployment.yaml")
+		if err != nil {
+			t.Fatalf("%s: unexpected error reading the tiller addon: %s", c.name, err)
+		}
+		templ, err := template.New("addon resolver template").Funcs(getAddonFuncMap(addon)).Parse(string(addonFileBytes))
+		if err != nil {
+			t.Fatalf("%s: unexpected error parsing the tiller addon: %s", c.name, err)
+		}
+		var buffer bytes.Buffer
+		if err := templ.Execute(&buffer, addon); err != nil {
+			t.Fatalf("%s: unexpected error rendering the tiller addon: %s", c.name, err)
+		}
+		rendered := buffer.String()
+		if !strings.Contains(rendered, c.expected) {
+			t.Errorf("%s: expected rendered addon to contain %q, got: %s", c.name, c.expected, rendered)
+		}
+		if strings.Contains(rendered, c.unexpected) {
+			t.Errorf("%s: expected rendered addon not to contain %q", c.name, c.unexpected)
+		}
+	}
+}
+
+func TestGetAddonFuncMapImagePullSecrets(t *testing.T) {
+	cases := []struct {
+		name             string
+		imagePullSecrets string
+		expected         string
+		expectedErr      bool
+	}{
+		{
+			name:     "no image pull secrets",
+			expected: "      serviceAccountName: tiller\n      containers:\n",
+		},
+		{
+			name:             "image pull secret",
+			imagePullSecrets: "acr-credentials",
+			expected:         "      serviceAccountName: tiller\n      imagePullSecrets:\n      - name: \"acr-credentials\"\n      containers:\n",
+		},
+		{
+			name:             "several image pull secrets",
+			imagePullSecrets: "acr-credentials, registry.contoso.com,",
+			expected:         "      imagePullSecrets:\n      - name: \"acr-credentials\"\n      - name: \"registry.contoso.com\"\n      containers:\n",
+		},
+		{
+			name:             "invalid image pull secret",
+			imagePullSecrets: "ACR_Credentials",
+			expectedErr:      true,
+		},
+	}
+
+	for _, c := range cases {
+		cs := api.CreateMockContainerService("testcluster", "1.11.6", 1, 2, false)
+		cs.Properties.OrchestratorProfile.KubernetesConfig.Addons = []api.KubernetesAddon{
+			{
+				Name:    DefaultTillerAddonName,
+				Enabled: helpers.PointerToBool(true),
+				Config:  map[string]string{"imagePullSecrets": c.imagePullSecrets},
+			},
+		}
+		cs.SetPropertiesDefaults(false, false)
+		addon := cs.Properties.OrchestratorProfile.KubernetesConfig.GetAddonByName(DefaultTillerAddonName)
+
+		_, err := getContainerAddonsString(cs.Properties, "k8s/containeraddons", nil, false)
+		if c.expectedErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.name, err)
+		}
+
+		addonFileBytes, err := Asset("k8s/containeraddons/kubernetesmasteraddons-tiller-deployment.yaml")
+		if err != nil {
+			t.Fatalf("%s: unexpected error reading the tiller addon: %s", c.name, err)
+		}
+		templ, err := template.New("addon resolver template").Funcs(getAddonFuncMap(addon)).Parse(string(addonFileBytes))
+		if err != nil {
+			t.Fatalf("%s: unexpected error parsing the tiller addon: %s", c.name, err)
+		}
+		var buffer bytes.Buffer
+		if err := templ.Execute(&buffer, addon); err != nil {
+			t.Fatalf("%s: unexpected error rendering the tiller addon: %s", c.name, err)
+		}
+		rendered := buffer.String()
+		if !strings.Contains(rendered, c.expected) {
+			t.Errorf("%s: expected rendered addon to contain %q, got: %s", c.name, c.expected, rendered)
+		}
+		if c.imagePullSecrets == "" && strings.Contains(rendered, "imagePullSecrets") {
+			t.Errorf("%s: expected rendered addon not to reference image pull secrets", c.name)
+		}
+	}
+}
+
+func TestGetAddonFuncMapInitContainers(t *testing.T) {
+	var rootUser int64
+	cases := []struct {
+		name           string
+		initContainers []api.KubernetesInitContainerSpec
+		expected       string
+		expectedErr    bool
+	}{
+		{
+			name:     "no init containers",
+			expected: "      serviceAccountName: tiller\n      containers:\n",
+		},
+		{
+			name: "init container",
+			initContainers: []api.KubernetesInitContainerSpec{
+				{Name: "sysctl", Image: "busybox:1.30"},
+			},
+			expected: "      serviceAccountName: tiller\n      initContainers:\n      - name: \"sysctl\"\n        image: \"busybox:1.30\"\n      containers:\n",
+		},
+		{
+			name: "init containers with resources",
+			initContainers: []api.KubernetesInitContainerSpec{
+				{Name: "sysctl", Image: "busybox:1.30", CPURequests: "10m", MemoryLimits: "32Mi"},
+				{Name: "prepull", Image: "contoso.azurecr.io/charts:v1", CPURequests: "50m", MemoryRequests: "64Mi", CPULimits: "100m", MemoryLimits: "128Mi"},
+			},
+			expected: "      initContainers:\n" +
+				"      - name: \"sysctl\"\n        image: \"busybox:1.30\"\n        resources:\n          requests:\n            cpu: \"10m\"\n          limits:\n            memory: \"32Mi\"\n" +
+				"      - name: \"prepull\"\n        image: \"contoso.azurecr.io/charts:v1\"\n        resources:\n          requests:\n            cpu: \"50m\"\n            memory: \"64Mi\"\n          limits:\n            cpu: \"100m\"\n            memory: \"128Mi\"\n" +
+				"      containers:\n",
+		},
+		{
+			name: "init container with a command and a security context",
+			initContainers: []api.KubernetesInitContainerSpec{
+				{
+					Name:    "sysctl",
+					Image:   "busybox:1.30",
+					Command: []string{"sh", "-c"},
+					Args:    []string{"sysctl -w vm.max_map_count=262144"},
+					SecurityContext: &api.KubernetesSecurityContext{
+						Privileged: helpers.PointerToBool(true),
+						RunAsUser:  &rootUser,
+					},
+				},
+			},
+			expected: "      initContainers:\n" +
+				"      - name: \"sysctl\"\n        image: \"busybox:1.30\"\n        command: [\"sh\",\"-c\"]\n        args: [\"sysctl -w vm.max_map_count=262144\"]\n" +
+				"        securityContext:\n          privileged: true\n          runAsUser: 0\n" +
+				"      containers:\n",
+		},
+		{
+			name: "init container with an empty security context",
+			initContainers: []api.KubernetesInitContainerSpec{
+				{Name: "sysctl", Image: "busybox:1.30", SecurityContext: &api.KubernetesSecurityContext{}},
+			},
+			expected: "      - name: \"sysctl\"\n        image: \"busybox:1.30\"\n      containers:\n",
+		},
+		{
+			name: "init container without an image",
+			initContainers: []api.KubernetesInitContainerSpec{
+				{Name: "sysctl"},
+			},
+			expectedErr: true,
+		},
+		{
+			name: "init container named after the main container",
+			initContainers: []api.KubernetesInitContainerSpec{
+				{Name: "tiller", Image: "busybox:1.30"},
+			},
+			expectedErr: true,
+		},
+		{
+			name: "init container with an invalid name",
+			initContainers: []api.KubernetesInitContainerSpec{
+				{Name: "Sysctl_Init", Image: "busybox:1.30"},
+			},
+			expectedErr: true,
+		},
+		{
+			name: "init container running as root with runAsNonRoot",
+			initContainers: []api.KubernetesInitContainerSpec{
+				{
+					Name:  "sysctl",
+					Image: "busybox:1.30",
+					SecurityContext: &api.KubernetesSecurityContext{
+						RunAsUser:    &rootUser,
+						RunAsNonRoot: helpers.PointerToBool(true),
+					},
+				},
+			},
+			expectedErr: true,
+		},
+		{
+			name: "init container requesting more than its limit",
+			initContainers: []api.KubernetesInitContainerSpec{
+				{Name: "sysctl", Image: "busybox:1.30", MemoryRequests: "64Mi", MemoryLimits: "32Mi"},
+			},
+			expectedErr: true,
+		},
+	}
+
+	for _, c := range cases {
+		cs := api.CreateMockContainerService("testcluster", "1.11.6", 1, 2, false)
+		cs.Properties.OrchestratorProfile.KubernetesConfig.Addons = []api.KubernetesAddon{
+			{
+				Name:           DefaultTillerAddonName,
+				Enabled:        helpers.PointerToBool(true),
+				InitContainers: c.initContainers,
+			},
+		}
+		cs.SetPropertiesDefaults(false, false)
+		addon := cs.Properties.OrchestratorProfile.KubernetesConfig.GetAddonByName(DefaultTillerAddonName)
+
+		_, err := getContainerAddonsString(cs.Properties, "k8s/containeraddons", nil, false)
+		if c.expectedErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.name, err)
+		}
+
+		addonFileBytes, err := Asset("k8s/containeraddons/kubernetesmasteraddons-tiller-deployment.yaml")
+		if err != nil {
+			t.Fatalf("%s: unexpected error reading the tiller addon: %s", c.name, err)
+		}
+		templ, err := template.New("addon resolver template").Funcs(getAddonFuncMap(addon)).Parse(string(addonFileBytes))
+		if err != nil {
+			t.Fatalf("%s: unexpected error parsing the tiller addon: %s", c.name, err)
+		}
+		var buffer bytes.Buffer
+		if err := templ.Execute(&buffer, addon); err != nil {
+			t.Fatalf("%s: unexpected error rendering the tiller addon: %s", c.name, err)
+		}
+		rendered := buffer.String()
+		if !strings.Contains(rendered, c.expected) {
+			t.Errorf("%s: expected rendered addon to contain %q, got: %s", c.name, c.expected, rendered)
+		}
+		if len(c.initContainers) == 0 && strings.Contains(rendered, "initContainers") {
+			t.Errorf("%s: expected rendered addon not to have init containers", c.name)
+		}
+	}
+}
+
+func TestValidateAddonImageTags(t *testing.T) {
+	cases := []struct {
+		name        string
+		image       string
+		expectedErr bool
+	}{
+		{
+			name:  "pinned tag",
+			image: "gcr.io/kubernetes-helm/tiller:v2.11.0",
+		},
+		{
+			name:  "pinned digest",
+			image: "gcr.io/kubernetes-helm/tiller@sha256:ba6e5f7d9a7a8d3b1e8f2e7f3c1c2a4b5d6e7f8091a2b3c4d5e6f708192a3b4c",
+		},
+		{
+			name:        "latest tag",
+			image:       "gcr.io/kubernetes-helm/tiller:latest",
+			expectedErr: true,
+		},
+		{
+			name:        "no tag",
+			image:       "gcr.io/kubernetes-helm/tiller",
+			expectedErr: true,
+		},
+		{
+			name:        "registry port without a tag",
+			image:       "myregistry.io:5000/tiller",
+			expectedErr: true,
+		},
+	}
+
+	for _, c := range cases {
+		cs := api.CreateMockContainerService("testcluster", "1.11.6", 1, 2, false)
+		cs.Properties.OrchestratorProfile.KubernetesConfig.Addons = []api.KubernetesAddon{
+			{
+				Name:    DefaultTillerAddonName,
+				Enabled: helpers.PointerToBool(true),
+				Containers: []api.KubernetesContainerSpec{
+					{
+						Name:  DefaultTillerAddonName,
+						Image: c.image,
+					},
+				},
+			},
+		}
+
+		err := ValidateAddonImageTags(cs.Properties)
+		if c.expectedErr && err == nil {
+			t.Errorf("%s: expected an error for image %s", c.name, c.image)
+		}
+		if !c.expectedErr && err != nil {
+			t.Errorf("%s: unexpected error for image %s: %s", c.name, c.image, err)
+		}
+	}
+}
+
+func TestGenerateTemplateForbidMutableAddonImages(t *testing.T) {
+	cs := api.CreateMockContainerService("testcluster", "1.11.6", 1, 2, false)
+	cs.Properties.OrchestratorProfile.KubernetesConfig.Addons = []api.KubernetesAddon{
+		{
+			Name:    DefaultTillerAddonName,
+			Enabled: helpers.PointerToBool(true),
+			Containers: []api.KubernetesContainerSpec{
+				{
+					Name:  DefaultTillerAddonName,
+					Image: "gcr.io/kubernetes-helm/tiller:latest",
+				},
+			},
+		},
+	}
+	cs.SetPropertiesDefaults(false, false)
+
+	templateGenerator, err := InitializeTemplateGenerator(Context{
+		Translator:               &i18n.Translator{},
+		ForbidMutableAddonImages: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to initialize template generator: %v", err)
+	}
+	_, _, err = templateGenerator.GenerateTemplate(cs, DefaultGeneratorCode, TestAKSEngineVersion)
+	if err == nil || !strings.Contains(err.Error(), "mutable image") {
+		t.Fatalf("expected an error for the mutable addon images, got: %v", err)
+	}
+}
+
+func TestGetLoadBalancerRulesDisableOutboundSnat(t *testing.T) {
+	rules := []LoadBalancerRule{
+		{Port: 80},
+		{Port: 443, DisableOutboundSnat: true},
+	}
+	lbRules, err := getLoadBalancerRules("agentpool1", rules)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var emittedRules []struct {
+		Properties struct {
+			DisableOutboundSnat *bool `json:"disableOutboundSnat"`
+		} `json:"properties"`
+	}
+	if err = json.Unmarshal([]byte("["+lbRules+"]"), &emittedRules); err != nil {
+		t.Fatalf("couldn't unmarshal emitted LB rules: %v", err)
+	}
+	if emittedRules[0].Properties.DisableOutboundSnat == nil || *emittedRules[0].Properties.DisableOutboundSnat {
+		t.Errorf("expected the default rule to emit disableOutboundSnat false")
+	}
+	if emittedRules[1].Properties.DisableOutboundSnat == nil || !*emittedRules[1].Properties.DisableOutboundSnat {
+		t.Errorf("expected the rule to emit disableOutboundSnat true")
+	}
+}
+
+func TestGetLoadBalancerRulesBackendPort(t *testing.T) {
+	rules := []LoadBalancerRule{
+		{Port: 443, BackendPort: 8443, ProbeProtocol: "https", ProbePath: "/healthz"},
+		{Port: 80},
+	}
+	lbRules, err := getLoadBalancerRules("agentpool1", rules)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	probes, err := getLoadBalancerProbes(rules)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var emittedRules []struct {
+		Name       string `json:"name"`
+		Properties struct {
+			BackendPort  int `json:"backendPort"`
+			FrontendPort int `json:"frontendPort"`
+		} `json:"properties"`
+	}
+	if err = json.Unmarshal([]byte("["+lbRules+"]"), &emittedRules); err != nil {
+		t.Fatalf("couldn't unmarshal emitted LB rules: %v", err)
+	}
+	var emittedProbes []struct {
+		Properties struct {
+			Port int `json:"port"`
+		} `json:"properties"`
+	}
+	if err = json.Unmarshal([]byte("["+probes+"]"), &emittedProbes); err != nil {
+		t.Fatalf("couldn't unmarshal emitted probes: %v", err)
+	}
+
+	expected := []struct {
+		frontendPort int
+		backendPort  int
+	}{
+		{443, 8443},
+		{80, 80},
+	}
+	for i, e := range expected {
+		rule := emittedRules[i]
+		if rule.Properties.FrontendPort != e.frontendPort || rule.Properties.BackendPort != e.backendPort {
+			t.Errorf("expected rule %s to map frontend port %d to backend port %d, got %d to %d",
+				rule.Name, e.frontendPort, e.backendPort, rule.Properties.FrontendPort, rule.Properties.BackendPort)
+		}
+		if emittedProbes[i].Properties.Port != e.backendPort {
+			t.Errorf("expected the probe of rule %s to check backend port %d, got %d", rule.Name, e.backendPort, emittedProbes[i].Properties.Port)
+		}
+	}
+
+	if _, err = getLoadBalancerRules("agentpool1", []LoadBalancerRule{{Port: 443, BackendPort: 70000}}); err == nil {
+		t.Errorf("expected an error for an invalid backend port")
+	}
+}
+
+func TestValidateExtensionRootURLs(t *testing.T) {
+	cases := []struct {
+		name           string
+		rootURL        string
+		allowedSchemes []string
+		expectedErr    bool
+	}{
+		{
+			name:           "https under strict mode",
+			rootURL:        "https://raw.githubusercontent.com/Azure/aks-engine/master/",
+			allowedSchemes: []string{"https"},
+		},
+		{
+			name:           "http under strict mode",
+			rootURL:        "http://raw.githubusercontent.com/Azure/aks-engine/master/",
+			allowedSchemes: []string{"https"},
+			expectedErr:    true,
+		},
+		{
+			name:           "http in the allow-list",
+			rootURL:        "http://extensions.internal/",
+			allowedSchemes: []string{"https", "http"},
+		},
+		{
+			name:           "scheme case is ignored",
+			rootURL:        "HTTPS://raw.githubusercontent.com/Azure/aks-engine/master/",
+			allowedSchemes: []string{"https"},
+		},
+	}
+
+	for _, c := range cases {
+		properties := &api.Properties{
+			ExtensionProfiles: []*api.ExtensionProfile{
+				{
+					Name:    "hello-world-k8s",
+					Version: "v1",
+					RootURL: c.rootURL,
+				},
+			},
+		}
+		err := ValidateExtensionRootURLs(properties, c.allowedSchemes)
+		if c.expectedErr && err == nil {
+			t.Errorf("%s: expected an error for root URL %s", c.name, c.rootURL)
+		}
+		if !c.expectedErr && err != nil {
+			t.Errorf("%s: unexpected error for root URL %s: %s", c.name, c.rootURL, err)
+		}
+	}
+}
+
+func TestGenerateTemplateAllowedExtensionSchemes(t *testing.T) {
+	apiloader := &api.Apiloader{
+		Translator: &i18n.Translator{},
+	}
+	containerService, _, err := apiloader.LoadContainerServiceFromFile("./testdata/extensions/kubernetes.json", true, false, nil)
+	if err != nil {
+		t.Fatalf("Failed to load container service from file: %v", err)
+	}
+	containerService.SetPropertiesDefaults(false, false)
+	for _, extensionProfile := range containerService.Properties.ExtensionProfiles {
+		extensionProfile.RootURL = "http://raw.githubusercontent.com/Azure/aks-engine/master/"
+	}
+
+	templateGenerator, err := InitializeTemplateGenerator(Context{
+		Translator:              &i18n.Translator{},
+		AllowedExtensionSchemes: []string{"https"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to initialize template generator: %v", err)
+	}
+	_, _, err = templateGenerator.GenerateTemplate(containerService, DefaultGeneratorCode, TestAKSEngineVersion)
+	if err == nil || !strings.Contains(err.Error(), "allowed schemes are https") {
+		t.Fatalf("expected an error for the http extension root URL, got: %v", err)
+	}
+}
+
+func TestGenerateKubeConfigTokenAuth(t *testing.T) {
+	cs := api.CreateMockContainerService("testcluster", "1.11.6", 1, 2, true)
+
+	cases := []struct {
+		name        string
+		authMode    string
+		token       string
+		expectError bool
+	}{
+		{
+			name:     "token auth",
+			authMode: KubeConfigAuthModeToken,
+			token:    "eyJhbGciOiJSUzI1NiJ9.sa-token",
+		},
+		{
+			name:        "token auth without a token",
+			authMode:    KubeConfigAuthModeToken,
+			expectError: true,
+		},
+		{
+			name:        "unsupported auth mode",
+			authMode:    "basic",
+			token:       "secret",
+			expectError: true,
+		},
+	}
+
+	for _, c := range cases {
+		kubeConfig, err := GenerateKubeConfigWithOptions(cs.Properties, "westus2", KubeConfigOptions{AuthMode: c.authMode, Token: c.token})
+		if c.expectError {
+			if err == nil {
+				t.Errorf("%s: expected an error", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.name, err)
+		}
+
+		var config struct {
+			Users []struct {
+				User map[string]interface{} `json:"user"`
+			} `json:"users"`
+		}
+		if err = json.Unmarshal([]byte(kubeConfig), &config); err != nil {
+			t.Fatalf("%s: expected valid JSON, got %v:\n%s", c.name, err, kubeConfig)
+		}
+		user := config.Users[0].User
+		if user["token"] != c.token {
+			t.Errorf("%s: expected token %s, got %v", c.name, c.token, user["token"])
+		}
+		if _, ok := user["client-certificate-data"]; ok {
+			t.Errorf("%s: expected no client certificate with token auth", c.name)
+		}
+	}
+}
+
+func TestGenerateKubeConfigAzureStack(t *testing.T) {
+	cs := api.CreateMockContainerService("testcluster", "1.11.6", 1, 2, true)
+	cs.Properties.AADProfile = &api.AADProfile{
+		ServerAppID: "serverAppID",
+		ClientAppID: "clientAppID",
+		TenantID:    "tenantID",
+	}
+	cloud := &KubeConfigCloudEnvironment{
+		Name:                       "AzureStackCloud",
+		ResourceManagerVMDNSSuffix: "cloudapp.azurestack.external",
+	}
+
+	kubeConfig, err := GenerateKubeConfigWithOptions(cs.Properties, "local", KubeConfigOptions{CloudEnvironment: cloud})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var config struct {
+		Clusters []struct {
+			Cluster struct {
+				Server string `json:"server"`
+			} `json:"cluster"`
+		} `json:"clusters"`
+		Users []struct {
+			User struct {
+				AuthProvider struct {
+					Config map[string]string `json:"config"`
+				} `json:"auth-provider"`
+			} `json:"user"`
+		} `json:"users"`
+	}
+	if err = json.Unmarshal([]byte(kubeConfig), &config); err != nil {
+		t.Fatalf("expected valid JSON, got %v:\n%s", err, kubeConfig)
+	}
+	expectedServer := fmt.Sprintf("https://%s.local.cloudapp.azurestack.external", cs.Properties.MasterProfile.DNSPrefix)
+	if server := config.Clusters[0].Cluster.Server; server != expectedServer {
+		t.Errorf("expected server %s, got %s", expectedServer, server)
+	}
+	if environment := config.Users[0].User.AuthProvider.Config["environment"]; environment != "AzureStackCloud" {
+		t.Errorf("expected the AzureStackCloud environment, got %s", environment)
+	}
+
+	// without the cloud metadata the location formats a public cloud FQDN
+	kubeConfig, err = GenerateKubeConfig(cs.Properties, "local")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(kubeConfig, `"environment":"AzurePublicCloud"`) || strings.Contains(kubeConfig, "azurestack") {
+		t.Errorf("expected a public cloud kubeconfig, got:\n%s", kubeConfig)
+	}
+
+	if _, err = GenerateKubeConfigWithOptions(cs.Properties, "local", KubeConfigOptions{CloudEnvironment: &KubeConfigCloudEnvironment{Name: "AzureStackCloud"}}); err == nil {
+		t.Errorf("expected an error for a cloud environment without a DNS suffix")
+	}
+}
+
+func TestGenerateKubeConfigNamespace(t *testing.T) {
+	cs := api.CreateMockContainerService("testcluster", "1.11.6", 1, 1, false)
+
+	cases := []struct {
+		name              string
+		namespace         string
+		alternateEndpoint bool
+		expectError       bool
+	}{
+		{
+			name: "no namespace",
+		},
+		{
+			name:      "namespace",
+			namespace: "team-a",
+		},
+		{
+			name:              "namespace with an alternate endpoint",
+			namespace:         "team-a",
+			alternateEndpoint: true,
+		},
+		{
+			name:        "uppercase namespace",
+			namespace:   "Team-A",
+			expectError: true,
+		},
+		{
+			name:        "namespace ending with a hyphen",
+			namespace:   "team-",
+			expectError: true,
+		},
+		{
+			name:        "namespace too long",
+			namespace:   strings.Repeat("a", 64),
+			expectError: true,
+		},
+	}
+
+	for _, c := range cases {
+		options := KubeConfigOptions{Namespace: c.namespace}
+		if c.alternateEndpoint {
+			options.AlternateEndpoints = []KubeConfigEndpoint{{Name: "secondary", Server: "secondary.contoso.com"}}
+		}
+		kubeConfig, err := GenerateKubeConfigWithOptions(cs.Properties, "westus2", options)
+		if c.expectError {
+			if err == nil {
+				t.Errorf("%s: expected an error", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.name, err)
+		}
+		var config struct {
+			Contexts []struct {
+				Context map[string]string `json:"context"`
+				Name    string            `json:"name"`
+			} `json:"contexts"`
+		}
+		if err = json.Unmarshal([]byte(kubeConfig), &config); err != nil {
+			t.Fatalf("%s: expected valid JSON, got %v:\n%s", c.name, err, kubeConfig)
+		}
+		expectedContexts := 1
+		if c.alternateEndpoint {
+			expectedContexts = 2
+		}
+		if len(config.Contexts) != expectedContexts {
+			t.Fatalf("%s: expected %d contexts, got %d", c.name, expectedContexts, len(config.Contexts))
+		}
+		for _, context := range config.Contexts {
+			namespace, ok := context.Context["namespace"]
+			if c.namespace == "" && ok {
+				t.Errorf("%s: expected context %s to omit the namespace, got %s", c.name, context.Name, namespace)
+			}
+			if namespace != c.namespace {
+				t.Errorf("%s: expected context %s namespace %q, got %q", c.name, context.Name, c.namespace, namespace)
+			}
+		}
+	}
+}
+
+func TestGenerateKubeConfigUserName(t *testing.T) {
+	cs := api.CreateMockContainerService("testcluster", "1.11.6", 1, 1, false)
+
+	cases := []struct {
+		name              string
+		userName          string
+		alternateEndpoint bool
+		expectedUserName  string
+		expectError       bool
+	}{
+		{
+			name:             "default user name",
+			expectedUserName: cs.Properties.MasterProfile.DNSPrefix + "-admin",
+		},
+		{
+			name:             "custom user name",
+			userName:         "jane@contoso.com",
+			expectedUserName: "jane@contoso.com",
+		},
+		{
+			name:              "custom user name with an alternate endpoint",
+			userName:          "jane@contoso.com",
+			alternateEndpoint: true,
+			expectedUserName:  "jane@contoso.com",
+		},
+		{
+			name:             "custom user name requiring escaping",
+			userName:         `ci "deploy" bot`,
+			expectedUserName: `ci "deploy" bot`,
+		},
+		{
+			name:        "user name with trailing whitespace",
+			userName:    "jane ",
+			expectError: true,
+		},
+	}
+
+	for _, c := range cases {
+		options := KubeConfigOptions{UserName: c.userName}
+		if c.alternateEndpoint {
+			options.AlternateEndpoints = []KubeConfigEndpoint{{Name: "secondary", Server: "secondary.contoso.com"}}
+		}
+		kubeConfig, err := GenerateKubeConfigWithOptions(cs.Properties, "westus2", options)
+		if c.expectError {
+			if err == nil {
+				t.Errorf("%s: expected an error", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.name, err)
+		}
+		var config struct {
+			Contexts []struct {
+				Context map[string]string `json:"context"`
+				Name    string            `json:"name"`
+			} `json:"contexts"`
+			Users []struct {
+				Name string `json:"name"`
+			} `json:"users"`
+		}
+		if err = json.Unmarshal([]byte(kubeConfig), &config); err != nil {
+			t.Fatalf("%s: expected valid JSON, got %v:\n%s", c.name, err, kubeConfig)
+		}
+		if len(config.Users) != 1 || config.Users[0].Name != c.expectedUserName {
+			t.Errorf("%s: expected a single user %q, got %+v", c.name, c.expectedUserName, config.Users)
+		}
+		for _, context := range config.Contexts {
+			if context.Context["user"] != c.expectedUserName {
+				t.Errorf("%s: expected context %s user %q, got %q", c.name, context.Name, c.expectedUserName, context.Context["user"])
+			}
+		}
+	}
+}
+
+func TestGenerateKubeConfigMasterIndex(t *testing.T) {
+	cs := api.CreateMockContainerService("testcluster", "1.11.6", 3, 1, false)
+	cs.Properties.MasterProfile.FirstConsecutiveStaticIP = "10.239.255.239"
+
+	cases := []struct {
+		name           string
+		masterIndex    int
+		expectedServer string
+		expectError    bool
+	}{
+		{
+			name:           "first master",
+			masterIndex:    0,
+			expectedServer: "https://10.239.255.239",
+		},
+		{
+			name:           "last master",
+			masterIndex:    2,
+			expectedServer: "https://10.239.255.241",
+		},
+		{
+			name:        "past the master count",
+			masterIndex: 3,
+			expectError: true,
+		},
+		{
+			name:        "negative index",
+			masterIndex: -1,
+			expectError: true,
+		},
+	}
+
+	for _, c := range cases {
+		masterIndex := c.masterIndex
+		kubeConfig, err := GenerateKubeConfigWithOptions(cs.Properties, "westus2", KubeConfigOptions{MasterIndex: &masterIndex})
+		if c.expectError {
+			if err == nil {
+				t.Errorf("%s: expected an error", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.name, err)
+		}
+		var config struct {
+			Clusters []struct {
+				Cluster struct {
+					Server string `json:"server"`
+				} `json:"cluster"`
+			} `json:"clusters"`
+		}
+		if err = json.Unmarshal([]byte(kubeConfig), &config); err != nil {
+			t.Fatalf("%s: expected valid JSON, got %v:\n%s", c.name, err, kubeConfig)
+		}
+		if server := config.Clusters[0].Cluster.Server; server != c.expectedServer {
+			t.Errorf("%s: expected server %s, got %s", c.name, c.expectedServer, server)
+		}
+	}
+
+	cs.Properties.MasterProfile.AvailabilityProfile = api.VirtualMachineScaleSets
+	masterIndex := 0
+	if _, err := GenerateKubeConfigWithOptions(cs.Properties, "westus2", KubeConfigOptions{MasterIndex: &masterIndex}); err == nil {
+		t.Errorf("expected an error pinning the kubeconfig to a scale set master")
+	}
+}
+
+func TestGenerateTemplateCustomDataEncoding(t *testing.T) {
+	cases := []struct {
+		name        string
+		encoding    CustomDataEncodingOptions
+		expectPlain bool
+	}{
+		{
+			name: "gzipped by default",
+		},
+		{
+			name:        "uncompressed",
+			encoding:    CustomDataEncodingOptions{Uncompressed: true},
+			expectPlain: true,
+		},
+		{
+			name:        "addons below the threshold",
+			encoding:    CustomDataEncodingOptions{UncompressedThreshold: 1 << 20},
+			expectPlain: true,
+		},
+		{
+			name:     "no addon below the threshold",
+			encoding: CustomDataEncodingOptions{UncompressedThreshold: 1},
+		},
+	}
+
+	for _, c := range cases {
+		cs := api.CreateMockContainerService("testcluster", "1.11.6", 1, 2, false)
+		cs.SetPropertiesDefaults(false, false)
+
+		templateGenerator, err := InitializeTemplateGenerator(Context{
+			Translator:         &i18n.Translator{},
+			CustomDataEncoding: c.encoding,
+		})
+		if err != nil {
+			t.Fatalf("Failed to initialize template generator: %v", err)
+		}
+		armTemplate, _, err := templateGenerator.GenerateTemplate(cs, DefaultGeneratorCode, TestAKSEngineVersion)
+		if err != nil {
+			t.Fatalf("%s: unexpected error generating the template: %v", c.name, err)
+		}
+		// the custom data is escaped into a JSON string
+		addonEntry := "- path: /etc/kubernetes/addons/kube-tiller-deployment.yaml\\n  permissions: \\\"0644\\\"\\n  encoding: "
+		if !strings.Contains(armTemplate, addonEntry) {
+			t.Fatalf("%s: expected the template to write the tiller addon", c.name)
+		}
+		expectedEncoding := CustomDataEncodingGzip
+		if c.expectPlain {
+			expectedEncoding = CustomDataEncodingBase64
+		}
+		if !strings.Contains(armTemplate, addonEntry+expectedEncoding+"\\n") {
+			t.Errorf("%s: expected the tiller addon to be encoded as %s", c.name, expectedEncoding)
+		}
+	}
+}
+
+func TestGenerateTemplateDisableBGPRoutePropagation(t *testing.T) {
+	for _, disable := range []bool{false, true} {
+		cs := api.CreateMockContainerService("testcluster", "1.11.6", 1, 2, false)
+		cs.Properties.OrchestratorProfile.KubernetesConfig.NetworkPlugin = api.NetworkPluginKubenet
+		if disable {
+			cs.Properties.OrchestratorProfile.KubernetesConfig.DisableBGPRoutePropagation = helpers.PointerToBool(true)
+		}
+		cs.SetPropertiesDefaults(false, false)
+
+		templateGenerator, err := InitializeTemplateGenerator(Context{Translator: &i18n.Translator{}})
+		if err != nil {
+			t.Fatalf("Failed to initialize template generator: %v", err)
+		}
+		armTemplate, _, err := templateGenerator.GenerateTemplate(cs, DefaultGeneratorCode, TestAKSEngineVersion)
+		if err != nil {
+			t.Fatalf("unexpected error generating the template: %v", err)
+		}
+		if !json.Valid([]byte(armTemplate)) {
+			t.Fatalf("expected a valid JSON template")
+		}
+		if emitted := strings.Contains(armTemplate, `"disableBgpRoutePropagation": true`); emitted != disable {
+			t.Errorf("expected disableBgpRoutePropagation emitted %t, got %t", disable, emitted)
+		}
+	}
+}
+
+func TestGenerateTemplateInternalLbIdleTimeout(t *testing.T) {
+	cases := []struct {
+		name                    string
+		internalIdleTimeout     int
+		expectedInternalTimeout int
+	}{
+		{
+			name:                    "default",
+			expectedInternalTimeout: DefaultLoadBalancerIdleTimeoutInMinutes,
+		},
+		{
+			name:                    "custom internal timeout",
+			internalIdleTimeout:     30,
+			expectedInternalTimeout: 30,
+		},
+	}
+
+	for _, c := range cases {
+		cs := api.CreateMockContainerService("testcluster", "1.11.6", 3, 2, false)
+		cs.Properties.OrchestratorProfile.KubernetesConfig.InternalLbIdleTimeoutInMinutes = c.internalIdleTimeout
+		cs.SetPropertiesDefaults(false, false)
+
+		templateGenerator, err := InitializeTemplateGenerator(Context{Translator: &i18n.Translator{}})
+		if err != nil {
+			t.Fatalf("Failed to initialize template generator: %v", err)
+		}
+		armTemplate, _, err := templateGenerator.GenerateTemplate(cs, DefaultGeneratorCode, TestAKSEngineVersion)
+		if err != nil {
+			t.Fatalf("%s: unexpected error generating the template: %v", c.name, err)
+		}
+
+		var generated struct {
+			Resources []struct {
+				Name       string `json:"name"`
+				Type       string `json:"type"`
+				Properties struct {
+					LoadBalancingRules []struct {
+						Properties struct {
+							IdleTimeoutInMinutes int `json:"idleTimeoutInMinutes"`
+						} `json:"properties"`
+					} `json:"loadBalancingRules"`
+				} `json:"properties"`
+			} `json:"resources"`
+		}
+		if err = json.Unmarshal([]byte(armTemplate), &generated); err != nil {
+			t.Fatalf("%s: expected a valid JSON template, got %v", c.name, err)
+		}
+		timeouts := map[string]int{}
+		for _, resource := range generated.Resources {
+			if resource.Type != "Microsoft.Network/loadBalancers" {
+				continue
+			}
+			for _, rule := range resource.Properties.LoadBalancingRules {
+				timeouts[resource.Name] = rule.Properties.IdleTimeoutInMinutes
+			}
+		}
+		if timeout := timeouts["[variables('masterInternalLbName')]"]; timeout != c.expectedInternalTimeout {
+			t.Errorf("%s: expected internal LB idle timeout %d, got %d", c.name, c.expectedInternalTimeout, timeout)
+		}
+		if timeout := timeouts["[variables('masterLbName')]"]; timeout != DefaultLoadBalancerIdleTimeoutInMinutes {
+			t.Errorf("%s: expected public LB idle timeout %d, got %d", c.name, DefaultLoadBalancerIdleTimeoutInMinutes, timeout)
+		}
+	}
+}
+
+func TestValidateInternalLoadBalancerIP(t *testing.T) {
+	cases := []struct {
+		name                     string
+		subnet                   string
+		firstConsecutiveStaticIP string
+		expectedErr              bool
+		expectedResolveErr       bool
+	}{
+		{
+			name:                     "default master addresses",
+			subnet:                   "10.240.0.0/16",
+			firstConsecutiveStaticIP: "10.240.255.5",
+		},
+		{
+			name:                     "lands on the broadcast address",
+			subnet:                   "10.240.0.0/24",
+			firstConsecutiveStaticIP: "10.240.0.245",
+			expectedErr:              true,
+		},
+		{
+			name:                     "lands on the network address",
+			subnet:                   "10.240.0.16/28",
+			firstConsecutiveStaticIP: "10.240.0.6",
+			expectedErr:              true,
+		},
+		{
+			name:                     "lands on an Azure reserved host address",
+			subnet:                   "10.240.0.16/28",
+			firstConsecutiveStaticIP: "10.240.0.9",
+			expectedErr:              true,
+		},
+		{
+			name:                     "first usable address",
+			subnet:                   "10.240.0.16/28",
+			firstConsecutiveStaticIP: "10.240.0.10",
+			expectedResolveErr:       true,
+		},
+		{
+			name:                     "outside of the subnet",
+			subnet:                   "10.240.0.0/24",
+			firstConsecutiveStaticIP: "10.241.0.5",
+			expectedErr:              true,
+		},
+	}
+
+	for _, c := range cases {
+		properties := &api.Properties{
+			MasterProfile: &api.MasterProfile{
+				Subnet:                   c.subnet,
+				FirstConsecutiveStaticIP: c.firstConsecutiveStaticIP,
+			},
+		}
+		err := ValidateInternalLoadBalancerIP(properties)
+		if c.expectedErr && err == nil {
+			t.Errorf("%s: expected an error", c.name)
+		}
+		if !c.expectedErr && err != nil {
+			t.Errorf("%s: unexpected error: %s", c.name, err)
+		}
+
+		properties.MasterProfile.Count = 3
+		properties.OrchestratorProfile = &api.OrchestratorProfile{
+			KubernetesConfig: &api.KubernetesConfig{
+				PrivateCluster: &api.PrivateCluster{
+					Enabled: helpers.PointerToBool(true),
+				},
+			},
+		}
+		_, err = ResolveAPIServerEndpoint(properties, "westus2")
+		expectedResolveErr := c.expectedErr || c.expectedResolveErr
+		if expectedResolveErr && err == nil {
+			t.Errorf("%s: expected an error resolving the API server endpoint", c.name)
+		}
+		if !expectedResolveErr && err != nil {
+			t.Errorf("%s: unexpected error resolving the API server endpoint: %s", c.name, err)
+		}
+	}
+}
+
+func TestValidateInternalLoadBalancerIPOffset(t *testing.T) {
+	cases := []struct {
+		name                     string
+		masterCount              int
+		subnet                   string
+		firstConsecutiveStaticIP string
+		expectedErr              bool
+	}{
+		{
+			name:                     "3 masters",
+			masterCount:              3,
+			subnet:                   "10.240.0.0/16",
+			firstConsecutiveStaticIP: "10.240.255.5",
+		},
+		{
+			name:                     "last master just before the offset",
+			masterCount:              DefaultInternalLbStaticIPOffset,
+			subnet:                   "10.240.0.0/16",
+			firstConsecutiveStaticIP: "10.240.255.5",
+		},
+		{
+			name:                     "last master on the offset",
+			masterCount:              DefaultInternalLbStaticIPOffset + 1,
+			subnet:                   "10.240.0.0/16",
+			firstConsecutiveStaticIP: "10.240.255.5",
+			expectedErr:              true,
+		},
+		{
+			name:                     "masters past the offset",
+			masterCount:              DefaultInternalLbStaticIPOffset + 5,
+			firstConsecutiveStaticIP: "10.240.255.5",
+			expectedErr:              true,
+		},
+		{
+			name:                     "last master outside of the subnet",
+			masterCount:              5,
+			subnet:                   "10.240.0.0/29",
+			firstConsecutiveStaticIP: "10.240.0.4",
+			expectedErr:              true,
+		},
+		{
+			name:                     "last master overflows the last octet",
+			masterCount:              5,
+			firstConsecutiveStaticIP: "10.240.255.253",
+			expectedErr:              true,
+		},
+	}
+
+	for _, c := range cases {
+		properties := &api.Properties{
+			MasterProfile: &api.MasterProfile{
+				Count:                    c.masterCount,
+				Subnet:                   c.subnet,
+				FirstConsecutiveStaticIP: c.firstConsecutiveStaticIP,
+			},
+		}
+		err := ValidateInternalLoadBalancerIPOffset(properties)
+		if c.expectedErr && err == nil {
+			t.Errorf("%s: expected an error", c.name)
+		}
+		if !c.expectedErr && err != nil {
+			t.Errorf("%s: unexpected error: %s", c.name, err)
+		}
+	}
+
+	cs := api.CreateMockContainerService("testcluster", "1.11.6", DefaultInternalLbStaticIPOffset+1, 1, false)
+	cs.Properties.MasterProfile.FirstConsecutiveStaticIP = "10.239.255.239"
+	cs.Properties.OrchestratorProfile.KubernetesConfig.PrivateCluster = &api.PrivateCluster{Enabled: helpers.PointerToBool(true)}
+	if _, err := GenerateKubeConfig(cs.Properties, "westus2"); err == nil {
+		t.Errorf("expected GenerateKubeConfig to reject masters colliding with the internal load balancer IP")
+	}
+	cs.Properties.MasterProfile.Count = 3
+	if _, err := GenerateKubeConfig(cs.Properties, "westus2"); err != nil {
+		t.Errorf("unexpected error from GenerateKubeConfig: %v", err)
+	}
+}
+
+func TestValidateFirstConsecutiveStaticIP(t *testing.T) {
+	cases := []struct {
+		name                     string
+		subnet                   string
+		firstConsecutiveStaticIP string
+		expectedErr              bool
+	}{
+		{
+			name:                     "default master addresses",
+			subnet:                   "10.240.0.0/16",
+			firstConsecutiveStaticIP: "10.240.255.5",
+		},
+		{
+			name:                     "no master subnet",
+			firstConsecutiveStaticIP: "10.240.255.5",
+		},
+		{
+			name:                     "first address of the subnet",
+			subnet:                   "10.240.0.16/28",
+			firstConsecutiveStaticIP: "10.240.0.16",
+		},
+		{
+			name:                     "past the end of the subnet",
+			subnet:                   "10.240.0.16/28",
+			firstConsecutiveStaticIP: "10.240.0.32",
+			expectedErr:              true,
+		},
+		{
+			name:                     "outside of the subnet",
+			subnet:                   "10.240.0.0/24",
+			firstConsecutiveStaticIP: "10.241.0.5",
+			expectedErr:              true,
+		},
+		{
+			name:                     "invalid address",
+			subnet:                   "10.240.0.0/24",
+			firstConsecutiveStaticIP: "10.240.0",
+			expectedErr:              true,
+		},
+		{
+			name:                     "invalid subnet",
+			subnet:                   "10.240.0.0",
+			firstConsecutiveStaticIP: "10.240.0.5",
+			expectedErr:              true,
+		},
+	}
+
+	for _, c := range cases {
+		properties := &api.Properties{
+			MasterProfile: &api.MasterProfile{
+				Subnet:                   c.subnet,
+				FirstConsecutiveStaticIP: c.firstConsecutiveStaticIP,
+			},
+		}
+		err := ValidateFirstConsecutiveStaticIP(properties)
+		if c.expectedErr && err == nil {
+			t.Errorf("%s: expected an error", c.name)
+		}
+		if !c.expectedErr && err != nil {
+			t.Errorf("%s: unexpected error: %s", c.name, err)
+		}
+	}
+
+	cs := api.CreateMockContainerService("testcluster", "1.11.6", 1, 1, false)
+	cs.Properties.MasterProfile.Subnet = "10.240.0.0/16"
+	cs.Properties.MasterProfile.FirstConsecutiveStaticIP = "10.239.255.239"
+	if _, err := GenerateKubeConfig(cs.Properties, "westus2"); err == nil {
+		t.Errorf("expected GenerateKubeConfig to reject a first master address outside of the master subnet")
+	}
+	cs.Properties.MasterProfile.FirstConsecutiveStaticIP = "10.240.255.5"
+	if _, err := GenerateKubeConfig(cs.Properties, "westus2"); err != nil {
+		t.Errorf("unexpected error from GenerateKubeConfig: %v", err)
+	}
+}
+
+func TestGetLoadBalancerProbesFastFailover(t *testing.T) {
+	probes, err := getLoadBalancerProbes([]LoadBalancerRule{
+		{Port: 80, NumberOfProbes: 1, ProbeIntervalInSeconds: MinLoadBalancerProbeIntervalInSeconds},
+		{Port: 443},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var emittedProbes []struct {
+		Properties struct {
+			IntervalInSeconds string `json:"intervalInSeconds"`
+			NumberOfProbes    string `json:"numberOfProbes"`
+		} `json:"properties"`
+	}
+	if err = json.Unmarshal([]byte("["+probes+"]"), &emittedProbes); err != nil {
+		t.Fatalf("couldn't unmarshal emitted probes: %v", err)
+	}
+	if fast := emittedProbes[0].Properties; fast.NumberOfProbes != "1" || fast.IntervalInSeconds != "5" {
+		t.Errorf("expected a single probe every 5 seconds, got %+v", fast)
+	}
+	if defaults := emittedProbes[1].Properties; defaults.NumberOfProbes != strconv.Itoa(DefaultLoadBalancerNumberOfProbes) ||
+		defaults.IntervalInSeconds != strconv.Itoa(DefaultLoadBalancerProbeIntervalInSeconds) {
+		t.Errorf("expected the default probe threshold, got %+v", defaults)
+	}
+
+	invalid := []LoadBalancerRule{
+		{Port: 80, NumberOfProbes: -1},
+		{Port: 80, NumberOfProbes: 1, ProbeIntervalInSeconds: 4},
+	}
+	for _, rule := range invalid {
+		if _, err = getLoadBalancerProbes([]LoadBalancerRule{rule}); err == nil {
+			t.Errorf("expected an error for %d probes every %d seconds", rule.NumberOfProbes, rule.ProbeIntervalInSeconds)
+		}
+	}
+}
+
+func TestGetNumberOfProbesMasterAndAgent(t *testing.T) {
+	// agent probes take their count from the rule spec
+	rules := []LoadBalancerRule{
+		{Port: 80},
+		{Port: 443, NumberOfProbes: 4},
+	}
+	probes, err := getLoadBalancerProbes(rules)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var emittedProbes []struct {
+		Properties struct {
+			NumberOfProbes string `json:"numberOfProbes"`
+		} `json:"properties"`
+	}
+	if err = json.Unmarshal([]byte("["+probes+"]"), &emittedProbes); err != nil {
+		t.Fatalf("couldn't unmarshal emitted probes: %v", err)
+	}
+	if emittedProbes[0].Properties.NumberOfProbes != strconv.Itoa(DefaultLoadBalancerNumberOfProbes) {
+		t.Errorf("expected the default agent probe count %d, got %s", DefaultLoadBalancerNumberOfProbes, emittedProbes[0].Properties.NumberOfProbes)
+	}
+	if emittedProbes[1].Properties.NumberOfProbes != "4" {
+		t.Errorf("expected agent probe count 4, got %s", emittedProbes[1].Properties.NumberOfProbes)
+	}
+	if _, err = getLoadBalancerProbes([]LoadBalancerRule{{Port: 80, NumberOfProbes: -1}}); err == nil {
+		t.Errorf("expected an error for a negative probe count")
+	}
+
+	// master probes take their count from the cluster configuration
+	for _, masterProbes := range []int{0, 3} {
+		cs := api.CreateMockContainerService("testcluster", "1.11.6", 3, 2, false)
+		cs.Properties.OrchestratorProfile.KubernetesConfig.MasterLbNumberOfProbes = masterProbes
+		cs.SetPropertiesDefaults(false, false)
+
+		templateGenerator, err := InitializeTemplateGenerator(Context{Translator: &i18n.Translator{}})
+		if err != nil {
+			t.Fatalf("Failed to initialize template generator: %v", err)
+		}
+		armTemplate, _, err := templateGenerator.GenerateTemplate(cs, DefaultGeneratorCode, TestAKSEngineVersion)
+		if err != nil {
+			t.Fatalf("unexpected error generating the template: %v", err)
+		}
+		expected := masterProbes
+		if expected == 0 {
+			expected = DefaultLoadBalancerNumberOfProbes
+		}
+		var generated struct {
+			Resources []struct {
+				Type       string `json:"type"`
+				Properties struct {
+					Probes []struct {
+						Properties struct {
+							NumberOfProbes string `json:"numberOfProbes"`
+						} `json:"properties"`
+					} `json:"probes"`
+				} `json:"properties"`
+			} `json:"resources"`
+		}
+		if err = json.Unmarshal([]byte(armTemplate), &generated); err != nil {
+			t.Fatalf("expected a valid JSON template, got %v", err)
+		}
+		masterProbeCount := 0
+		for _, resource := range generated.Resources {
+			if resource.Type != "Microsoft.Network/loadBalancers" {
+				continue
+			}
+			for _, probe := range resource.Properties.Probes {
+				masterProbeCount++
+				if probe.Properties.NumberOfProbes != strconv.Itoa(expected) {
+					t.Errorf("expected master probe count %d, got %s", expected, probe.Properties.NumberOfProbes)
+				}
+			}
+		}
+		if masterProbeCount == 0 {
+			t.Errorf("expected master load balancer probes in the template")
+		}
+	}
+}
+
+func TestGetEncodedCustomScriptFromStr(t *testing.T) {
+	small := "#!/bin/bash\necho hello\n"
+	large := strings.Repeat("echo provisioning the node\n", 100)
+
+	cases := []struct {
+		name             string
+		input            string
+		options          CustomDataEncodingOptions
+		expectedEncoding string
+	}{
+		{
+			name:             "default small",
+			input:            small,
+			expectedEncoding: CustomDataEncodingGzip,
+		},
+		{
+			name:             "small below the threshold",
+			input:            small,
+			options:          CustomDataEncodingOptions{UncompressedThreshold: 256},
+			expectedEncoding: CustomDataEncodingBase64,
+		},
+		{
+			name:             "large above the threshold",
+			input:            large,
+			options:          CustomDataEncodingOptions{UncompressedThreshold: 256},
+			expectedEncoding: CustomDataEncodingGzip,
+		},
+		{
+			name:             "large explicitly uncompressed",
+			input:            large,
+			options:          CustomDataEncodingOptions{Uncompressed: true},
+			expectedEncoding: CustomDataEncodingBase64,
+		},
+	}
+
+	for _, c := range cases {
+		encoded, encoding, err := getEncodedCustomScriptFromStr(c.input, c.options)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.name, err)
+		}
+		if encoding != c.expectedEncoding {
+			t.Errorf("%s: expected encoding %s, got %s", c.name, c.expectedEncoding, encoding)
+		}
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			t.Fatalf("%s: expected valid base64, got %v", c.name, err)
+		}
+		if encoding == CustomDataEncodingGzip {
+			reader, err := gzip.NewReader(bytes.NewReader(decoded))
+			if err != nil {
+				t.Fatalf("%s: expected a gzip stream, got %v", c.name, err)
+			}
+			if decoded, err = ioutil.ReadAll(reader); err != nil {
+				t.Fatalf("%s: unexpected error decompressing: %v", c.name, err)
+			}
+		}
+		if string(decoded) != c.input {
+			t.Errorf("%s: expected the decoded content to match the input", c.name)
+		}
+	}
+}
+
+func TestMinifyCustomScript(t *testing.T) {
+	script := `#!/bin/bash
+# provisions the node
+
+set -e
+
+# greet with the hash kept in strings
+GREETING="hello # not a comment"
+echo "$GREETING" # trailing comments are kept
+echo ${#GREETING}
+
+
+cat <<EOF
+# kept in the here-document
+
+done
+EOF
+MESSAGE="a multiline
+# string"
+echo "$MESSAGE"
+`
+	expected := `#!/bin/bash
+set -e
+GREETING="hello # not a comment"
+echo "$GREETING" # trailing comments are kept
+echo ${#GREETING}
+cat <<EOF
+# kept in the here-document
+
+done
+EOF
+MESSAGE="a multiline
+# string"
+echo "$MESSAGE"
+`
+	minified := minifyCustomScript(script)
+	if minified != expected {
+		t.Fatalf("expected minified script:\n%s\ngot:\n%s", expected, minified)
+	}
+
+	raw, err := exec.Command("/bin/bash", "-c", script).Output()
+	if err != nil {
+		t.Fatalf("unexpected error running the script: %v", err)
+	}
+	out, err := exec.Command("/bin/bash", "-c", minified).Output()
+	if err != nil {
+		t.Fatalf("unexpected error running the minified script: %v", err)
+	}
+	if string(out) != string(raw) {
+		t.Errorf("expected the minified script to print:\n%s\ngot:\n%s", raw, out)
+	}
+
+	yaml := `#cloud-config
+
+# files written at boot
+write_files:
+- path: /etc/motd
+  content: |
+    # welcome
+
+    to the node
+# the owner
+  owner: root
+`
+	expectedYaml := `write_files:
+- path: /etc/motd
+  content: |
+    # welcome
+
+    to the node
+  owner: root
+`
+	if minifiedYaml := minifyCustomScript(yaml); minifiedYaml != expectedYaml {
+		t.Errorf("expected minified yaml:\n%s\ngot:\n%s", expectedYaml, minifiedYaml)
+	}
+
+	rawEncoded, _, err := getEncodedCustomScriptFromStr(script, CustomDataEncodingOptions{Uncompressed: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	minifiedEncoded, _, err := getEncodedCustomScriptFromStr(script, CustomDataEncodingOptions{Uncompressed: true, Minify: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if decoded, _ := base64.StdEncoding.DecodeString(minifiedEncoded); string(decoded) != expected {
+		t.Errorf("expected the minified script to be encoded, got:\n%s", decoded)
+	}
+	if len(minifiedEncoded) >= len(rawEncoded) {
+		t.Errorf("expected the minified custom data to be smaller than the raw %d bytes, got %d", len(rawEncoded), len(minifiedEncoded))
+	}
+}
+
+func TestGetContainerAddonsStringResourceLimits(t *testing.T) {
+	cases := []struct {
+		name        string
+		container   api.KubernetesContainerSpec
+		expectedErr string
+	}{
+		{
+			name: "requests within limits",
+			container: api.KubernetesContainerSpec{
+				Name:           DefaultTillerAddonName,
+				CPURequests:    "50m",
+				MemoryRequests: "150Mi",
+				CPULimits:      "0.05",
+				MemoryLimits:   "1Gi",
+			},
+		},
+		{
+			name: "inverted CPU",
+			container: api.KubernetesContainerSpec{
+				Name:        DefaultTillerAddonName,
+				CPURequests: "1",
+				CPULimits:   "500m",
+			},
+			expectedErr: "addon tiller container tiller requests CPU 1, more than its limit of 500m",
+		},
+		{
+			name: "inverted memory",
+			container: api.KubernetesContainerSpec{
+				Name:           DefaultTillerAddonName,
+				MemoryRequests: "2Gi",
+				MemoryLimits:   "1024Mi",
+			},
+			expectedErr: "addon tiller container tiller requests memory 2Gi, more than its limit of 1024Mi",
+		},
+		{
+			name: "invalid quantity",
+			container: api.KubernetesContainerSpec{
+				Name:        DefaultTillerAddonName,
+				CPURequests: "lots",
+				CPULimits:   "1",
+			},
+			expectedErr: "addon tiller container tiller has an invalid CPU request lots",
+		},
+	}
+
+	for _, c := range cases {
+		cs := api.CreateMockContainerService("testcluster", "1.11.6", 1, 2, false)
+		cs.Properties.OrchestratorProfile.KubernetesConfig.Addons = []api.KubernetesAddon{
+			{
+				Name:       DefaultTillerAddonName,
+				Enabled:    helpers.PointerToBool(true),
+				Containers: []api.KubernetesContainerSpec{c.container},
+			},
+		}
+		cs.SetPropertiesDefaults(false, false)
+
+		_, err := getContainerAddonsString(cs.Properties, "k8s/containeraddons", nil, false)
+		if c.expectedErr == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", c.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), c.expectedErr) {
+			t.Errorf("%s: expected error %q, got %v", c.name, c.expectedErr, err)
+		}
+	}
+}
+
+func TestGetContainerAddonsStringExecuteError(t *testing.T) {
+	cs := api.CreateMockContainerService("testcluster", "1.11.6", 1, 2, false)
+	cs.Properties.OrchestratorProfile.KubernetesConfig.Addons = []api.KubernetesAddon{
+		{
+			Name:    DefaultTillerAddonName,
+			Enabled: helpers.PointerToBool(true),
+		},
+	}
+	cs.SetPropertiesDefaults(false, false)
+	// the tiller template looks its container up by name, which fails once renamed
+	addons := cs.Properties.OrchestratorProfile.KubernetesConfig.Addons
+	for i := range addons {
+		if addons[i].Name == DefaultTillerAddonName {
+			addons[i].Containers = []api.KubernetesContainerSpec{{Name: "renamed"}}
+		}
+	}
+
+	_, err := getContainerAddonsString(cs.Properties, "k8s/containeraddons", nil, false)
+	expectedErr := "error executing the tiller addon template"
+	if err == nil || !strings.Contains(err.Error(), expectedErr) {
+		t.Errorf("expected error %q, got %v", expectedErr, err)
+	}
+}
+
+func TestGetSecurityRulesServiceTagSource(t *testing.T) {
+	cases := []struct {
+		name                string
+		source              string
+		expectedSource      string
+		expectedDescription string
+		expectedErr         bool
+	}{
+		{
+			name:                "default source",
+			expectedSource:      "Internet",
+			expectedDescription: "Allow traffic from the Internet to port 443",
+		},
+		{
+			name:                "service tag source",
+			source:              "AzureLoadBalancer",
+			expectedSource:      "AzureLoadBalancer",
+			expectedDescription: "Allow traffic from AzureLoadBalancer to port 443",
+		},
+		{
+			name:                "regional service tag source",
+			source:              "Storage.WestUS",
+			expectedSource:      "Storage.WestUS",
+			expectedDescription: "Allow traffic from Storage.WestUS to port 443",
+		},
+		{
+			name:        "address prefix source",
+			source:      "10.0.0.0/8",
+			expectedErr: true,
+		},
+	}
+
+	for _, c := range cases {
+		rules, err := getSecurityRulesWithOptions([]int{443}, SecurityRuleOptions{Source: c.source})
+		if c.expectedErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.name, err)
+		}
+
+		var emitted []struct {
+			Properties struct {
+				Description         string `json:"description"`
+				SourceAddressPrefix string `json:"sourceAddressPrefix"`
+			} `json:"properties"`
+		}
+		if err = json.Unmarshal([]byte("["+rules+"]"), &emitted); err != nil {
+			t.Fatalf("%s: expected valid JSON, got %v:\n%s", c.name, err, rules)
+		}
+		if emitted[0].Properties.SourceAddressPrefix != c.expectedSource {
+			t.Errorf("%s: expected source %s, got %s", c.name, c.expectedSource, emitted[0].Properties.SourceAddressPrefix)
+		}
+		if emitted[0].Properties.Description != c.expectedDescription {
+			t.Errorf("%s: expected description %q, got %q", c.name, c.expectedDescription, emitted[0].Properties.Description)
+		}
+	}
+}
+
+func TestGetSecurityRulesDualProtocol(t *testing.T) {
+	options := SecurityRuleOptions{
+		BasePriority: 300,
+		Protocols:    map[int][]string{53: {"tcp", "udp"}},
+	}
+	rules, err := GetPlannedSecurityRulesWithOptions([]int{53, 443}, options)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []SecurityRule{
+		{Name: "Allow_53_Tcp", Port: 53, Priority: 300, Source: "Internet", Access: "Allow", Protocol: "Tcp"},
+		{Name: "Allow_53_Udp", Port: 53, Priority: 301, Source: "Internet", Access: "Allow", Protocol: "Udp"},
+		{Name: "Allow_443", Port: 443, Priority: 302, Source: "Internet", Access: "Allow"},
+	}
+	if !reflect.DeepEqual(rules, expected) {
+		t.Fatalf("expected rules %+v, got %+v", expected, rules)
+	}
+
+	securityRules, err := getSecurityRulesWithOptions([]int{53, 443}, options)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var emitted []struct {
+		Name       string `json:"name"`
+		Properties struct {
+			Priority int    `json:"priority"`
+			Protocol string `json:"protocol"`
+		} `json:"properties"`
+	}
+	if err = json.Unmarshal([]byte("["+securityRules+"]"), &emitted); err != nil {
+		t.Fatalf("couldn't unmarshal emitted security rules: %v", err)
+	}
+	for i, protocol := range []string{"Tcp", "Udp", "*"} {
+		if emitted[i].Properties.Protocol != protocol {
+			t.Errorf("expected rule %s to allow protocol %s, got %s", emitted[i].Name, protocol, emitted[i].Properties.Protocol)
+		}
+	}
+
+	invalid := []map[int][]string{
+		{53: {"icmp"}},
+		{53: {"Tcp", "tcp"}},
+	}
+	for _, protocols := range invalid {
+		if _, err = GetPlannedSecurityRulesWithOptions([]int{53}, SecurityRuleOptions{Protocols: protocols}); err == nil {
+			t.Errorf("expected an error for protocols %v", protocols)
+		}
+	}
+}
+
+func TestJoinSecurityRulesSortedByPriority(t *testing.T) {
+	rules := []SecurityRule{
+		{Name: "Allow_443", Port: 443, Priority: 302, Source: "Internet", Access: "Allow"},
+		{Name: "Allow_80", Port: 80, Priority: 120, Source: "Internet", Access: "Allow"},
+		{Name: "Allow_53_Udp", Port: 53, Priority: 200, Source: "Internet", Access: "Allow", Protocol: "Udp"},
+		{Name: "Allow_53_Tcp", Port: 53, Priority: 200, Source: "Internet", Access: "Allow", Protocol: "Tcp"},
+	}
+	planned := make([]SecurityRule, len(rules))
+	copy(planned, rules)
+
+	var emitted []struct {
+		Name       string `json:"name"`
+		Properties struct {
+			Priority int `json:"priority"`
+		} `json:"properties"`
+	}
+	if err := json.Unmarshal([]byte("["+joinSecurityRules(rules)+"]"), &emitted); err != nil {
+		t.Fatalf("couldn't unmarshal emitted security rules: %v", err)
+	}
+	expected := []string{"Allow_80", "Allow_53_Tcp", "Allow_53_Udp", "Allow_443"}
+	if len(emitted) != len(expected) {
+		t.Fatalf("expected %d rules, got %d", len(expected), len(emitted))
+	}
+	for i, name := range expected {
+		if emitted[i].Name != name {
+			t.Errorf("expected rule %d to be %s, got %s with priority %d", i, name, emitted[i].Name, emitted[i].Properties.Priority)
+		}
+	}
+	if !reflect.DeepEqual(rules, planned) {
+		t.Errorf("expected the planned rules to be left in their order, got %+v", rules)
+	}
+
+	// the emitted order doesn't depend on the planned order
+	reversed := make([]SecurityRule, 0, len(rules))
+	for i := len(rules) - 1; i >= 0; i-- {
+		reversed = append(reversed, rules[i])
+	}
+	if joinSecurityRules(reversed) != joinSecurityRules(rules) {
+		t.Errorf("expected the same output for the rules in any order")
+	}
+}
+
+func TestGetSecurityRulesIntraCluster(t *testing.T) {
+	options := SecurityRuleOptions{AllowIntraCluster: true}
+	rules, err := GetPlannedSecurityRulesWithOptions([]int{443}, options)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(rules) != 2 || rules[0].Name != "Allow_IntraCluster" || rules[0].Priority != DefaultSecurityRuleBasePriority || rules[1].Priority != DefaultSecurityRuleBasePriority+1 {
+		t.Fatalf("expected the intra-cluster rule to take the first priority ahead of the exposed ports, got %+v", rules)
+	}
+
+	securityRules, err := getSecurityRulesWithOptions([]int{443}, options)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	type emittedRule struct {
+		Name       string `json:"name"`
+		Properties struct {
+			Access                   string `json:"access"`
+			DestinationAddressPrefix string `json:"destinationAddressPrefix"`
+			DestinationPortRange     string `json:"destinationPortRange"`
+			Priority                 int    `json:"priority"`
+			Protocol                 string `json:"protocol"`
+			SourceAddressPrefix      string `json:"sourceAddressPrefix"`
+		} `json:"properties"`
+	}
+	var emitted []emittedRule
+	if err = json.Unmarshal([]byte("["+securityRules+"]"), &emitted); err != nil {
+		t.Fatalf("couldn't unmarshal emitted security rules: %v", err)
+	}
+	intraCluster := emitted[0].Properties
+	if intraCluster.SourceAddressPrefix != "VirtualNetwork" || intraCluster.DestinationAddressPrefix != "VirtualNetwork" ||
+		intraCluster.DestinationPortRange != "*" || intraCluster.Protocol != "*" || intraCluster.Access != "Allow" {
+		t.Errorf("expected a rule allowing any traffic within the VNET, got %+v", intraCluster)
+	}
+	exposed := emitted[1].Properties
+	if exposed.SourceAddressPrefix != "Internet" || exposed.DestinationAddressPrefix != "*" || exposed.DestinationPortRange != "443" {
+		t.Errorf("expected the exposed port rule to be unchanged, got %+v", exposed)
+	}
+
+	rules, err = GetPlannedSecurityRulesWithOptions([]int{443}, SecurityRuleOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(rules) != 1 || rules[0].Name != "Allow_443" {
+		t.Errorf("expected no intra-cluster rule by default, got %+v", rules)
+	}
+}
+
+func TestGetMasterSubnet(t *testing.T) {
+	cases := []struct {
+		name           string
+		cidr           string
+		masterCount    int
+		expectedSubnet string
+		expectedErr    bool
+	}{
+		{
+			name:           "default master subnet",
+			cidr:           "10.240.255.0/24",
+			masterCount:    3,
+			expectedSubnet: "10.240.255.0/24",
+		},
+		{
+			name:           "host bits are cleared",
+			cidr:           "10.240.255.5/24",
+			masterCount:    5,
+			expectedSubnet: "10.240.255.0/24",
+		},
+		{
+			name:           "smallest subnet fitting the internal load balancer",
+			cidr:           "10.240.255.0/28",
+			masterCount:    5,
+			expectedSubnet: "10.240.255.0/28",
+		},
+		{
+			name:        "too small for the internal load balancer offset",
+			cidr:        "10.240.255.0/29",
+			masterCount: 1,
+			expectedErr: true,
+		},
+		{
+			name:        "invalid CIDR",
+			cidr:        "10.240.255.0",
+			masterCount: 1,
+			expectedErr: true,
+		},
+		{
+			name:        "no masters",
+			cidr:        "10.240.255.0/24",
+			masterCount: 0,
+			expectedErr: true,
+		},
+	}
+
+	for _, c := range cases {
+		subnet, err := GetMasterSubnet(c.cidr, c.masterCount)
+		if c.expectedErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", c.name, err)
+			continue
+		}
+		if subnet != c.expectedSubnet {
+			t.Errorf("%s: expected subnet %s, got %s", c.name, c.expectedSubnet, subnet)
+		}
+	}
+}
+
+func TestGetContainerAddonsStringDeniedAddons(t *testing.T) {
+	cs := api.CreateMockContainerService("testcluster", "1.11.6", 1, 2, false)
+	cs.Properties.OrchestratorProfile.KubernetesConfig.Addons = []api.KubernetesAddon{
+		{
+			Name:    DefaultTillerAddonName,
+			Enabled: helpers.PointerToBool(true),
+		},
+	}
+	cs.SetPropertiesDefaults(false, false)
+
+	addons, err := getContainerAddonsString(cs.Properties, "k8s/containeraddons", nil, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(addons, "kube-tiller-deployment.yaml") {
+		t.Fatalf("expected the tiller addon without a deny-list, got: %s", addons)
+	}
+
+	addons, err = getContainerAddonsString(cs.Properties, "k8s/containeraddons", []string{DefaultTillerAddonName}, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Contains(addons, "kube-tiller-deployment.yaml") {
+		t.Errorf("expected the denied tiller addon to be excluded, got: %s", addons)
+	}
+	if !strings.Contains(addons, "kube-metrics-server-deployment.yaml") {
+		t.Errorf("expected the other addons to render, got: %s", addons)
+	}
+}
+
+func TestGetTemplateFiles(t *testing.T) {
+	cs := api.CreateMockContainerService("testcluster", "1.11.6", 3, 2, false)
+	files, err := GetTemplateFiles(cs)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []string{
+		agentOutputs, agentParams, masterOutputs, iaasOutputs, masterParams, windowsParams,
+		kubernetesBaseFile, kubernetesAgentResourcesVMAS, kubernetesAgentResourcesVMSS, kubernetesAgentVars,
+		kubernetesMasterResourcesVMAS, kubernetesMasterResourcesVMSS, kubernetesMasterVars, kubernetesParams,
+		kubernetesWinAgentVars, kubernetesWinAgentVarsVMSS,
+	}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("expected template files %v, got %v", expected, files)
+	}
+	for _, file := range files {
+		if _, err = Asset(file); err != nil {
+			t.Errorf("expected template file %s to be an asset: %v", file, err)
+		}
+	}
+
+	// the returned list is a copy
+	files[0] = "modified"
+	if commonTemplateFiles[0] != agentOutputs {
+		t.Errorf("expected the package template file list to be left unchanged")
+	}
+
+	cs.Properties.OrchestratorProfile.OrchestratorType = "DCOS"
+	if _, err = GetTemplateFiles(cs); err == nil {
+		t.Errorf("expected an error for an orchestrator without template files")
+	}
+	cs.Properties.OrchestratorProfile = nil
+	if _, err = GetTemplateFiles(cs); err == nil {
+		t.Errorf("expected an error for a nil orchestrator profile")
+	}
+}
+
+func TestRenderTemplateFiles(t *testing.T) {
+	cases := []struct {
+		name                  string
+		windowsPool           bool
+		windowsVMSS           bool
+		expectedPoolFiles     []string
+		expectedWindowsParams bool
+		unexpectedPoolFiles   []string
+	}{
+		{
+			name:                "linux pools",
+			expectedPoolFiles:   []string{agentParams, kubernetesAgentVars, kubernetesAgentResourcesVMAS, agentOutputs},
+			unexpectedPoolFiles: []string{kubernetesWinAgentVars, kubernetesWinAgentVarsVMSS},
+		},
+		{
+			name:                  "windows pools",
+			windowsPool:           true,
+			expectedPoolFiles:     []string{agentParams, kubernetesAgentVars, kubernetesWinAgentVars, agentOutputs},
+			expectedWindowsParams: true,
+			unexpectedPoolFiles:   []string{kubernetesAgentResourcesVMAS, kubernetesWinAgentVarsVMSS},
+		},
+		{
+			name:                  "windows scale set pools",
+			windowsPool:           true,
+			windowsVMSS:           true,
+			expectedPoolFiles:     []string{agentParams, kubernetesAgentVars, kubernetesWinAgentVarsVMSS, agentOutputs},
+			expectedWindowsParams: true,
+			unexpectedPoolFiles:   []string{kubernetesAgentResourcesVMSS, kubernetesWinAgentVars},
+		},
+	}
+
+	templateGenerator, err := InitializeTemplateGenerator(Context{Translator: &i18n.Translator{}})
+	if err != nil {
+		t.Fatalf("Failed to initialize template generator: %v", err)
+	}
+
+	for _, c := range cases {
+		cs := api.CreateMockContainerService("testcluster", "1.11.6", 3, 2, false)
+		if c.windowsPool {
+			cs.Properties.WindowsProfile = &api.WindowsProfile{AdminUsername: "azureuser", AdminPassword: "password"}
+			for _, profile := range cs.Properties.AgentPoolProfiles {
+				profile.OSType = api.Windows
+				if c.windowsVMSS {
+					profile.AvailabilityProfile = api.VirtualMachineScaleSets
+				}
+			}
+		}
+		cs.SetPropertiesDefaults(false, false)
+
+		rendered, err := templateGenerator.RenderTemplateFiles(cs)
+		if err != nil {
+			t.Fatalf("%s: unexpected error rendering the template files: %v", c.name, err)
+		}
+
+		expected := []string{masterParams, kubernetesParams, kubernetesMasterVars, kubernetesMasterResourcesVMAS, masterOutputs, iaasOutputs}
+		if c.expectedWindowsParams {
+			expected = append(expected, windowsParams)
+		}
+		for _, profile := range cs.Properties.AgentPoolProfiles {
+			for _, name := range c.expectedPoolFiles {
+				expected = append(expected, name+"/"+profile.Name)
+			}
+			for _, name := range c.unexpectedPoolFiles {
+				if _, ok := rendered[name+"/"+profile.Name]; ok {
+					t.Errorf("%s: expected %s not to render for pool %s", c.name, name, profile.Name)
+				}
+			}
+		}
+		if len(rendered) != len(expected) {
+			t.Errorf("%s: expected %d rendered files, got %d", c.name, len(expected), len(rendered))
+		}
+		for _, key := range expected {
+			output, ok := rendered[key]
+			// the agent outputs only apply to availability sets and are empty for scale sets
+			if !ok || (strings.TrimSpace(output) == "" && !(c.windowsVMSS && strings.HasPrefix(key, agentOutputs))) {
+				t.Errorf("%s: expected %s to render", c.name, key)
+			}
+		}
+		if _, ok := rendered[windowsParams]; ok && !c.expectedWindowsParams {
+			t.Errorf("%s: expected the Windows parameters to be left out of a Linux cluster", c.name)
+		}
+	}
+}
+
+func TestGetVNETSubnetsPrivateEndpointNetworkPolicies(t *testing.T) {
+	properties := &api.Properties{
+		AgentPoolProfiles: []*api.AgentPoolProfile{
+			{Name: "agentpool1"},
+			{Name: "endpoints"},
+			{Name: "agentpool2"},
+		},
+	}
+	subnetsJSON := getVNETSubnetsWithOptions(properties, VNETSubnetOptions{
+		MasterPrivateEndpointNetworkPolicies: helpers.PointerToBool(true),
+		PrivateEndpointNetworkPolicies: map[string]bool{
+			"endpoints":  false,
+			"agentpool2": true,
+		},
+	})
+
+	var subnets []struct {
+		Name       string `json:"name"`
+		Properties struct {
+			PrivateEndpointNetworkPolicies *string `json:"privateEndpointNetworkPolicies"`
+		} `json:"properties"`
+	}
+	if err := json.Unmarshal([]byte("["+subnetsJSON+"]"), &subnets); err != nil {
+		t.Fatalf("expected valid JSON, got %v:\n%s", err, subnetsJSON)
+	}
+	expected := []string{"Enabled", "", "Disabled", "Enabled"}
+	for i, policies := range expected {
+		emitted := subnets[i].Properties.PrivateEndpointNetworkPolicies
+		if policies == "" && emitted != nil {
+			t.Errorf("expected subnet %s to leave the private endpoint network policies unset, got %s", subnets[i].Name, *emitted)
+		}
+		if policies != "" && (emitted == nil || *emitted != policies) {
+			t.Errorf("expected subnet %s private endpoint network policies %s, got %v", subnets[i].Name, policies, emitted)
+		}
+	}
+}
+
+func TestGetVNETSubnetsNATGateway(t *testing.T) {
+	natGatewayID := "/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg/providers/Microsoft.Network/natGateways/egress"
+	cases := []struct {
+		name         string
+		natGatewayID string
+	}{
+		{
+			name: "no NAT gateway",
+		},
+		{
+			name:         "NAT gateway",
+			natGatewayID: natGatewayID,
+		},
+	}
+
+	for _, c := range cases {
+		properties := &api.Properties{
+			MasterProfile: &api.MasterProfile{NATGatewayID: c.natGatewayID},
+			AgentPoolProfiles: []*api.AgentPoolProfile{
+				{Name: "agentpool1"},
+				{Name: "agentpool2"},
+			},
+		}
+		subnetsJSON := getVNETSubnets(properties, true)
+
+		var subnets []struct {
+			Name       string `json:"name"`
+			Properties struct {
+				NATGateway *struct {
+					ID string `json:"id"`
+				} `json:"natGateway"`
+				NetworkSecurityGroup *struct {
+					ID string `json:"id"`
+				} `json:"networkSecurityGroup"`
+			} `json:"properties"`
+		}
+		if err := json.Unmarshal([]byte("["+subnetsJSON+"]"), &subnets); err != nil {
+			t.Fatalf("%s: expected valid JSON, got %v:\n%s", c.name, err, subnetsJSON)
+		}
+		if len(subnets) != 3 {
+			t.Fatalf("%s: expected 3 subnets, got %d", c.name, len(subnets))
+		}
+		for _, subnet := range subnets {
+			emitted := subnet.Properties.NATGateway
+			if c.natGatewayID == "" && emitted != nil {
+				t.Errorf("%s: expected subnet %s to leave the NAT gateway unset, got %s", c.name, subnet.Name, emitted.ID)
+			}
+			if c.natGatewayID != "" && (emitted == nil || emitted.ID != c.natGatewayID) {
+				t.Errorf("%s: expected subnet %s NAT gateway %s, got %v", c.name, subnet.Name, c.natGatewayID, emitted)
+			}
+		}
+		if subnets[1].Properties.NetworkSecurityGroup == nil {
+			t.Errorf("%s: expected subnet %s to keep its NSG", c.name, subnets[1].Name)
+		}
+	}
+}
+
+func TestGenerateTemplateNATGateway(t *testing.T) {
+	natGatewayID := "/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg/providers/Microsoft.Network/natGateways/egress"
+	cases := []struct {
+		name                string
+		availabilityProfile string
+		subnetCount         int
+	}{
+		{
+			name:                "availability set masters",
+			availabilityProfile: api.AvailabilitySet,
+			subnetCount:         1,
+		},
+		{
+			name:                "scale set masters",
+			availabilityProfile: api.VirtualMachineScaleSets,
+			subnetCount:         2,
+		},
+	}
+
+	for _, c := range cases {
+		cs := api.CreateMockContainerService("testcluster", "1.11.6", 3, 2, false)
+		cs.Properties.MasterProfile.AvailabilityProfile = c.availabilityProfile
+		cs.Properties.MasterProfile.NATGatewayID = natGatewayID
+		for _, profile := range cs.Properties.AgentPoolProfiles {
+			profile.AvailabilityProfile = api.VirtualMachineScaleSets
+		}
+		cs.Properties.OrchestratorProfile.KubernetesConfig.LoadBalancerSku = "Standard"
+		cs.Properties.OrchestratorProfile.KubernetesConfig.UseManagedIdentity = true
+		cs.Properties.OrchestratorProfile.KubernetesConfig.UserAssignedID = "clusterIdentity"
+		cs.SetPropertiesDefaults(false, false)
+
+		templateGenerator, err := InitializeTemplateGenerator(Context{
+			Translator: &i18n.Translator{},
+		})
+		if err != nil {
+			t.Fatalf("%s: failed to initialize template generator: %v", c.name, err)
+		}
+		templateRaw, _, err := templateGenerator.GenerateTemplate(cs, DefaultGeneratorCode, TestAKSEngineVersion)
+		if err != nil {
+			t.Fatalf("%s: unexpected error generating the template: %v", c.name, err)
+		}
+
+		if count := strings.Count(templateRaw, `"natGateway": {`); count != c.subnetCount {
+			t.Errorf("%s: expected the NAT gateway on %d subnets, got %d", c.name, c.subnetCount, count)
+		}
+		if !strings.Contains(templateRaw, `"id": "`+natGatewayID+`"`) {
+			t.Errorf("%s: expected the template to reference the NAT gateway %s", c.name, natGatewayID)
+		}
+		if !strings.Contains(templateRaw, `"apiVersionNetwork": "2019-02-01"`) {
+			t.Errorf("%s: expected a network API version supporting NAT gateways", c.name)
+		}
+	}
+}
+
+func TestValidateKubernetesSubnets(t *testing.T) {
+	cases := []struct {
+		name        string
+		vnetCidr    string
+		subnet      string
+		agentSubnet string
+		agentCount  int
+		expectedErr bool
+	}{
+		{
+			name:        "default address space",
+			vnetCidr:    "10.0.0.0/8",
+			subnet:      "10.240.0.0/16",
+			agentSubnet: "10.240.0.0/16",
+			agentCount:  2,
+		},
+		{
+			name:        "separate address space",
+			vnetCidr:    "10.240.0.0/14",
+			subnet:      "10.240.255.0/24",
+			agentSubnet: "10.241.0.0/16",
+			agentCount:  2,
+		},
+		{
+			name:        "agent subnet overlapping the pod CIDRs",
+			subnet:      "10.240.255.0/24",
+			agentSubnet: "10.244.0.0/20",
+			agentCount:  2,
+			expectedErr: true,
+		},
+		{
+			name:        "too many nodes",
+			subnet:      "10.240.255.0/24",
+			agentSubnet: "10.241.0.0/16",
+			agentCount:  300,
+			expectedErr: true,
+		},
+	}
+
+	for _, c := range cases {
+		properties := &api.Properties{
+			MasterProfile: &api.MasterProfile{
+				Count:    1,
+				VnetCidr: c.vnetCidr,
+				Subnet:   c.subnet,
+			},
+			AgentPoolProfiles: []*api.AgentPoolProfile{
+				{
+					Name:   "windowspool",
+					Count:  c.agentCount,
+					OSType: api.Windows,
+					Subnet: c.agentSubnet,
+				},
+			},
+		}
+		err := ValidateKubernetesSubnets(properties, false)
+		if c.expectedErr && err == nil {
+			t.Errorf("%s: expected an error", c.name)
+		}
+		if !c.expectedErr && err != nil {
+			t.Errorf("%s: unexpected error: %s", c.name, err)
+		}
+		if _, subnetsErr := getKubernetesSubnets(properties, false); (subnetsErr == nil) != (err == nil) {
+			t.Errorf("%s: expected getKubernetesSubnets to fail with the validation", c.name)
+		}
+	}
+}
@@ -5,6 +5,7 @@ package engine
 
 import (
 	"fmt"
+	"regexp"
 
 	"github.com/Azure/aks-engine/pkg/api"
 	"github.com/Azure/aks-engine/pkg/helpers"
@@ -85,7 +86,9 @@ func getParameters(cs *api.ContainerService, generatorCode string, aksengineVers
 
 	// Kubernetes Parameters
 	if properties.OrchestratorProfile.IsKubernetes() {
-		assignKubernetesParameters(properties, parametersMap, cloudSpecConfig, generatorCode)
+		if err := assignKubernetesParameters(properties, parametersMap, cloudSpecConfig, generatorCode); err != nil {
+			return nil, err
+		}
 	}
 
 	// Agent parameters
@@ -121,7 +124,9 @@ func getParameters(cs *api.ContainerService, generatorCode string, aksengineVers
 	// Windows parameters
 	if properties.HasWindows() {
 		addValue(parametersMap, "windowsAdminUsername", properties.WindowsProfile.AdminUsername)
-		addSecret(parametersMap, "windowsAdminPassword", properties.WindowsProfile.AdminPassword, false)
+		if err := addSecret(parametersMap, "windowsAdminPassword", properties.WindowsProfile.AdminPassword, false); err != nil {
+			return nil, err
+		}
 		if properties.WindowsProfile.ImageVersion != "" {
 			addValue(parametersMap, "agentWindowsVersion", properties.WindowsProfile.ImageVersion)
 		}
@@ -172,14 +177,45 @@ func getParameters(cs *api.ContainerService, generatorCode string, aksengineVers
 
 	for _, extension := range properties.ExtensionProfiles {
 		if extension.ExtensionParametersKeyVaultRef != nil {
-			addKeyvaultReference(parametersMap, fmt.Sprintf("%sParameters", extension.Name),
+			addKeyvaultReference(parametersMap, getExtensionParametersName(extension.Name),
 				extension.ExtensionParametersKeyVaultRef.VaultID,
 				extension.ExtensionParametersKeyVaultRef.SecretName,
 				extension.ExtensionParametersKeyVaultRef.SecretVersion)
 		} else {
-			addValue(parametersMap, fmt.Sprintf("%sParameters", extension.Name), extension.ExtensionParameters)
+			addValue(parametersMap, getExtensionParametersName(extension.Name), extension.ExtensionParameters)
 		}
 	}
 
 	return parametersMap, nil
 }
+
+// RedactedParameterValue replaces the values of secret parameters in RedactParameters
+const RedactedParameterValue = "REDACTED"
+
+// secretParameterRe matches the names of the parameters holding secrets, and the certificates
+// that are passed alongside them
+var secretParameterRe = regexp.MustCompile(`(?i)(privatekey|certificate|password|secret|encryptionkey)\d*$`)
+
+// RedactParameters returns a copy of the template parameters that is safe to log, with the values of
+// secret parameters replaced by RedactedParameterValue. KeyVault references are preserved since they
+// only point at the secret
+func RedactParameters(parameters map[string]interface{}) map[string]interface{} {
+	redacted := make(map[string]interface{}, len(parameters))
+	for name, parameter := range parameters {
+		redacted[name] = parameter
+		if !secretParameterRe.MatchString(name) {
+			continue
+		}
+		switch p := parameter.(type) {
+		case paramsMap:
+			if _, ok := p["value"]; ok {
+				redacted[name] = paramsMap{"value": RedactedParameterValue}
+			}
+		case map[string]interface{}:
+			if _, ok := p["value"]; ok {
+				redacted[name] = map[string]interface{}{"value": RedactedParameterValue}
+			}
+		}
+	}
+	return redacted
+}
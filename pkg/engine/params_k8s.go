@@ -16,7 +16,7 @@ import (
 )
 
 func assignKubernetesParameters(properties *api.Properties, parametersMap paramsMap,
-	cloudSpecConfig api.AzureEnvironmentSpecConfig, generatorCode string) {
+	cloudSpecConfig api.AzureEnvironmentSpecConfig, generatorCode string) error {
 	addValue(parametersMap, "generatorCode", generatorCode)
 
 	orchestratorProfile := properties.OrchestratorProfile
@@ -202,24 +202,36 @@ func assignKubernetesParameters(properties *api.Properties, parametersMap params
 
 		certificateProfile := properties.CertificateProfile
 		if certificateProfile != nil {
-			addSecret(parametersMap, "apiServerCertificate", certificateProfile.APIServerCertificate, true)
-			addSecret(parametersMap, "apiServerPrivateKey", certificateProfile.APIServerPrivateKey, true)
-			addSecret(parametersMap, "caCertificate", certificateProfile.CaCertificate, true)
-			addSecret(parametersMap, "caPrivateKey", certificateProfile.CaPrivateKey, true)
-			addSecret(parametersMap, "clientCertificate", certificateProfile.ClientCertificate, true)
-			addSecret(parametersMap, "clientPrivateKey", certificateProfile.ClientPrivateKey, true)
-			addSecret(parametersMap, "kubeConfigCertificate", certificateProfile.KubeConfigCertificate, true)
-			addSecret(parametersMap, "kubeConfigPrivateKey", certificateProfile.KubeConfigPrivateKey, true)
+			type secretParameter struct {
+				name  string
+				value string
+			}
+			secrets := []secretParameter{
+				{"apiServerCertificate", certificateProfile.APIServerCertificate},
+				{"apiServerPrivateKey", certificateProfile.APIServerPrivateKey},
+				{"caCertificate", certificateProfile.CaCertificate},
+				{"caPrivateKey", certificateProfile.CaPrivateKey},
+				{"clientCertificate", certificateProfile.ClientCertificate},
+				{"clientPrivateKey", certificateProfile.ClientPrivateKey},
+				{"kubeConfigCertificate", certificateProfile.KubeConfigCertificate},
+				{"kubeConfigPrivateKey", certificateProfile.KubeConfigPrivateKey},
+			}
 			if properties.MasterProfile != nil {
-				addSecret(parametersMap, "etcdServerCertificate", certificateProfile.EtcdServerCertificate, true)
-				addSecret(parametersMap, "etcdServerPrivateKey", certificateProfile.EtcdServerPrivateKey, true)
-				addSecret(parametersMap, "etcdClientCertificate", certificateProfile.EtcdClientCertificate, true)
-				addSecret(parametersMap, "etcdClientPrivateKey", certificateProfile.EtcdClientPrivateKey, true)
+				secrets = append(secrets,
+					secretParameter{"etcdServerCertificate", certificateProfile.EtcdServerCertificate},
+					secretParameter{"etcdServerPrivateKey", certificateProfile.EtcdServerPrivateKey},
+					secretParameter{"etcdClientCertificate", certificateProfile.EtcdClientCertificate},
+					secretParameter{"etcdClientPrivateKey", certificateProfile.EtcdClientPrivateKey})
 				for i, pc := range certificateProfile.EtcdPeerCertificates {
-					addSecret(parametersMap, "etcdPeerCertificate"+strconv.Itoa(i), pc, true)
+					secrets = append(secrets, secretParameter{"etcdPeerCertificate" + strconv.Itoa(i), pc})
 				}
 				for i, pk := range certificateProfile.EtcdPeerPrivateKeys {
-					addSecret(parametersMap, "etcdPeerPrivateKey"+strconv.Itoa(i), pk, true)
+					secrets = append(secrets, secretParameter{"etcdPeerPrivateKey" + strconv.Itoa(i), pk})
+				}
+			}
+			for _, secret := range secrets {
+				if err := addSecret(parametersMap, secret.name, secret.value, true); err != nil {
+					return err
 				}
 			}
 		}
@@ -242,4 +254,5 @@ func assignKubernetesParameters(properties *api.Properties, parametersMap params
 			}
 		}
 	}
+	return nil
 }
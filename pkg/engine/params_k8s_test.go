@@ -40,7 +40,9 @@ func TestAssignKubernetesParameters(t *testing.T) {
 		containerService.Location = "eastus"
 		cloudSpecConfig := containerService.GetCloudSpecConfig()
 		containerService.SetPropertiesDefaults(false, false)
-		assignKubernetesParameters(containerService.Properties, parametersMap, cloudSpecConfig, DefaultGeneratorCode)
+		if err = assignKubernetesParameters(containerService.Properties, parametersMap, cloudSpecConfig, DefaultGeneratorCode); err != nil {
+			t.Errorf("should not get error when assigning parameters: %v", err)
+		}
 		for k, v := range parametersMap {
 			switch val := v.(paramsMap)["value"].(type) {
 			case *bool:
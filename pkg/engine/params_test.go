@@ -4,10 +4,13 @@
 package engine
 
 import (
+	"encoding/json"
 	"path"
+	"strings"
 	"testing"
 
 	"github.com/Azure/aks-engine/pkg/api"
+	"github.com/Azure/aks-engine/pkg/helpers"
 	"github.com/Azure/aks-engine/pkg/i18n"
 	"github.com/leonelquinteros/gotext"
 )
@@ -50,3 +53,164 @@ func TestAssignParameters(t *testing.T) {
 		}
 	}
 }
+
+func TestRedactParameters(t *testing.T) {
+	parametersMap := paramsMap{}
+	for _, secret := range []struct {
+		name   string
+		value  string
+		encode bool
+	}{
+		{"caPrivateKey", "private key", true},
+		{"etcdPeerPrivateKey0", "peer private key", true},
+		{"windowsAdminPassword", "password", false},
+		{"clientCertificate", "/subscriptions/SUB/resourceGroups/RG/providers/Microsoft.KeyVault/vaults/KV/secrets/clientCert/1", true},
+	} {
+		if err := addSecret(parametersMap, secret.name, secret.value, secret.encode); err != nil {
+			t.Fatalf("unexpected error adding %s: %v", secret.name, err)
+		}
+	}
+	addValue(parametersMap, "servicePrincipalClientSecret", "client secret")
+	addKeyvaultReference(parametersMap, "servicePrincipalClientId", "vault", "name", "")
+	addValue(parametersMap, "masterEndpointDNSNamePrefix", "testcluster")
+
+	redacted := RedactParameters(parametersMap)
+
+	for _, name := range []string{"caPrivateKey", "etcdPeerPrivateKey0", "windowsAdminPassword", "servicePrincipalClientSecret"} {
+		if value := redacted[name].(paramsMap)["value"]; value != RedactedParameterValue {
+			t.Errorf("expected %s to be redacted, got %v", name, value)
+		}
+	}
+	if _, ok := redacted["clientCertificate"].(paramsMap)["reference"].(*KeyVaultRef); !ok {
+		t.Errorf("expected the clientCertificate KeyVault reference to be preserved, got %v", redacted["clientCertificate"])
+	}
+	if value := redacted["masterEndpointDNSNamePrefix"].(paramsMap)["value"]; value != "testcluster" {
+		t.Errorf("expected masterEndpointDNSNamePrefix to be preserved, got %v", value)
+	}
+	if value := parametersMap["windowsAdminPassword"].(paramsMap)["value"]; value != "password" {
+		t.Errorf("expected the original parameters to be unchanged, got %v", value)
+	}
+
+	// parameters read back from the generated JSON are redacted the same way
+	var parameters map[string]interface{}
+	if err := json.Unmarshal([]byte(`{"caPrivateKey":{"value":"private key"},"location":{"value":"westus2"}}`), &parameters); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	redacted = RedactParameters(parameters)
+	if value := redacted["caPrivateKey"].(map[string]interface{})["value"]; value != RedactedParameterValue {
+		t.Errorf("expected caPrivateKey to be redacted, got %v", value)
+	}
+	if value := redacted["location"].(map[string]interface{})["value"]; value != "westus2" {
+		t.Errorf("expected location to be preserved, got %v", value)
+	}
+}
+
+func TestCanonicalizeParameters(t *testing.T) {
+	vaultID := "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.KeyVault/vaults/vault"
+
+	first := paramsMap{}
+	addValue(first, "masterVMSize", "Standard_D2_v2")
+	addValue(first, "agentpool1Count", 3)
+	addValue(first, "maxPods", 110)
+	if err := addSecret(first, "servicePrincipalClientSecret", vaultID+"/secrets/secret/1", false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the same parameters added in another order, with the KeyVault reference as parsed JSON
+	second := paramsMap{}
+	if err := json.Unmarshal([]byte(`{"servicePrincipalClientSecret": {"reference": {"secretVersion": "1", "secretName": "secret", "keyVault": {"id": "`+vaultID+`"}}}}`), &second); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	addValue(second, "maxPods", 110)
+	addValue(second, "agentpool1Count", 3)
+	addValue(second, "masterVMSize", "Standard_D2_v2")
+
+	firstRaw, err := helpers.JSONMarshal(first, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	secondRaw, err := helpers.JSONMarshal(second, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	firstCanonical, err := CanonicalizeParameters(string(firstRaw))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	secondCanonical, err := CanonicalizeParameters(string(secondRaw))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if firstCanonical != secondCanonical {
+		t.Fatalf("expected equal parameters to serialize identically, got:\n%s\nand:\n%s", firstCanonical, secondCanonical)
+	}
+
+	expectedOrder := []string{`"agentpool1Count"`, `"masterVMSize"`, `"maxPods"`, `"servicePrincipalClientSecret"`, `"keyVault"`, `"secretName"`, `"secretVersion"`}
+	last := -1
+	for _, key := range expectedOrder {
+		index := strings.Index(firstCanonical, key)
+		if index <= last {
+			t.Fatalf("expected the keys in the order %v, got:\n%s", expectedOrder, firstCanonical)
+		}
+		last = index
+	}
+
+	recanonicalized, err := CanonicalizeParameters(firstCanonical)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if recanonicalized != firstCanonical {
+		t.Errorf("expected canonical parameters to be unchanged by canonicalizing them again, got:\n%s", recanonicalized)
+	}
+	if _, err = CanonicalizeParameters("{"); err == nil {
+		t.Errorf("expected an error for invalid JSON")
+	}
+}
+
+func TestAddSecretKeyvaultSecretName(t *testing.T) {
+	cases := []struct {
+		name        string
+		secretName  string
+		expectError bool
+	}{
+		{
+			name:       "letters digits and dashes",
+			secretName: "client-Cert-01",
+		},
+		{
+			name:        "underscore",
+			secretName:  "client_cert",
+			expectError: true,
+		},
+		{
+			name:        "dot",
+			secretName:  "client.cert",
+			expectError: true,
+		},
+		{
+			name:        "too long",
+			secretName:  strings.Repeat("a", 128),
+			expectError: true,
+		},
+	}
+
+	for _, c := range cases {
+		parametersMap := paramsMap{}
+		path := "/subscriptions/SUB/resourceGroups/RG/providers/Microsoft.KeyVault/vaults/KV/secrets/" + c.secretName + "/1"
+		err := addSecret(parametersMap, "clientCertificate", path, true)
+		if c.expectError {
+			if err == nil {
+				t.Errorf("%s: expected an error for secret name %s", c.name, c.secretName)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+			continue
+		}
+		reference, ok := parametersMap["clientCertificate"].(paramsMap)["reference"].(*KeyVaultRef)
+		if !ok || reference.SecretName != c.secretName {
+			t.Errorf("%s: expected a KeyVault reference to secret %s, got %v", c.name, c.secretName, parametersMap["clientCertificate"])
+		}
+	}
+}
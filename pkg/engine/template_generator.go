@@ -6,6 +6,7 @@ package engine
 import (
 	"archive/zip"
 	"bytes"
+	"context"
 	"encoding/base64"
 	"fmt"
 	"runtime/debug"
@@ -25,12 +26,51 @@ import (
 // TemplateGenerator represents the object that performs the template generation.
 type TemplateGenerator struct {
 	Translator *i18n.Translator
+	// CloudInitUser is an additional sudo user cloud-init provisions the nodes with alongside the
+	// linux admin user, none if empty
+	CloudInitUser string
+	// ForbidMutableAddonImages fails generation when an addon image has no tag or is tagged latest
+	ForbidMutableAddonImages bool
+	// AllowedExtensionSchemes restricts the extension root URL schemes, non-https root URLs are only logged if empty
+	AllowedExtensionSchemes []string
+	// DeniedAddons are container addons left out of the custom data even if enabled
+	DeniedAddons []string
+	// InlineExtensionScriptMaxBytes embeds the preprovision extension scripts of at most this size in
+	// the custom data rather than downloading them at boot. Disabled if zero
+	InlineExtensionScriptMaxBytes int
+	// Proxy is the HTTP(S) proxy configured in the custom data of the nodes, none if empty
+	Proxy ProxyConfig
+	// MinifyCustomData strips the comment lines and blank lines of the provisioning scripts
+	MinifyCustomData bool
+	// ExtensionFetchPolicy retries and bounds the requests fetching the extension resources
+	ExtensionFetchPolicy ExtensionFetchPolicy
+	// CombineAddonManifests writes the container addons to a single multi-document YAML
+	CombineAddonManifests bool
+	// CustomDataEncoding selects how the container addon manifests are encoded in the custom data
+	CustomDataEncoding CustomDataEncodingOptions
+	// ValidateTemplateReferences fails generation when the template references a variable or
+	// parameter it does not declare
+	ValidateTemplateReferences bool
+	// ctx bounds the remote requests made while generating, see GenerateTemplateWithContext
+	ctx context.Context
 }
 
 // InitializeTemplateGenerator creates a new template generator object
 func InitializeTemplateGenerator(ctx Context) (*TemplateGenerator, error) {
 	t := &TemplateGenerator{
-		Translator: ctx.Translator,
+		Translator:               ctx.Translator,
+		CloudInitUser:            ctx.CloudInitUser,
+		ForbidMutableAddonImages: ctx.ForbidMutableAddonImages,
+		AllowedExtensionSchemes:  ctx.AllowedExtensionSchemes,
+		DeniedAddons:             ctx.DeniedAddons,
+
+		InlineExtensionScriptMaxBytes: ctx.InlineExtensionScriptMaxBytes,
+		Proxy:                         ctx.Proxy,
+		MinifyCustomData:              ctx.MinifyCustomData,
+		ExtensionFetchPolicy:          ctx.ExtensionFetchPolicy,
+		CombineAddonManifests:         ctx.CombineAddonManifests,
+		CustomDataEncoding:            ctx.CustomDataEncoding,
+		ValidateTemplateReferences:    ctx.ValidateTemplateReferences,
 	}
 
 	if err := t.verifyFiles(); err != nil {
@@ -42,6 +82,17 @@ func InitializeTemplateGenerator(ctx Context) (*TemplateGenerator, error) {
 
 // GenerateTemplate generates the template from the API Model
 func (t *TemplateGenerator) GenerateTemplate(containerService *api.ContainerService, generatorCode string, aksengineVersion string) (templateRaw string, parametersRaw string, err error) {
+	return t.GenerateTemplateWithContext(context.Background(), containerService, generatorCode, aksengineVersion)
+}
+
+// GenerateTemplateWithContext generates the template from the API Model, aborting the
+// extension downloads when ctx is cancelled or its deadline expires
+func (t *TemplateGenerator) GenerateTemplateWithContext(ctx context.Context, containerService *api.ContainerService, generatorCode string, aksengineVersion string) (templateRaw string, parametersRaw string, err error) {
+	// generate from a copy so that concurrent generations do not share a context
+	g := *t
+	g.ctx = withExtensionFetchPolicy(ctx, t.ExtensionFetchPolicy)
+	t = &g
+
 	// named return values are used in order to set err in case of a panic
 	templateRaw = ""
 	parametersRaw = ""
@@ -91,16 +142,63 @@ func (t *TemplateGenerator) GenerateTemplate(containerService *api.ContainerServ
 		return templateRaw, parametersRaw, errors.New("Invalid distro")
 	}
 
+	if err = ValidateAgentPoolSubnets(properties); err != nil {
+		return templateRaw, parametersRaw, err
+	}
+
+	if len(t.AllowedExtensionSchemes) > 0 {
+		if err = ValidateExtensionRootURLs(properties, t.AllowedExtensionSchemes); err != nil {
+			return templateRaw, parametersRaw, err
+		}
+	} else if e := ValidateExtensionRootURLs(properties, []string{"https"}); e != nil {
+		log.Warnf("%s, extensions fetched over insecure schemes may be tampered with", e)
+	}
+
+	if err = ValidateExtensionSingleOrAll(properties); err != nil {
+		return templateRaw, parametersRaw, err
+	}
+
+	securityRuleCount := GetSecurityRuleCount(properties)
+	if err = validateSecurityRuleCount(securityRuleCount); err != nil {
+		return templateRaw, parametersRaw, err
+	}
+	if securityRuleCount > SecurityRuleCountWarningThreshold {
+		log.Warnf("the cluster NSG has %d rules, close to the %d Azure accepts", securityRuleCount, MaxSecurityRulesPerNSG)
+	}
+
+	if unused := GetUnusedExtensionProfiles(properties); len(unused) > 0 {
+		log.Warnf("extension profiles %s are not referenced by the master or any agent pool and will not be deployed", strings.Join(unused, ", "))
+	}
+
+	if t.ForbidMutableAddonImages {
+		if err = ValidateAddonImageTags(properties); err != nil {
+			return templateRaw, parametersRaw, err
+		}
+	}
+
 	var b bytes.Buffer
 	if err = templ.ExecuteTemplate(&b, baseFile, properties); err != nil {
 		return templateRaw, parametersRaw, err
 	}
 	templateRaw = b.String()
 
+	if t.ValidateTemplateReferences {
+		var defined TemplateReferences
+		if defined, err = getDefinedTemplateReferences(templateRaw); err != nil {
+			return templateRaw, parametersRaw, err
+		}
+		if err = validateTemplateReferences(templateRaw, defined); err != nil {
+			return templateRaw, parametersRaw, err
+		}
+	}
+
 	var parametersMap paramsMap
 	if parametersMap, err = getParameters(containerService, generatorCode, aksengineVersion); err != nil {
 		return templateRaw, parametersRaw, err
 	}
+	if err = validateExtensionParameters(properties, parametersMap); err != nil {
+		return templateRaw, parametersRaw, err
+	}
 
 	var parameterBytes []byte
 	if parameterBytes, err = helpers.JSONMarshal(parametersMap, false); err != nil {
@@ -111,6 +209,117 @@ func (t *TemplateGenerator) GenerateTemplate(containerService *api.ContainerServ
 	return templateRaw, parametersRaw, err
 }
 
+// RenderTemplateFiles renders the common and Kubernetes template files for the container service
+// one at a time and returns the output keyed by file name, which helps finding the file at fault
+// when the generation fails. The files rendered once per agent pool are keyed "<file>/<pool name>",
+// the files the cluster does not use, such as the Windows parameters of a Linux cluster, are left
+// out, and so is the base file, which only composes the others. The error reports every file that
+// failed to render
+func (t *TemplateGenerator) RenderTemplateFiles(containerService *api.ContainerService) (map[string]string, error) {
+	properties := containerService.Properties
+	type templateFile struct {
+		key  string
+		name string
+		data interface{}
+	}
+	var files []templateFile
+	for _, profile := range properties.AgentPoolProfiles {
+		for _, name := range []string{agentParams, kubernetesAgentVars, getAgentPoolResourcesTemplateFile(profile), agentOutputs} {
+			files = append(files, templateFile{key: name + "/" + profile.Name, name: name, data: profile})
+		}
+	}
+	if properties.HasWindows() {
+		files = append(files, templateFile{key: windowsParams, name: windowsParams})
+	}
+	clusterFiles := []string{masterParams, kubernetesParams, kubernetesMasterVars, iaasOutputs}
+	if !properties.IsHostedMasterProfile() {
+		masterResources := kubernetesMasterResourcesVMAS
+		if properties.MasterProfile != nil && properties.MasterProfile.IsVirtualMachineScaleSets() {
+			masterResources = kubernetesMasterResourcesVMSS
+		}
+		clusterFiles = append(clusterFiles, masterResources, masterOutputs)
+	}
+	for _, name := range clusterFiles {
+		files = append(files, templateFile{key: name, name: name, data: properties})
+	}
+
+	rendered := make(map[string]string, len(files))
+	var failures []string
+	for _, file := range files {
+		output, err := t.getSingleLine(file.name, containerService, file.data)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", file.key, err))
+			continue
+		}
+		rendered[file.key] = output
+	}
+	if len(failures) > 0 {
+		return rendered, errors.Errorf("%d template files failed to render: %s", len(failures), strings.Join(failures, "; "))
+	}
+	return rendered, nil
+}
+
+// wrapAsParameter returns the reference to the ARM parameter s concatenated into a template string
+func wrapAsParameter(s string) string {
+	return fmt.Sprintf("',parameters('%s'),'", s)
+}
+
+// getAgentPoolResourcesTemplateFile returns the resources template file the base file renders for
+// the agent pool profile, picked by its OS and availability profile. The Linux and Windows pools
+// share the agent vars, only their resources differ
+func getAgentPoolResourcesTemplateFile(profile *api.AgentPoolProfile) string {
+	switch {
+	case profile.IsWindows() && profile.IsVirtualMachineScaleSets():
+		return kubernetesWinAgentVarsVMSS
+	case profile.IsWindows():
+		return kubernetesWinAgentVars
+	case profile.IsVirtualMachineScaleSets():
+		return kubernetesAgentResourcesVMSS
+	default:
+		return kubernetesAgentResourcesVMAS
+	}
+}
+
+// getPreprovisionScriptCommands returns the commands running the preprovision extension of the agent
+// pool profile, or of the master profile if nil. The extension script is embedded in the commands
+// if it is no larger than InlineExtensionScriptMaxBytes, and downloaded at boot otherwise
+func (t *TemplateGenerator) getPreprovisionScriptCommands(cs *api.ContainerService, profile *api.AgentPoolProfile) (string, error) {
+	extension := cs.Properties.MasterProfile.PreprovisionExtension
+	if profile != nil {
+		extension = profile.PreprovisionExtension
+	}
+	if t.InlineExtensionScriptMaxBytes > 0 {
+		extensionProfile := getExtensionProfile(extension, cs.Properties.ExtensionProfiles)
+		if extensionProfile == nil {
+			return "", errors.Errorf("%s extension referenced was not found in the extension profile", extension.Name)
+		}
+		script, err := getExtensionResource(t.context(), extensionProfile.RootURL, extensionProfile.ExtensionsDir, extensionProfile.Name, extensionProfile.Version, extensionProfile.Script, extensionProfile.URLQuery)
+		if err != nil {
+			return "", err
+		}
+		if len(script) <= t.InlineExtensionScriptMaxBytes {
+			if profile != nil && profile.OSType == api.Windows {
+				return makeInlineWindowsExtensionScriptCommands(extensionProfile, script), nil
+			}
+			return makeInlineExtensionScriptCommands(extensionProfile, script), nil
+		}
+		log.Warnf("script %s of extension %s is %d bytes, larger than the %d bytes inlined, it will be downloaded at boot",
+			extensionProfile.Script, extensionProfile.Name, len(script), t.InlineExtensionScriptMaxBytes)
+	}
+	if profile == nil {
+		return makeMasterExtensionScriptCommands(cs), nil
+	}
+	return makeAgentExtensionScriptCommands(cs, profile), nil
+}
+
+// context returns the context of the generation in progress
+func (t *TemplateGenerator) context() context.Context {
+	if t.ctx == nil {
+		return context.Background()
+	}
+	return t.ctx
+}
+
 func (t *TemplateGenerator) verifyFiles() error {
 	allFiles := commonTemplateFiles
 	allFiles = append(allFiles, kubernetesTemplateFiles...)
@@ -166,7 +375,10 @@ func (t *TemplateGenerator) getMasterCustomData(cs *api.ContainerService, textFi
 		customFilesReader,
 		"MASTER_CUSTOM_FILES_PLACEHOLDER")
 
-	addonStr := getContainerAddonsString(cs.Properties, "k8s/containeraddons")
+	addonStr, err := getContainerAddonsStringWithOptions(cs.Properties, "k8s/containeraddons", t.DeniedAddons, t.CombineAddonManifests, t.CustomDataEncoding)
+	if err != nil {
+		panic(err)
+	}
 
 	str = strings.Replace(str, "MASTER_CONTAINER_ADDONS_PLACEHOLDER", addonStr, -1)
 
@@ -285,6 +497,24 @@ func (t *TemplateGenerator) getTemplateFuncMap(cs *api.ContainerService) templat
 		"RequireRouteTable": func() bool {
 			return cs.Properties.OrchestratorProfile.RequireRouteTable()
 		},
+		"GetInternalLbIdleTimeoutInMinutes": func() int {
+			kubernetesConfig := cs.Properties.OrchestratorProfile.KubernetesConfig
+			if kubernetesConfig == nil || kubernetesConfig.InternalLbIdleTimeoutInMinutes == 0 {
+				return DefaultLoadBalancerIdleTimeoutInMinutes
+			}
+			return kubernetesConfig.InternalLbIdleTimeoutInMinutes
+		},
+		"GetMasterLbNumberOfProbes": func() int {
+			kubernetesConfig := cs.Properties.OrchestratorProfile.KubernetesConfig
+			if kubernetesConfig == nil || kubernetesConfig.MasterLbNumberOfProbes == 0 {
+				return DefaultLoadBalancerNumberOfProbes
+			}
+			return kubernetesConfig.MasterLbNumberOfProbes
+		},
+		"DisableBGPRoutePropagation": func() bool {
+			kubernetesConfig := cs.Properties.OrchestratorProfile.KubernetesConfig
+			return kubernetesConfig != nil && helpers.IsTrueBoolPointer(kubernetesConfig.DisableBGPRoutePropagation)
+		},
 
 		"IsPrivateCluster": func() bool {
 			if !cs.Properties.OrchestratorProfile.IsKubernetes() {
@@ -361,7 +591,7 @@ func (t *TemplateGenerator) getTemplateFuncMap(cs *api.ContainerService) templat
 		"GetProbes": func(ports []int) string {
 			return getProbes(ports)
 		},
-		"GetSecurityRules": func(ports []int) string {
+		"GetSecurityRules": func(ports []int) (string, error) {
 			return getSecurityRules(ports)
 		},
 		"GetUniqueNameSuffix": func() string {
@@ -373,7 +603,7 @@ func (t *TemplateGenerator) getTemplateFuncMap(cs *api.ContainerService) templat
 		"GetVNETSubnets": func(addNSG bool) string {
 			return getVNETSubnets(cs.Properties, addNSG)
 		},
-		"GetDataDisks": func(profile *api.AgentPoolProfile) string {
+		"GetDataDisks": func(profile *api.AgentPoolProfile) (string, error) {
 			return getDataDisks(profile)
 		},
 		"HasBootstrap": func() bool {
@@ -406,6 +636,15 @@ func (t *TemplateGenerator) getTemplateFuncMap(cs *api.ContainerService) templat
 		"GetDefaultInternalLbStaticIPOffset": func() int {
 			return DefaultInternalLbStaticIPOffset
 		},
+		"GetMaxVMsPerPool": func() int {
+			return MaxVMsPerPool
+		},
+		"GetMaxVMsPerStorageAccount": func() int {
+			return MaxVMsPerStorageAccount
+		},
+		"GetDataStorageAccountPrefixSeed": func() int {
+			return DataStorageAccountPrefixSeed
+		},
 		"GetKubernetesMasterCustomData": func(profile *api.Properties) string {
 			str := t.getMasterCustomData(cs, kubernetesMasterCustomDataYaml, profile)
 			return str
@@ -436,55 +675,62 @@ func (t *TemplateGenerator) getTemplateFuncMap(cs *api.ContainerService) templat
 
 			return fmt.Sprintf("\"customData\": \"[base64(concat('%s'))]\",", str)
 		},
-		"WriteLinkedTemplatesForExtensions": func() string {
-			extensions := getLinkedTemplatesForExtensions(cs.Properties)
-			return extensions
+		"WriteLinkedTemplatesForExtensions": func() (string, error) {
+			return getLinkedTemplatesForExtensions(t.context(), cs.Properties)
 		},
 		"GetKubernetesB64Provision": func() string {
-			return getBase64CustomScript(kubernetesCustomScript)
+			return getBase64CustomScript(kubernetesCustomScript, t.MinifyCustomData)
 		},
 		"GetKubernetesB64ProvisionSource": func() string {
-			return getBase64CustomScript(kubernetesProvisionSourceScript)
+			return getBase64CustomScript(kubernetesProvisionSourceScript, t.MinifyCustomData)
 		},
 		"GetKubernetesB64HealthMonitorScript": func() string {
-			return getBase64CustomScript(kubernetesHealthMonitorScript)
+			return getBase64CustomScript(kubernetesHealthMonitorScript, t.MinifyCustomData)
 		},
 		"GetKubernetesB64Installs": func() string {
-			return getBase64CustomScript(kubernetesInstalls)
+			return getBase64CustomScript(kubernetesInstalls, t.MinifyCustomData)
 		},
 		"GetKubernetesB64Configs": func() string {
-			return getBase64CustomScript(kubernetesConfigurations)
+			return getBase64CustomScript(kubernetesConfigurations, t.MinifyCustomData)
 		},
 		"GetKubernetesB64Mountetcd": func() string {
-			return getBase64CustomScript(kubernetesMountetcd)
+			return getBase64CustomScript(kubernetesMountetcd, t.MinifyCustomData)
 		},
 		"GetKubernetesB64CustomSearchDomainsScript": func() string {
-			return getBase64CustomScript(kubernetesCustomSearchDomainsScript)
+			return getBase64CustomScript(kubernetesCustomSearchDomainsScript, t.MinifyCustomData)
 		},
 		"GetKubernetesB64GenerateProxyCerts": func() string {
-			return getBase64CustomScript(kubernetesMasterGenerateProxyCertsScript)
+			return getBase64CustomScript(kubernetesMasterGenerateProxyCertsScript, t.MinifyCustomData)
 		},
 		"GetB64sshdConfig": func() string {
-			return getBase64CustomScript(sshdConfig)
+			return getBase64CustomScript(sshdConfig, t.MinifyCustomData)
 		},
 		"GetB64systemConf": func() string {
-			return getBase64CustomScript(systemConf)
+			return getBase64CustomScript(systemConf, t.MinifyCustomData)
 		},
-		"GetKubernetesMasterPreprovisionYaml": func() string {
+		"GetKubernetesMasterPreprovisionYaml": func() (string, error) {
 			str := ""
 			if cs.Properties.MasterProfile.PreprovisionExtension != nil {
+				cmd, err := t.getPreprovisionScriptCommands(cs, nil)
+				if err != nil {
+					return "", err
+				}
 				str += "\n"
-				str += makeMasterExtensionScriptCommands(cs)
+				str += cmd
 			}
-			return str
+			return str, nil
 		},
-		"GetKubernetesAgentPreprovisionYaml": func(profile *api.AgentPoolProfile) string {
+		"GetKubernetesAgentPreprovisionYaml": func(profile *api.AgentPoolProfile) (string, error) {
 			str := ""
 			if profile.PreprovisionExtension != nil {
+				cmd, err := t.getPreprovisionScriptCommands(cs, profile)
+				if err != nil {
+					return "", err
+				}
 				str += "\n"
-				str += makeAgentExtensionScriptCommands(cs, profile)
+				str += cmd
 			}
-			return str
+			return str, nil
 		},
 		"GetLocation": func() string {
 			return cs.Location
@@ -532,15 +778,18 @@ func (t *TemplateGenerator) getTemplateFuncMap(cs *api.ContainerService) templat
 			preprovisionCmd := ""
 
 			if profile.PreprovisionExtension != nil {
-				preprovisionCmd = makeAgentExtensionScriptCommands(cs, profile)
+				preprovisionCmd, e = t.getPreprovisionScriptCommands(cs, profile)
+				if e != nil {
+					panic(e)
+				}
 			}
 
 			str = strings.Replace(str, "PREPROVISION_EXTENSION", escapeSingleLine(strings.TrimSpace(preprovisionCmd)), -1)
 
 			return fmt.Sprintf("\"customData\": \"[base64(concat('%s'))]\",", str)
 		},
-		"GetKubernetesSubnets": func() string {
-			return getKubernetesSubnets(cs.Properties)
+		"GetKubernetesSubnets": func() (string, error) {
+			return getKubernetesSubnets(cs.Properties, false)
 		},
 		"GetKubernetesPodStartIndex": func() string {
 			return fmt.Sprintf("%d", getKubernetesPodStartIndex(cs.Properties))
@@ -548,15 +797,37 @@ func (t *TemplateGenerator) getTemplateFuncMap(cs *api.ContainerService) templat
 		"WrapAsVariable": func(s string) string {
 			return fmt.Sprintf("',variables('%s'),'", s)
 		},
-		"WrapAsParameter": func(s string) string {
-			return fmt.Sprintf("',parameters('%s'),'", s)
-		},
+		"WrapAsParameter": wrapAsParameter,
 		"WrapAsParameterObject": func(o, p string) string {
 			return fmt.Sprintf("',parameters('%s').%s,'", o, p)
 		},
 		"WrapAsVerbatim": func(s string) string {
 			return fmt.Sprintf("',%s,'", s)
 		},
+		"HasCloudInitUser": func() bool {
+			return t.CloudInitUser != ""
+		},
+		"GetCloudInitUser": func() (string, error) {
+			if t.CloudInitUser == "" {
+				return wrapAsParameter("linuxAdminUsername"), nil
+			}
+			if !linuxUserNameRegex.MatchString(t.CloudInitUser) {
+				return "", errors.Errorf("cloud-init user %s is not a valid linux user name", t.CloudInitUser)
+			}
+			return t.CloudInitUser, nil
+		},
+		"HasProxyConfig": func() bool {
+			return t.Proxy.IsSet()
+		},
+		"GetProxyEnvironmentVariables": func() ([]string, error) {
+			return getProxyEnvironmentVariables(t.Proxy)
+		},
+		"GetContainerRuntime": func() string {
+			return getContainerRuntime(cs)
+		},
+		"GetAgentPoolContainerRuntime": func(profile *api.AgentPoolProfile) string {
+			return getAgentPoolContainerRuntime(cs, profile)
+		},
 		"AnyAgentUsesAvailabilitySets": func() bool {
 			for _, agentProfile := range cs.Properties.AgentPoolProfiles {
 				if agentProfile.IsAvailabilitySets() {
@@ -584,6 +855,9 @@ func (t *TemplateGenerator) getTemplateFuncMap(cs *api.ContainerService) templat
 		"IsNVIDIADevicePluginEnabled": func() bool {
 			return cs.Properties.IsNVIDIADevicePluginEnabled()
 		},
+		"IsAcceleratedNetworkingEnabled": func(profile *api.AgentPoolProfile) (bool, error) {
+			return getAcceleratedNetworkingEnabled(profile)
+		},
 		"IsNSeriesSKU": func(profile *api.AgentPoolProfile) bool {
 			return common.IsNvidiaEnabledSKU(profile.VMSize)
 		},
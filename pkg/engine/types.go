@@ -4,6 +4,9 @@
 package engine
 
 import (
+	"strings"
+	"time"
+
 	"github.com/Azure/aks-engine/pkg/api"
 	"github.com/Azure/aks-engine/pkg/api/vlabs"
 	"github.com/Azure/aks-engine/pkg/i18n"
@@ -55,6 +58,66 @@ type AzureOSImageConfig struct {
 // Context represents the object that is passed to the package
 type Context struct {
 	Translator *i18n.Translator
+	// CloudInitUser is an additional sudo user custom data provisions alongside the linux admin user
+	CloudInitUser string
+	// ForbidMutableAddonImages fails generation when an addon image has no tag or is tagged latest
+	ForbidMutableAddonImages bool
+	// AllowedExtensionSchemes restricts the extension root URL schemes, non-https root URLs are only logged if empty
+	AllowedExtensionSchemes []string
+	// DeniedAddons are container addons left out of the custom data even if enabled
+	DeniedAddons []string
+	// Proxy is the HTTP(S) proxy the provisioning scripts and container runtime of the nodes use, none if empty
+	Proxy ProxyConfig
+	// InlineExtensionScriptMaxBytes embeds the preprovision extension scripts of at most this size in
+	// the custom data, fetched at generation time, rather than downloading them at boot. Disabled if zero
+	InlineExtensionScriptMaxBytes int
+	// MinifyCustomData strips the comment lines and blank lines of the provisioning scripts before
+	// compressing them into the custom data
+	MinifyCustomData bool
+	// ExtensionFetchPolicy retries and bounds the requests fetching the extension resources
+	ExtensionFetchPolicy ExtensionFetchPolicy
+	// CombineAddonManifests writes the container addons to a single multi-document YAML, applied
+	// at once, rather than a file per addon
+	CombineAddonManifests bool
+	// CustomDataEncoding selects how the container addon manifests are encoded in the custom data,
+	// gzipped base64 if zero
+	CustomDataEncoding CustomDataEncodingOptions
+	// ValidateTemplateReferences fails generation when the template references a variable or
+	// parameter it does not declare
+	ValidateTemplateReferences bool
+}
+
+// ExtensionFetchPolicy retries and bounds the requests fetching extension resources, such as
+// supported-orchestrators.json and template-link.json. The zero value makes a single unbounded attempt
+type ExtensionFetchPolicy struct {
+	// Retries is the number of times a request failing with a network error, a 5xx or a 429 status is retried
+	Retries int
+	// Backoff is the delay before the first retry, doubled before each following one,
+	// DefaultExtensionFetchBackoff if zero
+	Backoff time.Duration
+	// Timeout bounds each attempt, unbounded if zero
+	Timeout time.Duration
+}
+
+// ProxyConfig is the HTTP(S) proxy configured on the nodes through their custom data
+type ProxyConfig struct {
+	// HTTPProxy is the proxy URL for http requests
+	HTTPProxy string
+	// HTTPSProxy is the proxy URL for https requests
+	HTTPSProxy string
+	// NoProxy are the hosts, domains and CIDRs reached without the proxy
+	NoProxy []string
+}
+
+// IsSet returns true if any proxy setting is configured
+func (p ProxyConfig) IsSet() bool {
+	return p.HTTPProxy != "" || p.HTTPSProxy != "" || len(p.NoProxy) > 0
+}
+
+// TemplateReferences are the ARM variable and parameter names a template defines
+type TemplateReferences struct {
+	Variables  []string
+	Parameters []string
 }
 
 // KeyVaultID represents a KeyVault instance on Azure
@@ -69,4 +132,207 @@ type KeyVaultRef struct {
 	SecretVersion string     `json:"secretVersion,omitempty"`
 }
 
+// SecurityRule describes an inbound network security group rule generated for an exposed port
+type SecurityRule struct {
+	Name string
+	// Port is the destination port the rule allows, any port if zero
+	Port     int
+	Priority int
+	Source   string
+	Access   string
+	// Destination is the destination address prefix or service tag, any destination if empty
+	Destination string
+	// Protocol is the protocol the rule allows, Tcp or Udp, any protocol if empty
+	Protocol string
+	// Description defaults to a description of the allowed traffic when empty
+	Description string
+}
+
+// SecurityRuleOptions customizes the NSG rules generated for exposed ports
+type SecurityRuleOptions struct {
+	// BasePriority is the priority of the first rule, DefaultSecurityRuleBasePriority if zero
+	BasePriority int
+	// ReservedPriorities are priority ranges left free for user-defined rules
+	ReservedPriorities []PriorityRange
+	// Descriptions are the descriptions of the rules keyed by port
+	Descriptions map[int]string
+	// Source is the Azure service tag the rules allow traffic from, e.g. AzureLoadBalancer, Internet if empty
+	Source string
+	// Protocols are the protocols allowed keyed by port, each getting its own rule, e.g. Tcp and Udp
+	// for DNS. The ports missing get a single rule allowing any protocol
+	Protocols map[int][]string
+	// AllowIntraCluster prepends a rule allowing any traffic within the VNET, node to node and pod
+	// to pod, which takes the first priority so user-defined deny rules cannot shadow it
+	AllowIntraCluster bool
+}
+
+// PriorityRange is an inclusive range of NSG rule priorities
+type PriorityRange struct {
+	Min int
+	Max int
+}
+
+func (r PriorityRange) contains(priority int) bool {
+	return priority >= r.Min && priority <= r.Max
+}
+
+// VNETSubnetOptions customizes the subnets generated for the cluster VNET
+type VNETSubnetOptions struct {
+	// AddNSG associates each agent subnet with the NSG of its pool
+	AddNSG bool
+	// MasterPrivateEndpointNetworkPolicies enables or disables the network policies of private
+	// endpoints in the master subnet, left to the Azure default if nil
+	MasterPrivateEndpointNetworkPolicies *bool
+	// PrivateEndpointNetworkPolicies enables or disables the network policies of private endpoints
+	// in the agent subnets keyed by pool name, left to the Azure default for the pools missing
+	PrivateEndpointNetworkPolicies map[string]bool
+	// NATGatewayID is the resource ID of the NAT gateway the subnets send their outbound traffic
+	// through, left unset if empty
+	NATGatewayID string
+}
+
+// LoadBalancerRule describes a load balancing rule for a port and the health probe it references.
+// The probe protocol is independent of the rule protocol, so a tcp rule may use an http probe
+type LoadBalancerRule struct {
+	// Port is the frontend port of the rule
+	Port int
+	// BackendPort is the port traffic is sent to on the backends, and that the probe checks, Port if zero
+	BackendPort int
+	// Protocol is the rule protocol, tcp (default) or udp
+	Protocol string
+	// ProbeProtocol is the probe protocol, tcp (default), http or https
+	ProbeProtocol string
+	// ProbePath is the request path for http and https probes, defaults to /
+	ProbePath string
+	// ProbeNamePrefix prefixes the port in the probe name, defaults to the probe protocol
+	ProbeNamePrefix string
+	// DisableOutboundSnat stops the rule from providing outbound SNAT, for backends using outbound rules
+	DisableOutboundSnat bool
+	// NumberOfProbes is the number of consecutive failed probes that take a backend out of rotation,
+	// DefaultLoadBalancerNumberOfProbes if zero. A backend is removed after about NumberOfProbes times
+	// ProbeIntervalInSeconds, so 1 probe every 5 seconds fails over fastest, but also removes a
+	// backend on a single dropped probe, e.g. during a GC pause or a brief network blip
+	NumberOfProbes int
+	// ProbeIntervalInSeconds is the interval between probes, DefaultLoadBalancerProbeIntervalInSeconds
+	// if zero and at least MinLoadBalancerProbeIntervalInSeconds
+	ProbeIntervalInSeconds int
+	// InternalFrontend binds the rule to the private IP frontend of the internal load balancer, e.g.
+	// %sInternalLbIPConfigID, rather than to the public IP frontend, for internal-only services
+	InternalFrontend bool
+}
+
+func (r LoadBalancerRule) getProtocol() string {
+	if r.Protocol == "" {
+		return "tcp"
+	}
+	return strings.ToLower(r.Protocol)
+}
+
+// getLbName returns the prefix of the variables of the load balancer the rule belongs to, name or,
+// for an internal frontend, the internal load balancer of name
+func (r LoadBalancerRule) getLbName(name string) string {
+	if r.InternalFrontend {
+		return name + "Internal"
+	}
+	return name
+}
+
+func (r LoadBalancerRule) getBackendPort() int {
+	if r.BackendPort == 0 {
+		return r.Port
+	}
+	return r.BackendPort
+}
+
+func (r LoadBalancerRule) getNumberOfProbes() int {
+	if r.NumberOfProbes == 0 {
+		return DefaultLoadBalancerNumberOfProbes
+	}
+	return r.NumberOfProbes
+}
+
+func (r LoadBalancerRule) getProbeIntervalInSeconds() int {
+	if r.ProbeIntervalInSeconds == 0 {
+		return DefaultLoadBalancerProbeIntervalInSeconds
+	}
+	return r.ProbeIntervalInSeconds
+}
+
+func (r LoadBalancerRule) getProbeProtocol() string {
+	if r.ProbeProtocol == "" {
+		return "tcp"
+	}
+	return strings.ToLower(r.ProbeProtocol)
+}
+
+func (r LoadBalancerRule) getProbePath() string {
+	if r.ProbePath == "" {
+		return "/"
+	}
+	return r.ProbePath
+}
+
+// KubeConfigOptions customizes the kubeconfig produced by GenerateKubeConfigWithOptions.
+// The zero value produces the default kubeconfig
+type KubeConfigOptions struct {
+	// ProxyURL is emitted as the cluster's proxy-url when set
+	ProxyURL string
+	// AlternateEndpoints adds a cluster and context for each endpoint, e.g. for manual failover
+	AlternateEndpoints []KubeConfigEndpoint
+	// CAFilePath is a PEM certificate file embedded as the certificate authority data instead of
+	// CertificateProfile.CaCertificate when set
+	CAFilePath string
+	// AuthMode selects how the user authenticates, a client certificate or AAD when empty, or
+	// KubeConfigAuthModeToken to use Token
+	AuthMode string
+	// Token is the bearer token of the user, e.g. of a service account, in token auth mode
+	Token string
+	// CloudEnvironment overrides the cloud derived from the location, e.g. for Azure Stack Hub
+	CloudEnvironment *KubeConfigCloudEnvironment
+	// MasterIndex points the kubeconfig at the IP of the master at this index rather than at the
+	// load balancer or FQDN, e.g. to troubleshoot a single master. Availability set masters only
+	MasterIndex *int
+	// Namespace is emitted as the namespace of the contexts when set, so that kubectl defaults to it
+	// rather than to the default namespace
+	Namespace string
+	// UserName names the user of the contexts instead of <dnsPrefix>-admin, e.g. after the principal
+	// the kubeconfig is issued to for auditing
+	UserName string
+}
+
+// KubeConfigCloudEnvironment describes a cloud, such as an Azure Stack Hub instance, whose metadata
+// can't be derived from the location
+type KubeConfigCloudEnvironment struct {
+	// Name is the environment the azure auth provider authenticates against, e.g. AzureStackCloud
+	Name string
+	// ResourceManagerVMDNSSuffix is the DNS suffix of the public IP FQDNs following the location,
+	// e.g. cloudapp.azurestack.external
+	ResourceManagerVMDNSSuffix string
+}
+
+// CustomDataEncodingOptions selects how files written by cloud-init are encoded
+type CustomDataEncodingOptions struct {
+	// Uncompressed emits plain base64 instead of gzipped base64, e.g. to read the custom data while debugging
+	Uncompressed bool
+	// UncompressedThreshold emits plain base64 for files shorter than this many bytes
+	UncompressedThreshold int
+	// Minify strips the comment lines and blank lines of the files before encoding them, see minifyCustomScript
+	Minify bool
+}
+
+// KubeConfigEndpoint is an alternate API server endpoint of a kubeconfig
+type KubeConfigEndpoint struct {
+	// Name names the cluster and the context of the endpoint
+	Name string
+	// Server is the host, and optionally port, of the API server
+	Server string
+}
+
+// AddonStatus describes whether a container addon will be rendered and why
+type AddonStatus struct {
+	Name    string
+	Enabled bool
+	Reason  string
+}
+
 type paramsMap map[string]interface{}